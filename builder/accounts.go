@@ -0,0 +1,143 @@
+package builder
+
+import (
+	archive "archive/tar"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erikh/box/builder/tar"
+)
+
+// accountFiles are the files useradd edits, as named in an archive of /etc.
+// passwd and group are created if missing; the shadow files are only edited
+// if the image has them.
+var accountFiles = []string{"etc/passwd", "etc/group", "etc/shadow", "etc/gshadow"}
+
+// firstID is the lowest uid and gid given to accounts by default, as with
+// useradd.
+const firstID = 1000
+
+// account is a user to add to an image. A uid or gid of -1 picks one.
+type account struct {
+	name  string
+	uid   int
+	gid   int
+	home  string
+	shell string
+}
+
+// add adds the user to the account files read from the image, along with a
+// group of the same name if the user's group does not exist, and returns the
+// files to write back. The uid and gid of the account are filled in.
+func (a *account) add(files map[string]*tar.File) ([]*tar.File, error) {
+	for _, name := range []string{"etc/passwd", "etc/group"} {
+		if files[name] == nil {
+			files[name] = &tar.File{Header: &archive.Header{Name: name, Mode: 0644}}
+		}
+	}
+
+	users := parseEntries(files["etc/passwd"].Content)
+	groups := parseEntries(files["etc/group"].Content)
+
+	if _, ok := users.names[a.name]; ok {
+		return nil, fmt.Errorf("User %q already exists", a.name)
+	}
+
+	if a.uid == -1 {
+		a.uid = users.free(firstID)
+	} else if name, ok := users.ids[a.uid]; ok {
+		return nil, fmt.Errorf("uid %d is already used by %q", a.uid, name)
+	}
+
+	newGroup := false
+
+	if existing, ok := groups.names[a.name]; ok {
+		if a.gid != -1 && a.gid != existing {
+			return nil, fmt.Errorf("Group %q already exists with gid %d", a.name, existing)
+		}
+
+		a.gid = existing
+	} else if a.gid == -1 {
+		a.gid = a.uid
+		if _, ok := groups.ids[a.gid]; ok {
+			a.gid = groups.free(firstID)
+		}
+
+		newGroup = true
+	} else if _, ok := groups.ids[a.gid]; !ok {
+		newGroup = true
+	}
+
+	appendEntry(files["etc/passwd"], fmt.Sprintf("%s:x:%d:%d::%s:%s", a.name, a.uid, a.gid, a.home, a.shell))
+	if files["etc/shadow"] != nil {
+		appendEntry(files["etc/shadow"], fmt.Sprintf("%s:!::0:99999:7:::", a.name))
+	}
+
+	if newGroup {
+		appendEntry(files["etc/group"], fmt.Sprintf("%s:x:%d:", a.name, a.gid))
+		if files["etc/gshadow"] != nil {
+			appendEntry(files["etc/gshadow"], fmt.Sprintf("%s:!::", a.name))
+		}
+	}
+
+	result := []*tar.File{}
+	for _, name := range accountFiles {
+		if files[name] != nil {
+			result = append(result, files[name])
+		}
+	}
+
+	return result, nil
+}
+
+// entries are the names and ids of a passwd-style file.
+type entries struct {
+	names map[string]int
+	ids   map[int]string
+}
+
+func parseEntries(content []byte) entries {
+	e := entries{names: map[string]int{}, ids: map[int]string{}}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || fields[0] == "" {
+			continue
+		}
+
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+
+		e.names[fields[0]] = id
+		if _, ok := e.ids[id]; !ok {
+			e.ids[id] = fields[0]
+		}
+	}
+
+	return e
+}
+
+// free returns the lowest id from start that is not in use.
+func (e entries) free(start int) int {
+	id := start
+	for {
+		if _, ok := e.ids[id]; !ok {
+			return id
+		}
+		id++
+	}
+}
+
+// appendEntry adds a line to the file, which is marked as modified now.
+func appendEntry(file *tar.File, line string) {
+	if len(file.Content) > 0 && file.Content[len(file.Content)-1] != '\n' {
+		file.Content = append(file.Content, '\n')
+	}
+
+	file.Content = append(file.Content, line+"\n"...)
+	file.Header.ModTime = time.Now()
+}
@@ -0,0 +1,77 @@
+package builder
+
+import (
+	"sync"
+
+	"github.com/erikh/box/builder/executor/docker"
+)
+
+// BaseCache holds the base images resolved by from, so builders sharing it,
+// such as those of the plans of a single run of box, resolve each image name
+// once. Later builds starting from the same name use the image the first one
+// resolved, unless one of the builders has tagged another image with it.
+type BaseCache struct {
+	mutex sync.Mutex
+	bases map[string]resolvedBase
+}
+
+// resolvedBase is an image name as from resolved it: the ID of the image, and
+// its digest, if it has one.
+type resolvedBase struct {
+	id     string
+	digest string
+}
+
+// NewBaseCache returns an empty BaseCache.
+func NewBaseCache() *BaseCache {
+	return &BaseCache{bases: map[string]resolvedBase{}}
+}
+
+func (bc *BaseCache) get(name string) (resolvedBase, bool) {
+	if bc == nil {
+		return resolvedBase{}, false
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	base, ok := bc.bases[baseKey(name)]
+	return base, ok
+}
+
+func (bc *BaseCache) set(name string, base resolvedBase) {
+	if bc == nil {
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	bc.bases[baseKey(name)] = base
+}
+
+// forget makes the next from of the name resolve it again, such as after the
+// name was given to an image built.
+func (bc *BaseCache) forget(name string) {
+	if bc == nil {
+		return
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	delete(bc.bases, baseKey(name))
+}
+
+// baseKey returns the name with its tag, so debian and debian:latest are the
+// same image.
+func baseKey(name string) string {
+	repo, tag := docker.SplitTag(name)
+	return repo + ":" + tag
+}
+
+// SetBaseCache makes from resolve image names through the cache, shared with
+// other builders, instead of asking the daemon each time.
+func (b *Builder) SetBaseCache(cache *BaseCache) {
+	b.bases = cache
+}
@@ -1,24 +1,150 @@
 package builder
 
 import (
+	"crypto/rand"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/erikh/box/builder/executor"
 	"github.com/erikh/box/builder/executor/docker"
+	"github.com/erikh/box/builder/tar"
 	"github.com/erikh/box/log"
 	"github.com/fatih/color"
 	mruby "github.com/mitchellh/go-mruby"
 )
 
+// ErrorKind classifies the errors returned by Run.
+type ErrorKind int
+
+const (
+	// ErrPlan is an error in the build plan itself, such as a syntax error or
+	// a call to an undefined verb.
+	ErrPlan ErrorKind = iota
+	// ErrStep is a failed build step, such as a run command exiting non-zero.
+	ErrStep
+	// ErrDaemon is a failure to communicate with the docker daemon.
+	ErrDaemon
+	// ErrDisk is the docker daemon running out of disk space, such as while
+	// committing a layer.
+	ErrDisk
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrStep:
+		return "step"
+	case ErrDaemon:
+		return "daemon"
+	case ErrDisk:
+		return "disk"
+	}
+
+	return "plan"
+}
+
+// BuildError is returned by Run and carries the classification of the error.
+type BuildError struct {
+	Kind ErrorKind
+	Err  error
+	// Step and Verb are the verb call that raised the error, if it was raised
+	// by a verb; Step is 0 otherwise.
+	Step int
+	Verb string
+	// Container is the container kept for inspection by the failed step, if
+	// any.
+	Container string
+}
+
+func (e *BuildError) Error() string {
+	return e.Err.Error()
+}
+
+// verbCall is a verb call in progress and its step number.
+type verbCall struct {
+	step int
+	verb string
+	// key is the cache key of the step, and inputs the files on the host it
+	// read, as recorded in the cache graph. cached is set by verbs that check
+	// the cache themselves, when they find the step in it.
+	key    string
+	inputs []CacheInput
+	cached bool
+}
+
+// CacheStep is a step of a build as it was looked up in the cache, as returned
+// by CacheGraph.
+type CacheStep struct {
+	Step int      `json:"step"`
+	Verb string   `json:"verb"`
+	Args []string `json:"args"`
+	// Key is the cache key of the step; copy is keyed by the sum of what it
+	// copies. ParentKey is the key of the step that produced the image the
+	// step was applied to, if any.
+	Key       string `json:"key"`
+	ParentKey string `json:"parent_key,omitempty"`
+	// Parent is the image the step was applied to, and Image the image it
+	// left, which are the same for steps that commit nothing.
+	Parent string       `json:"parent,omitempty"`
+	Image  string       `json:"image,omitempty"`
+	Cached bool         `json:"cached"`
+	Failed bool         `json:"failed,omitempty"`
+	Inputs []CacheInput `json:"inputs,omitempty"`
+}
+
+// CacheInput is a file or directory on the host read by a step, and the sum
+// of its content that is part of the step's cache key.
+type CacheInput struct {
+	Path string `json:"path"`
+	Sum  string `json:"sum"`
+}
+
 // Builder implements the builder core.
 type Builder struct {
-	useCache bool
-	mrb      *mruby.Mrb
-	exec     executor.Executor
+	useCache   bool
+	stepFailed bool
+	// planError is set by verbs raising an error in the plan, such as about
+	// the arguments they were given, rather than a failed step.
+	planError bool
+	// runs counts the calls to Run in progress; plans run by import are
+	// nested within the plan importing them.
+	runs       int
+	current    verbCall
+	keepFinal  bool
+	tagLayers  bool
+	copyOpts   tar.Options
+	step       int
+	cacheHits  int
+	resumed    bool
+	target     string
+	base       string
+	buildID    string
+	lock       *lockfile
+	bases      *BaseCache
+	argv       []string
+	version    string
+	buildArgs  map[string]string
+	labels     map[string]string
+	logDir     string
+	logSecrets []string
+	vars       map[string]string
+	extraHosts []string
+	proxyEnv   []string
+	inputs     []string
+	graph      []CacheStep
+	strict     StrictMode
+	safe       bool
+	imageKeys  map[string]string
+	mrb        *mruby.Mrb
+	exec       executor.Executor
+	lint       *linter
 }
 
 func keep(omitFuncs []string, name string) bool {
@@ -34,44 +160,96 @@ func keep(omitFuncs []string, name string) bool {
 func NewBuilder(tty bool, omitFuncs []string) (*Builder, error) {
 	useCache := os.Getenv("NO_CACHE") == ""
 
-	if !tty {
-		color.NoColor = true
-	}
-
 	exec, err := NewExecutor("docker", useCache, tty)
 	if err != nil {
 		return nil, err
 	}
 
+	return newBuilder(exec, useCache, tty, omitFuncs), nil
+}
+
+// NewBuilderWithClient creates a new builder that talks to docker through the
+// provided client instead of one configured from the environment, such as a
+// client shared by the builders of several plans, or a mock client in tests.
+func NewBuilderWithClient(client docker.Client, tty bool, omitFuncs []string) *Builder {
+	useCache := os.Getenv("NO_CACHE") == ""
+	return newBuilder(docker.NewDockerWithClient(client, useCache, tty), useCache, tty, omitFuncs)
+}
+
+func newBuilder(exec executor.Executor, useCache, tty bool, omitFuncs []string) *Builder {
+	if !tty {
+		color.NoColor = true
+	}
+
 	builder := &Builder{
 		useCache: useCache,
 		mrb:      mruby.NewMrb(),
 		exec:     exec,
 	}
 
+	builder.SetBuildID(newBuildID())
+
 	for name, def := range verbJumpTable {
 		if keep(omitFuncs, name) {
-			builder.AddVerb(name, def.verbFunc, def.argSpec)
+			builder.addVerb(name, def)
 		}
 	}
 
 	for name, def := range funcJumpTable {
 		if keep(omitFuncs, name) {
-			inner := def.fun
-			fn := func(m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
-				return inner(builder, m, self)
-			}
-
-			builder.mrb.TopSelf().SingletonClass().DefineMethod(name, fn, def.argSpec)
+			builder.addFunc(name, def)
 		}
 	}
 
-	return builder, nil
+	return builder
+}
+
+// addFunc adds a function to the mruby dispatch.
+func (b *Builder) addFunc(name string, def funcDefinition) {
+	fn := func(m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+		return def.fun(b, m, self)
+	}
+
+	b.mrb.TopSelf().SingletonClass().DefineMethod(name, fn, def.argSpec)
 }
 
 // Tag tags the last image yielded by the builder with the provided name.
 func (b *Builder) Tag(name string) error {
-	return b.exec.Tag(name)
+	if err := b.exec.Tag(name); err != nil {
+		return err
+	}
+
+	b.bases.forget(name)
+	return nil
+}
+
+// Save writes the result of the build to w as a tar archive, as docker save
+// would. The archive holds the provided tags of the image, or just the image
+// if none are provided.
+func (b *Builder) Save(w io.Writer, tags []string) error {
+	if len(tags) == 0 {
+		tags = []string{b.ImageID()}
+	}
+
+	return b.exec.Save(tags, w)
+}
+
+// Unload removes the result of the build, and the provided tags of it, from
+// the image store. The layers beneath it are kept for the build cache, unless
+// caching is off.
+func (b *Builder) Unload(tags []string) error {
+	for _, tag := range tags {
+		if err := b.exec.RemoveImage(tag, !b.useCache); err != nil {
+			return err
+		}
+	}
+
+	// removing the last tag removes the image as well.
+	if len(tags) > 0 {
+		return nil
+	}
+
+	return b.exec.RemoveImage(b.ImageID(), !b.useCache)
 }
 
 // SetCache sets the caching strategy for builds. Turn on to use caching, off
@@ -82,50 +260,731 @@ func (b *Builder) SetCache(useCache bool) {
 	b.exec.UseCache(useCache)
 }
 
+// AddHosts adds "name:ip" entries to /etc/hosts in the build's containers.
+// They are kept when the plan sets extra_hosts with host_config.
+func (b *Builder) AddHosts(hosts []string) {
+	b.extraHosts = append(b.extraHosts, hosts...)
+	b.exec.HostConfig().ExtraHosts = append(b.exec.HostConfig().ExtraHosts, hosts...)
+}
+
+// SetKeepFinal leaves a container of the final image created when the build
+// succeeds, so it can be inspected or started.
+func (b *Builder) SetKeepFinal(keep bool) {
+	b.keepFinal = keep
+}
+
+// SetTagLayers tags the image each step leaves, including those found in the
+// cache, as box-cache/<short key>, so intermediate images can be inspected or
+// run by name. The steps that start from an image, and the final commit, are
+// not tagged.
+func (b *Builder) SetTagLayers(tag bool) {
+	b.tagLayers = tag
+}
+
+// layerRepository is the repository SetTagLayers tags images in, followed by
+// the short key of the step.
+const layerRepository = "box-cache"
+
+// layerTag returns the name SetTagLayers gives the image of a step with the
+// cache key, applied to the parent image: the first 12 hex digits of the sum
+// of both, as keys are not valid names. The same step applied to another
+// image is tagged apart.
+func layerTag(parent, cacheKey string) string {
+	sum := sha512.Sum512_256([]byte(parent + ", " + cacheKey))
+	return layerRepository + "/" + hex.EncodeToString(sum[:])[:12]
+}
+
+// tagLayer tags the image left by the step of the cache graph's node, with
+// SetTagLayers. Verbs that replace the image leave no layer to tag.
+func (b *Builder) tagLayer(node int, def verbDefinition) error {
+	step := b.graph[node]
+	if !b.tagLayers || step.Image == "" || step.Image == step.Parent || def.replacesImage {
+		return nil
+	}
+
+	name := layerTag(step.Parent, step.Key)
+	if err := b.exec.TagImage(step.Image, name); err != nil {
+		return fmt.Errorf("Could not tag the layer of step %d as %s: %v", step.Step, name, err)
+	}
+
+	log.Tag(name)
+	return nil
+}
+
+// SetKeepOnFailure keeps the container of a failed step for inspection,
+// instead of removing it.
+func (b *Builder) SetKeepOnFailure(keep bool) {
+	b.exec.KeepOnFailure(keep)
+}
+
+// SetImageTTY records a TTY in the configuration of the images built, so
+// containers run from them ask for one. The TTY of the build is never
+// recorded.
+func (b *Builder) SetImageTTY(tty bool) {
+	b.exec.ImageTTY(tty)
+}
+
+// SetFailOnStderr fails run and script steps whose command writes anything to
+// stderr, even if it exits successfully. The commands are not given a TTY, as
+// it would merge stderr into stdout.
+func (b *Builder) SetFailOnStderr(fail bool) {
+	b.exec.FailOnStderr(fail)
+}
+
+// proxyVars are the proxy settings passed to the commands run with
+// SetUseProxy, in both of the cases tools read them in.
+var proxyVars = []string{
+	"HTTP_PROXY", "http_proxy",
+	"HTTPS_PROXY", "https_proxy",
+	"FTP_PROXY", "ftp_proxy",
+	"NO_PROXY", "no_proxy",
+	"ALL_PROXY", "all_proxy",
+}
+
+// SetUseProxy passes the proxy settings of box's environment, such as
+// HTTP_PROXY, to the commands of run, script, run_expect and wait_for.
+// They are not part of the image or of the cache keys of the steps. The
+// settings are read when this is called.
+func (b *Builder) SetUseProxy(useProxy bool) {
+	b.proxyEnv = nil
+
+	if !useProxy {
+		return
+	}
+
+	for _, name := range proxyVars {
+		if value, ok := os.LookupEnv(name); ok {
+			b.proxyEnv = append(b.proxyEnv, name+"="+value)
+		}
+	}
+}
+
+// withProxy returns the environment with the proxy settings enabled by
+// SetUseProxy added, replacing those of the image.
+func (b *Builder) withProxy(env []string) []string {
+	for _, entry := range b.proxyEnv {
+		parts := strings.SplitN(entry, "=", 2)
+		env = setEnv(env, parts[0], parts[1])
+	}
+
+	return env
+}
+
+// SetStrict enables the policy checks of strict mode: run and script may not
+// pipe a download into a shell, from may not use an image tagged latest, or
+// untagged, and the image built may not run as root. With StrictWarn the
+// violations are reported, and with StrictFail the first fails the build.
+func (b *Builder) SetStrict(mode StrictMode) {
+	b.strict = mode
+}
+
+// SetSkipEmpty turns off committing layers for steps that run a container but
+// do not change its filesystem.
+func (b *Builder) SetSkipEmpty(skip bool) {
+	b.exec.SkipEmpty(skip)
+}
+
+// SetStrictCopy makes files that copy cannot read fail the build, instead of
+// being skipped with a warning.
+func (b *Builder) SetStrictCopy(strict bool) {
+	b.copyOpts.Strict = strict
+}
+
+// SetReproducibleCopy makes the layers committed by copy depend only on the
+// names, contents and permissions of the files copied. Files are owned by
+// root, and modification times later than modTime are set to it.
+func (b *Builder) SetReproducibleCopy(modTime time.Time) {
+	b.copyOpts.Normalize = true
+	b.copyOpts.ModTime = modTime
+}
+
+// SetTempDir makes the build write its scratch files, such as the archives
+// of copy and flatten, to dir instead of os.TempDir().
+func (b *Builder) SetTempDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	b.copyOpts.TempDir = dir
+	return nil
+}
+
+// SetContextDir makes copy, and the files given to run with stdin and
+// env_file, resolve relative paths against dir instead of the current
+// directory, such as a build context unpacked from an archive.
+func (b *Builder) SetContextDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	b.copyOpts.Root = dir
+	return nil
+}
+
+// contextPath returns where the relative path given to a verb is found on
+// the host: within the context directory, if one is set. Nothing outside of
+// a context is read, as with copy, so with one, absolute paths and those
+// leading above it are an error.
+func (b *Builder) contextPath(path string) (string, error) {
+	if b.copyOpts.Root == "" {
+		return path, nil
+	}
+
+	clean := filepath.Clean(path)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the build context", path)
+	}
+
+	return filepath.Join(b.copyOpts.Root, clean), nil
+}
+
+// SetLogDir writes the output of each run and script step to a file of its
+// own in dir, named after the step, such as 03-run.log, in addition to
+// printing it. The secrets are redacted from the files as they are from the
+// output. The directory is created if missing.
+func (b *Builder) SetLogDir(dir string, secrets []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	b.logDir = dir
+	b.logSecrets = secrets
+	return nil
+}
+
+// openStepLog creates the log file of the current step in the log directory.
+// The returned function closes it.
+func (b *Builder) openStepLog() (io.Writer, func() error, error) {
+	name := fmt.Sprintf("%02d-%s.log", b.current.step, b.current.verb)
+
+	f, err := os.Create(filepath.Join(b.logDir, name))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(b.logSecrets) == 0 {
+		return f, f.Close, nil
+	}
+
+	w := log.NewRedactWriter(f, b.logSecrets)
+	closer := func() error {
+		err := w.Close()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		return err
+	}
+
+	return w, closer, nil
+}
+
+// SetAuthor sets the author recorded in every image the build commits.
+func (b *Builder) SetAuthor(author string) {
+	b.exec.SetAuthor(author)
+}
+
+// SetBuildID sets the ID the containers created by the build are labeled
+// with, or for those layers are committed from, named after. A random ID is
+// generated when the builder is created.
+func (b *Builder) SetBuildID(id string) {
+	b.buildID = id
+	b.exec.SetBuildID(id)
+}
+
+// BuildID returns the ID of the build.
+func (b *Builder) BuildID() string {
+	return b.buildID
+}
+
+// newBuildID returns a random build ID.
+func newBuildID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("could not generate a build ID: %v", err))
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+// SetLockfile pins the images used by from to the digests recorded in the
+// lockfile at the provided path. Images not yet in the lockfile are added to
+// it once resolved.
+func (b *Builder) SetLockfile(path string) error {
+	lf, err := loadLockfile(path)
+	if err != nil {
+		return err
+	}
+
+	b.lock = lf
+	return nil
+}
+
+// SetTarget sets the build target, which is exposed to the plan through the
+// target and only_in functions.
+func (b *Builder) SetTarget(target string) {
+	b.target = target
+}
+
+// SetArgv sets the positional arguments exposed to the plan through the argv
+// function.
+func (b *Builder) SetArgv(argv []string) {
+	b.argv = argv
+}
+
+// SetVersion sets the version of box that plans check with box_version.
+// Without one, box_version accepts any version.
+func (b *Builder) SetVersion(version string) {
+	b.version = version
+}
+
+// SetArg sets the build argument returned by the arg function.
+func (b *Builder) SetArg(name, value string) {
+	if b.buildArgs == nil {
+		b.buildArgs = map[string]string{}
+	}
+
+	b.buildArgs[name] = value
+}
+
+// SetLabel sets a label applied to the final image, after the plan's steps,
+// so the value does not affect their cache. It overrides a label of the same
+// name set by the plan.
+func (b *Builder) SetLabel(name, value string) {
+	if b.labels == nil {
+		b.labels = map[string]string{}
+	}
+
+	b.labels[name] = value
+}
+
+// labelChanges returns the LABEL instructions setting the labels given with
+// SetLabel, in order of name.
+func (b *Builder) labelChanges() []string {
+	names := []string{}
+	for name := range b.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+	changes := []string{}
+	for _, name := range names {
+		changes = append(changes, fmt.Sprintf(`LABEL "%s"="%s"`, quote.Replace(name), quote.Replace(b.labels[name])))
+	}
+
+	return changes
+}
+
+// SetCacheDir keeps an on-disk index of cache keys in the provided directory,
+// so cache lookups do not have to scan every image on the daemon.
+func (b *Builder) SetCacheDir(dir string) error {
+	return b.exec.UseCacheDir(dir)
+}
+
+// AddCacheSource fetches the named image, if necessary, and allows steps to
+// be satisfied by it when its history matches the build.
+func (b *Builder) AddCacheSource(name string) error {
+	return b.exec.AddCacheSource(name)
+}
+
+// CacheTo tags the layers of the build so that a later build on another host
+// may use them with AddCacheSource. Given name:tag, each layer is tagged
+// name:tag-N in order, and the final image is tagged name:tag. If push is
+// true, the tags are pushed as well.
+func (b *Builder) CacheTo(ref string, push bool) error {
+	repo, tag := docker.SplitTag(ref)
+	layers := b.exec.Layers()
+	names := []string{}
+
+	for i, id := range layers {
+		name := fmt.Sprintf("%s:%s-%d", repo, tag, i+1)
+		if i == len(layers)-1 {
+			name = fmt.Sprintf("%s:%s", repo, tag)
+		}
+
+		if err := b.exec.TagImage(id, name); err != nil {
+			return err
+		}
+
+		names = append(names, name)
+	}
+
+	if push {
+		for _, name := range names {
+			if err := b.exec.Push(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Inputs returns the files and directories on the host the build has read so
+// far, in the order they were read: the sources of copy and from_layer, and
+// the files given to run and script with stdin, env_file and cache_on.
+func (b *Builder) Inputs() []string {
+	return b.inputs
+}
+
+// CacheGraph returns the steps of the build so far, in the order they
+// started, with their cache keys and inputs, and whether they were found in
+// the cache. Steps within a block follow the step they belong to.
+func (b *Builder) CacheGraph() []CacheStep {
+	return b.graph
+}
+
 // ImageID returns the latest known Image identifier that we committed. At the
 // end of the run this will be the golden docker image.
 func (b *Builder) ImageID() string {
+	if b.lint != nil {
+		return b.lint.image
+	}
+
 	return b.exec.ImageID()
 }
 
+// Executor returns the executor the builder manipulates images with, for use
+// by verbs registered with RegisterVerb.
+func (b *Builder) Executor() executor.Executor {
+	return b.exec
+}
+
+// RegisterVerb adds a verb to the ones defined by the builders created from
+// here on, so programs embedding box can extend the language. The verb is
+// called like the built-in ones: it is numbered, logged and cached by its
+// arguments, and should commit its result with Executor().Commit and the
+// cacheKey it is passed. Names already used by a verb or function are refused.
+// It must not be called concurrently with NewBuilder or Lint.
+func RegisterVerb(name string, fn VerbFunc, spec mruby.ArgSpec) error {
+	if _, ok := verbJumpTable[name]; ok {
+		return fmt.Errorf("Verb %q is already defined", name)
+	}
+
+	if _, ok := funcJumpTable[name]; ok {
+		return fmt.Errorf("%q is already defined as a function", name)
+	}
+
+	verbJumpTable[name] = verbDefinition{verbFunc: fn, argSpec: spec}
+	return nil
+}
+
+// VerbInfo describes a verb or function of the language, and the arguments it
+// takes.
+type VerbInfo struct {
+	Name string `json:"name"`
+	// Function is true for functions, which compute values without committing
+	// a layer, and false for verbs.
+	Function bool `json:"function"`
+	Required int  `json:"required"`
+	Optional int  `json:"optional"`
+	// Rest is true if any number of arguments may follow, such as an options
+	// hash.
+	Rest  bool `json:"rest"`
+	Block bool `json:"block"`
+}
+
+// String returns the call signature, in ruby notation, such as
+// "with_user(arg1, &block)".
+func (vi VerbInfo) String() string {
+	args := []string{}
+	for i := 1; i <= vi.Required; i++ {
+		args = append(args, fmt.Sprintf("arg%d", i))
+	}
+
+	for i := vi.Required + 1; i <= vi.Required+vi.Optional; i++ {
+		args = append(args, fmt.Sprintf("arg%d = nil", i))
+	}
+
+	if vi.Rest {
+		args = append(args, "*args")
+	}
+
+	if vi.Block {
+		args = append(args, "&block")
+	}
+
+	return fmt.Sprintf("%s(%s)", vi.Name, strings.Join(args, ", "))
+}
+
+// newVerbInfo decodes the argument spec, laid out as mruby's MRB_ARGS macros
+// do.
+func newVerbInfo(name string, function bool, spec mruby.ArgSpec) VerbInfo {
+	return VerbInfo{
+		Name:     name,
+		Function: function,
+		Required: int(spec>>18) & 0x1f,
+		Optional: int(spec>>13) & 0x1f,
+		Rest:     spec&(1<<12) != 0,
+		Block:    spec&1 != 0,
+	}
+}
+
+// Verbs returns the verbs and functions a builder created with omitFuncs
+// provides, including those added with RegisterVerb, sorted by name.
+func Verbs(omitFuncs []string) []VerbInfo {
+	verbs := []VerbInfo{}
+
+	for name, def := range verbJumpTable {
+		if keep(omitFuncs, name) {
+			verbs = append(verbs, newVerbInfo(name, false, def.argSpec))
+		}
+	}
+
+	for name, def := range funcJumpTable {
+		if keep(omitFuncs, name) {
+			verbs = append(verbs, newVerbInfo(name, true, def.argSpec))
+		}
+	}
+
+	sort.Slice(verbs, func(i, j int) bool { return verbs[i].Name < verbs[j].Name })
+	return verbs
+}
+
 // AddVerb adds a function to the mruby dispatch as well as adding hooks around
 // the call to ensure containers are committed and intermediate layers are
 // cleared.
-func (b *Builder) AddVerb(name string, fn verbFunc, args mruby.ArgSpec) {
+func (b *Builder) AddVerb(name string, fn VerbFunc, args mruby.ArgSpec) {
+	b.addVerb(name, verbDefinition{verbFunc: fn, argSpec: args})
+}
+
+// addVerb is AddVerb for a definition of the jump table, which also says how
+// the verb is cached.
+func (b *Builder) addVerb(name string, def verbDefinition) {
 	builderFunc := func(m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 		args := m.GetArgs()
+
+		if b.lint != nil {
+			return b.lint.record(name, args, m)
+		}
+
 		strArgs := extractStringArgs(args)
-		cacheKey := strings.Join(append([]string{name}, strArgs...), ", ")
+		keyArgs := strArgs
+		inputs := []CacheInput{}
+
+		if def.inputKey != nil {
+			sum, verbInputs, err := def.inputKey(b, name, args)
+			if err != nil {
+				return nil, b.planException(m, err.Error())
+			}
+
+			if sum != "" {
+				keyArgs = append(append([]string{}, strArgs...), sum)
+				inputs = verbInputs
+			}
+		}
+
+		cacheKey := strings.Join(append([]string{name}, keyArgs...), ", ")
 		sum := sha512.Sum512_256([]byte(cacheKey))
 		cacheKey = base64.StdEncoding.EncodeToString([]byte(sum[:]))
 
 		log.BuildStep(name, strings.Join(strArgs, ", "))
+		b.step++
 
-		cached, err := b.exec.CheckCache(cacheKey)
-		if err != nil {
-			return nil, createException(m, err.Error())
+		// an error leaves the call in place for classify; verbs in a block
+		// return to the enclosing verb.
+		caller := b.current
+		b.current = verbCall{step: b.step, verb: name, key: cacheKey, inputs: inputs}
+
+		if err := b.violate(b.step, name, stepViolation(name, strArgs)); err != nil {
+			return nil, b.planException(m, err.Error())
+		}
+
+		parent := b.exec.ImageID()
+		node := len(b.graph)
+		b.graph = append(b.graph, CacheStep{Step: b.step, Verb: name, Args: strArgs, Key: cacheKey, ParentKey: b.imageKeys[parent], Parent: parent, Inputs: inputs})
+
+		// record fills in the step's node of the cache graph once it is done.
+		// A step failing within a block leaves the call in place, which then
+		// belongs to that step.
+		record := func(cached, failed bool) {
+			step := &b.graph[node]
+			if b.current.step == step.Step {
+				step.Key, step.Inputs = b.current.key, b.current.inputs
+				cached = cached || b.current.cached
+			}
+
+			step.Image = b.exec.ImageID()
+			step.Cached, step.Failed = cached, failed
+
+			if step.Image != parent && !failed {
+				if b.imageKeys == nil {
+					b.imageKeys = map[string]string{}
+				}
+				b.imageKeys[step.Image] = step.Key
+			}
+		}
+
+		cached := false
+		if !def.checksCache {
+			var err error
+			cached, err = b.checkCache(cacheKey)
+			if err != nil {
+				record(false, true)
+				b.stepFailed = true
+				return nil, createException(m, err.Error())
+			}
 		}
 
 		// if we don't do this for debug, we will step past it on successive runs
-		if !cached || name == "debug" {
-			return fn(b, cacheKey, args, m, self)
+		if !cached || def.alwaysRuns {
+			b.planError = false
+			val, exc := def.verbFunc(b, cacheKey, args, m, self)
+			if exc != nil {
+				record(false, true)
+				b.stepFailed = !b.planError
+				return val, exc
+			}
+
+			// the steps within a block report their own sizes.
+			if !def.replacesImage && !hasBlock(args) && parent != "" && b.exec.ImageID() != parent {
+				if err := b.logLayerSize(name, strArgs, parent); err != nil {
+					record(false, true)
+					b.stepFailed = true
+					return nil, createException(m, err.Error())
+				}
+			}
+
+			record(false, false)
+			if err := b.tagLayer(node, def); err != nil {
+				b.stepFailed = true
+				return nil, createException(m, err.Error())
+			}
+
+			b.current = caller
+			return val, exc
 		}
 
+		record(true, false)
+		if err := b.tagLayer(node, def); err != nil {
+			b.stepFailed = true
+			return nil, createException(m, err.Error())
+		}
+
+		b.current = caller
 		return nil, nil
 	}
 
-	b.mrb.TopSelf().SingletonClass().DefineMethod(name, builderFunc, args)
+	b.mrb.TopSelf().SingletonClass().DefineMethod(name, builderFunc, def.argSpec)
+}
+
+// logLayerSize reports how much the step grew, or shrank, the image it was
+// applied to.
+func (b *Builder) logLayerSize(name string, args []string, parent string) error {
+	before, err := b.exec.ImageSize(parent)
+	if err != nil {
+		return fmt.Errorf("Could not inspect the size of %q: %v", parent, err)
+	}
+
+	after, err := b.exec.ImageSize(b.exec.ImageID())
+	if err != nil {
+		return fmt.Errorf("Could not inspect the size of %q: %v", b.exec.ImageID(), err)
+	}
+
+	log.LayerSize(name, strings.Join(args, ", "), after-before)
+	return nil
 }
 
-// Run the script.
+// checkCache consults the cache for the current step. The first step to miss
+// the cache after others were found in it is reported as where the build
+// resumes; an earlier build of the plan stopped there.
+func (b *Builder) checkCache(cacheKey string) (bool, error) {
+	cacheable := b.useCache && b.exec.ImageID() != ""
+
+	cached, err := b.exec.CheckCache(cacheKey)
+	if err != nil {
+		return false, err
+	}
+
+	if cached {
+		log.CacheHit(b.current.step, b.current.verb, cacheKey, b.exec.ImageID())
+	}
+
+	if cacheable {
+		if cached {
+			b.cacheHits++
+		} else if b.cacheHits > 0 && !b.resumed {
+			b.resumed = true
+			log.Resume(b.step)
+		}
+	}
+
+	return cached, nil
+}
+
+// classify wraps an error from the run of a script in a *BuildError. Errors
+// raised by verbs are step failures unless the daemon could not be reached or
+// ran out of disk space; everything else originated in the plan itself.
+func (b *Builder) classify(err error) error {
+	if _, ok := err.(*BuildError); ok {
+		return err
+	}
+
+	kind := ErrPlan
+
+	if b.stepFailed {
+		kind = ErrStep
+	}
+
+	if docker.IsErrConnectionFailed(err) {
+		kind = ErrDaemon
+	}
+
+	// the daemon reports ENOSPC as it would any other error, with the path it
+	// failed to write to.
+	if message := strings.ToLower(err.Error()); strings.Contains(message, "no space left on device") || strings.Contains(message, "enospc") {
+		kind = ErrDisk
+		err = fmt.Errorf("The Docker daemon is out of disk space; free some, such as with docker system prune, and build again (%v)", err)
+	}
+
+	berr := &BuildError{Kind: kind, Err: err, Step: b.current.step, Verb: b.current.verb}
+
+	// linting has no executor.
+	if b.exec != nil {
+		berr.Container = b.exec.KeptContainer()
+	}
+
+	return berr
+}
+
+// Run the script. Errors returned are of type *BuildError.
 func (b *Builder) Run(script string) (*mruby.MrbValue, error) {
+	b.runs++
+	defer func() { b.runs-- }()
+
+	// only the outermost plan finishes the final image; an imported plan is
+	// followed by the rest of the one importing it.
+	final := b.runs == 1
+
+	b.stepFailed = false
+	b.current = verbCall{}
+
 	if _, err := b.mrb.LoadString(script); err != nil {
-		return nil, err
+		return nil, b.classify(err)
 	}
 
+	if b.lint != nil {
+		return mruby.String(b.ImageID()).MrbValue(b.mrb), nil
+	}
+
+	// the remaining operations only involve the daemon.
+	b.stepFailed = true
+
 	id, err := b.exec.Create()
 	if err != nil {
-		return nil, err
+		return nil, b.classify(err)
 	}
 
 	defer b.exec.Destroy(id)
@@ -135,18 +994,47 @@ func (b *Builder) Run(script string) (*mruby.MrbValue, error) {
 	// part of box. This also slightly forces users to consider the users and
 	// paths involved in running their images, which I think is a good thing.
 
-	if b.exec.Config().WorkDir == "" { // if the working dir is empty, set to / -- don't inherit.
-		b.exec.Config().WorkDir = "/"
+	// Windows images have neither root nor /, and are left with the defaults of
+	// the platform.
+	if !b.windows() {
+		if b.exec.Config().WorkDir == "" { // if the working dir is empty, set to / -- don't inherit.
+			b.exec.Config().WorkDir = "/"
+		}
+
+		if b.exec.Config().User == "" { // if the user is empty, do not inherit; use root.
+			b.exec.Config().User = "root"
+		}
+
+		// the violation is the plan's, not a step's.
+		if final {
+			if err := b.violate(0, "", imageViolation(b.exec.Config().User)); err != nil {
+				b.stepFailed = false
+				return nil, b.classify(err)
+			}
+		}
 	}
 
-	if b.exec.Config().User == "" { // if the user is empty, do not inherit; use root.
-		b.exec.Config().User = "root"
+	// this commit is never cached, so labels given to box only change the final
+	// image.
+	if final {
+		b.exec.AddChanges(b.labelChanges()...)
 	}
 
 	if err := b.exec.Commit("", nil); err != nil {
-		return nil, err
+		return nil, b.classify(err)
 	}
 
+	if b.keepFinal && final {
+		id, err := b.exec.CreateFinal()
+		if err != nil {
+			return nil, b.classify(err)
+		}
+
+		log.Container(id)
+	}
+
+	b.stepFailed = false
+
 	return mruby.String(b.exec.ImageID()).MrbValue(b.mrb), nil
 }
 
@@ -1,16 +1,24 @@
 package builder
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	. "testing"
+	"time"
 
 	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
 	"github.com/docker/engine-api/types/strslice"
+	mruby "github.com/mitchellh/go-mruby"
 
 	. "gopkg.in/check.v1"
 )
@@ -207,6 +215,64 @@ func (bs *builderSuite) TestFlatten(c *C) {
 	c.Assert(len(inspect.RootFS.Layers), Not(Equals), 1)
 }
 
+func (bs *builderSuite) TestCompressTo(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "echo foo >bar"
+    run "rm /etc/issue"
+    run "echo baz >bar"
+    env "COMPRESS" => "yes"
+  `)
+	c.Assert(err, IsNil)
+
+	base, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "debian")
+	c.Assert(err, IsNil)
+
+	c.Assert(b.CompressTo(len(base.RootFS.Layers)+1), IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(len(inspect.RootFS.Layers), Equals, len(base.RootFS.Layers)+1)
+	c.Assert(inspect.Config.Env, DeepEquals, b.exec.Config().Env)
+
+	// an image with few enough layers is left alone.
+	id := b.exec.Config().Image
+	c.Assert(b.CompressTo(len(inspect.RootFS.Layers)), IsNil)
+	c.Assert(b.exec.Config().Image, Equals, id)
+
+	c.Assert(string(readContainerFile(c, b, "/bar")), Equals, "baz\n")
+	c.Assert(string(runContainerCommand(c, b, []string{"sh", "-c", "test -e /etc/issue || echo removed"})), Equals, "removed\n")
+}
+
+func (bs *builderSuite) TestCheckpoint(c *C) {
+	defer dockerClient.ImageRemove(context.Background(), "box-checkpoint:base-ready", types.ImageRemoveOptions{})
+
+	b, err := runBuilder(`
+    from "debian"
+    run "echo expensive >/prefix"
+    checkpoint "base-ready"
+    run "echo experiment >/suffix"
+  `)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "box-checkpoint:base-ready")
+	c.Assert(err, IsNil)
+	c.Assert(inspect.ID, Not(Equals), b.ImageID())
+
+	b, err = runBuilder(`from "box-checkpoint:base-ready"`)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/prefix")), Equals, "expensive\n")
+
+	for _, script := range []string{
+		`checkpoint "early"`,
+		`from "debian"; checkpoint "has space"`,
+		`from "debian"; checkpoint "repo:tag"`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
 func (bs *builderSuite) TestEntrypointCmd(c *C) {
 	// the echo hi is to trigger a specific interaction problem with entrypoint
 	// and run where the entrypoint/cmd would not be overridden during commit
@@ -249,6 +315,33 @@ func (bs *builderSuite) TestEntrypointCmd(c *C) {
 	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo"})
 	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
 
+	// both in exec form, the cmd follows the entrypoint's arguments.
+	b, err = runBuilder(`
+    from "debian"
+    entrypoint "/bin/echo", "-n"
+    cmd "hello", "world"
+  `)
+
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo", "-n"})
+	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hello", "world"})
+
+	// a later entrypoint clears the cmd set for the earlier one.
+	b, err = runBuilder(`
+    from "debian"
+    entrypoint "/bin/echo"
+    cmd "hi"
+    entrypoint "/bin/cat"
+  `)
+
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/cat"})
+	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{})
+
 	// normal cmd usage.
 	b, err = runBuilder(`
     from "debian"
@@ -260,6 +353,19 @@ func (bs *builderSuite) TestEntrypointCmd(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(inspect.Config.Entrypoint, IsNil)
 	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
+
+	// blocks are not arguments.
+	b, err = runBuilder(`
+    from "debian"
+    entrypoint("/bin/echo") { }
+    cmd("hi") { }
+    run("echo -n hi >/hi") { }
+  `)
+
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().Entrypoint, DeepEquals, []string{"/bin/echo"})
+	c.Assert(b.exec.Config().Cmd, DeepEquals, []string{"hi"})
+	c.Assert(string(readContainerFile(c, b, "/hi")), Equals, "hi")
 }
 
 func (bs *builderSuite) TestRun(c *C) {
@@ -315,15 +421,41 @@ func (bs *builderSuite) TestRun(c *C) {
 	c.Assert(err, IsNil)
 	result = readContainerFile(c, b, "/test/bar")
 	c.Assert(string(result), Equals, "foo")
+
+	b, err = runBuilder(`
+    from "debian"
+    env "KEEP" => "yes"
+    run "echo -n $KEEP $FOO >/bar", env: { "FOO" => "bar" }
+  `)
+
+	c.Assert(err, IsNil)
+	result = readContainerFile(c, b, "/bar")
+	c.Assert(string(result), Equals, "yes bar")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	for _, env := range inspect.Config.Env {
+		c.Assert(strings.HasPrefix(env, "FOO="), Equals, false)
+	}
+
+	_, err = runBuilder(`
+    from "debian"
+    run "true", bogus: 1
+  `)
+
+	c.Assert(err, NotNil)
 }
 
 func (bs *builderSuite) TestWorkDirInside(c *C) {
-	_, err := runBuilder(`
+	b, err := runBuilder(`
     from "debian"
-    workdir "."
+    workdir "test"
+    workdir "sub"
+    workdir "../other/."
   `)
 
-	c.Assert(err, NotNil)
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().WorkDir, Equals, "/test/other")
 
 	_, err = runBuilder(`
     from "debian"
@@ -334,7 +466,7 @@ func (bs *builderSuite) TestWorkDirInside(c *C) {
 
 	c.Assert(err, NotNil)
 
-	b, err := runBuilder(`
+	b, err = runBuilder(`
     from "debian"
     run "mkdir /test"
     workdir "/test"
@@ -622,6 +754,20 @@ func (bs *builderSuite) TestEnv(c *C) {
 
 	c.Assert(count, Equals, 2)
 
+	// keys already set, including inherited ones, are replaced in place.
+	b, err = runBuilder(`
+    from "debian"
+    env "A" => "1", "PATH" => "/bin", "B" => "2"
+    env "PATH" => "/usr/bin:/bin", "A" => "3"
+  `)
+	c.Assert(err, IsNil)
+
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Env, DeepEquals, []string{"PATH=/usr/bin:/bin", "A=3", "B=2"})
+
+	c.Assert(setEnv([]string{"A=1", "B=2", "A=3"}, "A", "4"), DeepEquals, []string{"A=4", "B=2"})
+
 	_, err = runBuilder(`
     from "debian"
     env "TERM" => "myterm"
@@ -691,3 +837,1696 @@ func (bs *builderSuite) TestReaderFuncs(c *C) {
   `)
 	c.Assert(err, NotNil)
 }
+
+func (bs *builderSuite) TestOnlyIn(c *C) {
+	plan := `
+    from "debian"
+    only_in "release", "ci" do
+      run "echo -n #{target} >/target"
+    end
+  `
+
+	b, err := NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	b.SetTarget("release")
+	_, err = b.Run(plan)
+	c.Assert(err, IsNil)
+
+	content, err := b.exec.CopyOneFileFromContainer("/target")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "release")
+
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+
+	_, err = b.exec.CopyOneFileFromContainer("/target")
+	c.Assert(err, NotNil)
+
+	_, err = runBuilder(`
+    from "debian"
+    only_in "release"
+  `)
+	c.Assert(err, NotNil)
+}
+
+func (bs *builderSuite) TestDelete(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "mkdir -p /test/cache /test/keep && touch /test/cache/a /test/cache/b '/test/with space' /test/keep/c"
+    run "chown -R nobody /test"
+    user "nobody"
+    workdir "/test"
+    delete "cache/*", "/test/with space"
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().User, Equals, "nobody")
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "find /test | sort"})
+	c.Assert(string(result), Equals, "/test\n/test/cache\n/test/keep\n/test/keep/c\n")
+
+	_, err = runBuilder(`
+    from "debian"
+    delete
+  `)
+	c.Assert(err, NotNil)
+}
+
+func (bs *builderSuite) TestDeleteCached(c *C) {
+	os.Setenv("NO_CACHE", "")
+
+	// the image keeps its own configuration, whether delete ran or was found
+	// in the cache.
+	for i := 0; i < 2; i++ {
+		b, err := runBuilder(`
+      from "debian"
+      run "touch /tmp/delete-cached"
+      user "nobody"
+      entrypoint "/bin/echo"
+      cmd "hello"
+      delete "/tmp/delete-cached"
+    `)
+		c.Assert(err, IsNil)
+
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.ImageID())
+		c.Assert(err, IsNil)
+		c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo"}, Commentf("build %d", i+1))
+		c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hello"}, Commentf("build %d", i+1))
+		c.Assert(inspect.Config.User, Equals, "nobody", Commentf("build %d", i+1))
+	}
+}
+
+func (bs *builderSuite) TestFromImageID(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "touch /built"
+  `)
+	c.Assert(err, IsNil)
+	id := b.ImageID()
+
+	b, err = runBuilder(fmt.Sprintf(`
+    from %q
+    run "test -f /built"
+  `, id))
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Not(Equals), id)
+}
+
+func (bs *builderSuite) TestFromLayer(c *C) {
+	dir, err := ioutil.TempDir("", "box-from-layer")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	exportRootfs(c, "debian", filepath.Join(dir, "rootfs"))
+
+	wd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	c.Assert(os.Chdir(dir), IsNil)
+	defer os.Chdir(wd)
+
+	os.Setenv("NO_CACHE", "")
+
+	plan := `
+    from_layer "rootfs"
+    run "test -x /bin/sh && test ! -e /rootfs"
+  `
+
+	b, err := runBuilder(plan)
+	c.Assert(err, IsNil)
+	id := b.ImageID()
+
+	// the layer is the same wherever the directory is.
+	c.Assert(os.Mkdir("moved", 0755), IsNil)
+	c.Assert(os.Rename("rootfs", filepath.Join("moved", "rootfs")), IsNil)
+	c.Assert(os.Chdir("moved"), IsNil)
+
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Equals, id)
+}
+
+// exportRootfs unpacks the filesystem of a container of the image into dir.
+func exportRootfs(c *C, image, dir string) {
+	created, err := dockerClient.ContainerCreate(context.Background(), &container.Config{Image: image}, nil, nil, "")
+	c.Assert(err, IsNil)
+	defer dockerClient.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+
+	export, err := dockerClient.ContainerExport(context.Background(), created.ID)
+	c.Assert(err, IsNil)
+	defer export.Close()
+
+	tr := tar.NewReader(export)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		target := filepath.Join(dir, header.Name)
+		c.Assert(os.MkdirAll(filepath.Dir(target), 0755), IsNil)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			c.Assert(os.MkdirAll(target, os.FileMode(header.Mode)&os.ModePerm), IsNil)
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode)&os.ModePerm)
+			c.Assert(err, IsNil)
+			_, err = io.Copy(f, tr)
+			f.Close()
+			c.Assert(err, IsNil)
+		case tar.TypeSymlink:
+			c.Assert(os.Symlink(header.Linkname, target), IsNil)
+		case tar.TypeLink:
+			c.Assert(os.Link(filepath.Join(dir, header.Linkname), target), IsNil)
+		}
+	}
+}
+
+func (bs *builderSuite) TestRunExpect(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run_expect "cat /etc/debian_version", '^[0-9]+\.'
+    run_expect "echo one; echo two", '(?m)^two$'
+    run_expect "seq 100000", '(?m)^100000\s*\z'
+  `)
+	c.Assert(err, IsNil)
+
+	// nothing is committed.
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.ImageID())
+	c.Assert(err, IsNil)
+	base, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "debian")
+	c.Assert(err, IsNil)
+	c.Assert(len(inspect.RootFS.Layers), Equals, len(base.RootFS.Layers))
+
+	_, err = runBuilder(`from "debian"; run_expect "echo 2.7", '^3\.'`)
+	c.Assert(err, ErrorMatches, `.*Output of "echo 2.7" does not match.*"2.7".*`)
+	c.Assert(err.(*BuildError).Kind, Equals, ErrStep)
+
+	_, err = runBuilder(`from "debian"; run_expect "false", '.*'`)
+	c.Assert(err, NotNil)
+
+	_, err = runBuilder(`from "debian"; run_expect "true", '('`)
+	c.Assert(err, ErrorMatches, ".*Invalid pattern for run_expect.*")
+}
+
+func (bs *builderSuite) TestEnsureFile(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    workdir "/usr"
+    ensure_file "/etc/passwd"
+    ensure_file "bin"
+    ensure_file "/bin/sh", executable: true
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().WorkDir, Equals, "/usr")
+
+	for _, script := range []string{
+		`from "debian"; ensure_file "/nonexistent"`,
+		`from "debian"; ensure_file "/etc/passwd", executable: true`,
+		`from "debian"; ensure_file "/usr/bin", executable: true`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+		c.Assert(err.(*BuildError).Kind, Equals, ErrStep, Commentf("%s", script))
+	}
+
+	for _, script := range []string{
+		`ensure_file "/etc/passwd"`,
+		`from "debian"; ensure_file "/bin/sh", exec: true`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestChange(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    change "LABEL version=1.0", "EXPOSE 8080/tcp"
+    change "WORKDIR /srv"
+    env GOPATH: "/go"
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().WorkDir, Equals, "/srv")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Labels["version"], Equals, "1.0")
+	c.Assert(inspect.Config.WorkingDir, Equals, "/srv")
+
+	_, ok := inspect.Config.ExposedPorts["8080/tcp"]
+	c.Assert(ok, Equals, true)
+
+	for _, script := range []string{
+		`from "debian"; change`,
+		`from "debian"; change "LABEL"`,
+		`from "debian"; change "RUN ls"`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestMkdir(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    workdir "/srv"
+    mkdir "/var/log/app", "data", mode: 0750, owner: "nobody"
+    mkdir "/test/root"
+    mkdir "/test/group", owner: "nobody:mail"
+  `)
+	c.Assert(err, IsNil)
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "stat -c '%n %a %U %G' /var/log/app /srv/data /test/root /test/group"})
+	c.Assert(string(result), Equals, "/var/log/app 750 nobody nogroup\n/srv/data 750 nobody nogroup\n/test/root 755 root root\n/test/group 755 nobody mail\n")
+
+	for _, script := range []string{
+		`from "debian"; mkdir`,
+		`from "debian"; mkdir "/test", owner: "missing"`,
+		`from "debian"; mkdir "/test", mode: "0755"`,
+		`from "debian"; mkdir "/test", size: 1`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestHostname(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    hostname "buildhost", "example.com"
+    run "hostname >/hostname"
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/hostname")), Equals, "buildhost\n")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.ImageID())
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Hostname, Equals, "buildhost")
+	c.Assert(inspect.Config.Domainname, Equals, "example.com")
+
+	_, err = runBuilder(`from "debian"; hostname "a", "b", "c"`)
+	c.Assert(err, NotNil)
+}
+
+func (bs *builderSuite) TestUseradd(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    useradd "app"
+    useradd "svc", uid: 2000, gid: 100, home: "/srv/svc", shell: "/bin/false"
+    user "app"
+  `)
+	c.Assert(err, IsNil)
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "id; getent passwd svc; getent group app; stat -c '%n %U %G' /home/app /srv/svc; grep -c '^app:' /etc/shadow"})
+	c.Assert(string(result), Equals, "uid=1000(app) gid=1000(app) groups=1000(app)\nsvc:x:2000:100::/srv/svc:/bin/false\napp:x:1000:\n/home/app app app\n/srv/svc svc users\n1\n")
+
+	// images without the account files get them.
+	b, err = runBuilder(`
+    from "debian"
+    run "rm /etc/passwd /etc/group /etc/shadow /etc/gshadow"
+    useradd "app", uid: 1234
+  `)
+	c.Assert(err, IsNil)
+	content, err := b.exec.CopyOneFileFromContainer("/etc/passwd")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "app:x:1234:1234::/home/app:/bin/sh\n")
+
+	content, err = b.exec.CopyOneFileFromContainer("/etc/group")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "app:x:1234:\n")
+
+	for _, script := range []string{
+		`from "debian"; useradd`,
+		`from "debian"; useradd "root"`,
+		`from "debian"; useradd "app", uid: 0`,
+		`from "debian"; useradd "app", uid: "1000"`,
+		`from "debian"; useradd "app", home: "home/app"`,
+		`from "debian"; useradd "app", groups: ["sudo"]`,
+		`from "debian"; useradd "a:b"`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestStrict(c *C) {
+	for name, latest := range map[string]bool{
+		"debian":                    true,
+		"debian:latest":             true,
+		"localhost:5000/app":        true,
+		"debian:bookworm":           false,
+		"localhost:5000/app:1.2":    false,
+		"debian@sha256:abc":         false,
+		"sha256:deadbeef":           false,
+		strings.Repeat("a", 64):     false,
+		"localhost:5000/app:latest": true,
+	} {
+		c.Assert(isLatest(name), Equals, latest, Commentf("%s", name))
+	}
+
+	c.Assert(stepViolation("run", []string{"curl -fsSL https://example.com/install | sh"}), Not(Equals), "")
+	c.Assert(stepViolation("script", []string{"cd /tmp", "wget -qO- https://example.com/install | sudo /bin/bash -s"}), Not(Equals), "")
+	c.Assert(stepViolation("run", []string{"curl -fsSLo /tmp/install https://example.com/install && sh /tmp/install"}), Equals, "")
+	c.Assert(imageViolation("0:0"), Not(Equals), "")
+	c.Assert(imageViolation("nobody"), Equals, "")
+
+	_, err := runBuilder(`from "debian"; tag "box-strict:pinned"`)
+	c.Assert(err, IsNil)
+
+	strict := func(mode StrictMode, plan string) error {
+		b, err := NewBuilder(false, []string{})
+		c.Assert(err, IsNil)
+		defer b.Close()
+
+		b.SetStrict(mode)
+		_, err = b.Run(plan)
+		return err
+	}
+
+	for _, plan := range []string{
+		`from "debian"; user "nobody"`,
+		`from "box-strict:pinned"; run "curl -fsSL https://example.com/install | sh"; user "nobody"`,
+		`from "box-strict:pinned"`,
+	} {
+		err := strict(StrictFail, plan)
+		c.Assert(err, ErrorMatches, "strict: .*", Commentf("%s", plan))
+		c.Assert(err.(*BuildError).Kind, Equals, ErrPlan)
+	}
+
+	c.Assert(strict(StrictFail, `from "box-strict:pinned"; user "nobody"`), IsNil)
+	c.Assert(strict(StrictWarn, `from "debian"`), IsNil)
+
+	// the user is checked once the importing plan is done.
+	f, err := ioutil.TempFile("", "box-strict-import")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`run "true"`)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	c.Assert(strict(StrictFail, fmt.Sprintf(`from "box-strict:pinned"; import %q; user "nobody"`, f.Name())), IsNil)
+
+	err = strict(StrictFail, fmt.Sprintf(`from "box-strict:pinned"; import %q`, f.Name()))
+	c.Assert(err, ErrorMatches, "strict: .*")
+	c.Assert(err.(*BuildError).Kind, Equals, ErrPlan)
+}
+
+func (bs *builderSuite) TestSetLabel(c *C) {
+	f, err := ioutil.TempFile("", "box-label-import")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`run "true"`)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	b, err := NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	b.SetLabel("box.test", "final")
+	_, err = b.Run(fmt.Sprintf(`from "debian"; import %q; run "true"`, f.Name()))
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.ImageID())
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Labels["box.test"], Equals, "final")
+
+	// the image the import left is built on without the label.
+	graph := b.CacheGraph()
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), graph[len(graph)-1].Parent)
+	c.Assert(err, IsNil)
+	_, ok := inspect.Config.Labels["box.test"]
+	c.Assert(ok, Equals, false)
+}
+
+func (bs *builderSuite) TestLint(c *C) {
+	issues, err := Lint(`
+    from "debian"
+    copy "Gemfile", "/app/Gemfile"
+    run "bundle install"
+    workdir "/app"
+    cmd "ls -l"
+  `, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(len(issues), Equals, 0, Commentf("%v", issues))
+
+	issues, err = Lint(`
+    user "nobody"
+    from "debian"
+    copy ".", "/app"
+    only_in "release" do
+      run "apt-get install -y curl"
+    end
+    entrypoint "/bin/sh -c"
+    cmd "echo foo"
+    debug
+  `, []string{"debug"})
+	c.Assert(err, IsNil)
+	c.Assert(len(issues), Equals, 4, Commentf("%v", issues))
+	c.Assert(issues[0].Step, Equals, 1)
+	c.Assert(issues[0].Message, Equals, "called before from")
+	c.Assert(issues[1].Step, Equals, 4)
+	c.Assert(strings.Contains(issues[1].Message, `directory "." is copied at step 3`), Equals, true)
+	c.Assert(issues[2].Verb, Equals, "debug")
+	c.Assert(issues[3].Verb, Equals, "cmd")
+
+	// a cmd in shell form is one argument to any entrypoint.
+	issues, err = Lint(`
+    from "debian"
+    entrypoint "/bin/echo"
+    cmd "hello world"
+  `, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(len(issues), Equals, 1, Commentf("%v", issues))
+	c.Assert(issues[0].Step, Equals, 3)
+	c.Assert(strings.Contains(issues[0].Message, "passed to the entrypoint (step 2) as one argument"), Equals, true, Commentf("%v", issues))
+
+	for _, plan := range []string{
+		`from "debian"; entrypoint "/bin/echo"; cmd "hello", "world"`,
+		// entrypoint clears cmd, and from replaces both.
+		`from "debian"; cmd "hello world"; entrypoint "/bin/echo"`,
+		`from "debian"; entrypoint "/bin/echo"; from "debian"; cmd "hello world"`,
+	} {
+		issues, err = Lint(plan, []string{})
+		c.Assert(err, IsNil)
+		c.Assert(len(issues), Equals, 0, Commentf("%s: %v", plan, issues))
+	}
+
+	// dependencies are copied before the application.
+	issues, err = Lint(`
+    from "debian"
+    copy "app.rb", "/app/app.rb"
+    copy_deps "Gemfile", "/app/Gemfile"
+  `, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(len(issues), Equals, 1, Commentf("%v", issues))
+	c.Assert(issues[0].Step, Equals, 3)
+	c.Assert(strings.Contains(issues[0].Message, `"app.rb" is copied at step 2 before these dependencies`), Equals, true, Commentf("%v", issues))
+
+	issues, err = Lint(`
+    from "debian"
+    copy_deps "Gemfile", "/app/Gemfile"
+    copy ".", "/app"
+    from "debian"
+    copy_deps "Gemfile", "/app/Gemfile"
+  `, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(len(issues), Equals, 0, Commentf("%v", issues))
+
+	// retry blocks are evaluated once.
+	issues, err = Lint(`
+    from "debian"
+    copy ".", "/app"
+    retry 3 do
+      run "bundle install"
+    end
+  `, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(len(issues), Equals, 1, Commentf("%v", issues))
+	c.Assert(issues[0].Step, Equals, 3)
+
+	issues, err = Lint(`run "true"`, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(issues[len(issues)-1].Message, Equals, "from is never called")
+
+	// functions that read the image have nothing to read.
+	issues, err = Lint(`
+    from "debian"
+    run "echo #{read("/etc/hostname")} #{getuid("root")}:#{getgid("root")}"
+  `, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(len(issues), Equals, 0, Commentf("%v", issues))
+
+	_, err = Lint(`from "debian`, []string{})
+	c.Assert(err, NotNil)
+}
+
+func (bs *builderSuite) TestCopyDeps(c *C) {
+	dir, err := ioutil.TempDir("", "box-copy-deps")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	c.Assert(os.Chdir(dir), IsNil)
+	defer os.Chdir(wd)
+
+	c.Assert(ioutil.WriteFile("Gemfile", []byte("source 'https://rubygems.org'\n"), 0644), IsNil)
+
+	os.Setenv("NO_CACHE", "")
+
+	plan := `
+    from "debian"
+    copy_deps "Gemfile", "/app/Gemfile"
+  `
+
+	b, err := runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/app/Gemfile")), Equals, "source 'https://rubygems.org'\n")
+	id := b.ImageID()
+
+	// like copy, it is cached by the content copied.
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Equals, id)
+}
+
+func (bs *builderSuite) TestCopyOwner(c *C) {
+	dir, err := ioutil.TempDir("", "box-copy-owner")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	c.Assert(os.Chdir(dir), IsNil)
+	defer os.Chdir(wd)
+
+	c.Assert(os.MkdirAll("src/sub", 0755), IsNil)
+	c.Assert(ioutil.WriteFile("src/sub/file", []byte("file"), 0644), IsNil)
+
+	b, err := runBuilder(`
+    from "debian"
+    copy "src", "/root/src", owner: "0:0"
+    copy "src", "/nobody", owner: "nobody"
+    copy_deps "src/sub/file", "/deps", owner: "1234:mail"
+  `)
+	c.Assert(err, IsNil)
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "stat -c '%n %u %G' /root/src/sub/file /nobody/sub /deps"})
+	c.Assert(string(result), Equals, "/root/src/sub/file 0 root\n/nobody/sub 65534 nogroup\n/deps 1234 mail\n")
+
+	for _, script := range []string{
+		`from "debian"; copy "src", "/src", owner: "missing"`,
+		`from "debian"; copy "src", "/src", mode: 0644`,
+		`from "debian"; copy "src", "/src", "0:0"`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestUseProxy(c *C) {
+	os.Setenv("HTTP_PROXY", "http://proxy.example.com:3128")
+	os.Setenv("no_proxy", "localhost")
+	defer os.Unsetenv("HTTP_PROXY")
+	defer os.Unsetenv("no_proxy")
+
+	plan := `
+    from "debian"
+    env "NO_PROXY" => "image"
+    run "echo \"$HTTP_PROXY $no_proxy $NO_PROXY\" >/proxy"
+    run "echo \"$HTTP_PROXY\" >/override", env: { "HTTP_PROXY" => "http://other:8080" }
+  `
+
+	b, err := NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	b.SetUseProxy(true)
+	_, err = b.Run(plan)
+	c.Assert(err, IsNil)
+
+	c.Assert(string(readContainerFile(c, b, "/proxy")), Equals, "http://proxy.example.com:3128 localhost image\n")
+	c.Assert(string(readContainerFile(c, b, "/override")), Equals, "http://other:8080\n")
+
+	// none of the layers committed from the run containers keep the settings,
+	// and the image keeps its own NO_PROXY.
+	for _, layer := range b.exec.Layers() {
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), layer)
+		c.Assert(err, IsNil)
+		c.Assert(strings.Join(inspect.Config.Env, "\n"), Matches, "(?s).*NO_PROXY=image.*")
+		for _, entry := range inspect.Config.Env {
+			c.Assert(strings.HasPrefix(strings.ToLower(entry), "http_proxy="), Equals, false, Commentf("%v", inspect.Config.Env))
+			c.Assert(strings.HasPrefix(entry, "no_proxy="), Equals, false, Commentf("%v", inspect.Config.Env))
+		}
+	}
+
+	// without it, the commands only see the image's settings.
+	b, err = NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	_, err = b.Run(plan)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/proxy")), Equals, "  image\n")
+}
+
+func (bs *builderSuite) TestSafe(c *C) {
+	dir, err := ioutil.TempDir("", "box-safe")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(os.Mkdir(filepath.Join(dir, "context"), 0755), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(dir, "outside"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "outside", "secret"), []byte("secret"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "outside", "lib.rb"), []byte(`run "true"`), 0644), IsNil)
+
+	wd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	c.Assert(os.Chdir(filepath.Join(dir, "context")), IsNil)
+	defer os.Chdir(wd)
+
+	c.Assert(ioutil.WriteFile("file", []byte("file"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile("lib.rb", []byte(`run "echo -n lib >/lib"`), 0644), IsNil)
+	c.Assert(os.Symlink(filepath.Join(dir, "outside"), "escape"), IsNil)
+
+	safeBuilder := func(plan string) (*Builder, error) {
+		b, err := NewBuilder(false, []string{})
+		c.Assert(err, IsNil)
+		c.Assert(b.SetSafe(true), IsNil)
+		_, err = b.Run(plan)
+		return b, err
+	}
+
+	b, err := safeBuilder(`
+    from "debian"
+    copy "file", "/file"
+    import "lib.rb"
+    host_config memory: "256m"
+    run "cat", stdin: "file"
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/file")), Equals, "file")
+	c.Assert(string(readContainerFile(c, b, "/lib")), Equals, "lib")
+
+	for _, plan := range []string{
+		`copy "escape/secret", "/secret"`,
+		`copy "escape", "/escape"`,
+		fmt.Sprintf(`import %q`, filepath.Join(dir, "outside", "lib.rb")),
+		`import "escape/lib.rb"`,
+		`run "cat", stdin: "escape/secret"`,
+		`run "true", cache_on: ["escape/*"]`,
+	} {
+		_, err := safeBuilder("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		c.Assert(strings.Contains(err.Error(), "outside of the build context"), Equals, true, Commentf("%s: %v", plan, err))
+	}
+
+	for plan, message := range map[string]string{
+		`getenv "HOME"`:                                     "getenv is not allowed in safe mode",
+		`host_config privileged: true`:                      "cannot make containers privileged",
+		`host_config network_mode: "host"`:                  "cannot use network_mode",
+		`host_config cap_add: ["SYS_ADMIN"]`:                "cannot add capabilities",
+		`host_config security_opt: ["apparmor=unconfined"]`: "cannot set security options",
+	} {
+		_, err := safeBuilder("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		c.Assert(strings.Contains(err.Error(), message), Equals, true, Commentf("%s: %v", plan, err))
+	}
+
+	// without it, the same plans reach the host.
+	b, err = runBuilder(`
+    from "debian"
+    copy "escape/secret", "/secret"
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/secret")), Equals, "secret")
+}
+
+func (bs *builderSuite) TestBaseCache(c *C) {
+	defer dockerClient.ImageRemove(context.Background(), "box-base-cache:shared", types.ImageRemoveOptions{})
+
+	tagged := func(plan string) string {
+		_, err := runBuilder(plan)
+		c.Assert(err, IsNil)
+
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "box-base-cache:shared")
+		c.Assert(err, IsNil)
+		return inspect.ID
+	}
+
+	first := tagged(`from "debian"; run "touch /first"; tag "box-base-cache:shared"`)
+
+	bases := NewBaseCache()
+	build := func(bases *BaseCache) *Builder {
+		b, err := NewBuilder(false, []string{})
+		c.Assert(err, IsNil)
+		b.SetBaseCache(bases)
+		_, err = b.Run(`from "box-base-cache:shared"`)
+		c.Assert(err, IsNil)
+		return b
+	}
+
+	c.Assert(build(bases).base, Equals, first)
+
+	second := tagged(`from "debian"; run "touch /second"; tag "box-base-cache:shared"`)
+	c.Assert(second, Not(Equals), first)
+
+	// the name is resolved once for the builders sharing the cache.
+	c.Assert(build(bases).base, Equals, first)
+	c.Assert(build(NewBaseCache()).base, Equals, second)
+	c.Assert(build(nil).base, Equals, second)
+
+	// unless one of them tags another image with it.
+	b, err := NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	b.SetBaseCache(bases)
+	_, err = b.Run(`from "debian"; run "touch /third"; tag "box-base-cache:shared"`)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "box-base-cache:shared")
+	c.Assert(err, IsNil)
+	c.Assert(build(bases).base, Equals, inspect.ID)
+}
+
+func (bs *builderSuite) TestRunUser(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    user "nobody"
+    run "id -un >/as-root", user: "root"
+    script "id -un >/tmp/as-nobody"
+    with_user "nobody" do
+      run "id -un >/in-block", user: "0"
+    end
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().User, Equals, "nobody")
+	c.Assert(string(readContainerFile(c, b, "/as-root")), Equals, "root\n")
+	c.Assert(string(readContainerFile(c, b, "/tmp/as-nobody")), Equals, "nobody\n")
+	c.Assert(string(readContainerFile(c, b, "/in-block")), Equals, "root\n")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.ImageID())
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.User, Equals, "nobody")
+
+	// an image without a user is not given the one of the run: docker takes
+	// the user from the container committed when the image has none.
+	base, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "debian:latest")
+	c.Assert(err, IsNil)
+
+	b, err = runBuilder(`
+    from "debian"
+    run "true", user: "nobody"
+  `)
+	c.Assert(err, IsNil)
+
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.ImageID())
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.User, Equals, base.Config.User)
+
+	_, err = runBuilder(`from "debian"; run "true", user: ""`)
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, ".*user for run must be a user name or uid.*")
+}
+
+func (bs *builderSuite) TestTagLayers(c *C) {
+	b, err := NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	b.SetTagLayers(true)
+	_, err = b.Run(`
+    from "debian"
+    run "echo -n layer >/layer"
+    env "LAYER" => "1"
+  `)
+	c.Assert(err, IsNil)
+
+	tagged := 0
+	tags := map[string]bool{}
+	for _, step := range b.CacheGraph() {
+		name := layerTag(step.Parent, step.Key)
+		tags[name] = true
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), name)
+
+		if step.Verb == "from" {
+			c.Assert(err, NotNil, Commentf("%s", name))
+			continue
+		}
+
+		c.Assert(err, IsNil, Commentf("step %d (%s)", step.Step, step.Verb))
+		c.Assert(inspect.ID, Equals, step.Image)
+		c.Assert(strings.HasPrefix(name, "box-cache/"), Equals, true)
+		dockerClient.ImageRemove(context.Background(), name, types.ImageRemoveOptions{})
+		tagged++
+	}
+
+	c.Assert(tagged, Equals, 2)
+
+	// the same step on another image is tagged apart.
+	b, err = NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	b.SetTagLayers(true)
+	_, err = b.Run(`
+    from "debian"
+    run "echo -n other >/layer"
+    env "LAYER" => "1"
+  `)
+	c.Assert(err, IsNil)
+
+	for _, step := range b.CacheGraph() {
+		if step.Verb == "from" {
+			continue
+		}
+
+		name := layerTag(step.Parent, step.Key)
+		c.Assert(tags[name], Equals, false, Commentf("step %d (%s)", step.Step, step.Verb))
+
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), name)
+		c.Assert(err, IsNil, Commentf("step %d (%s)", step.Step, step.Verb))
+		c.Assert(inspect.ID, Equals, step.Image)
+		dockerClient.ImageRemove(context.Background(), name, types.ImageRemoveOptions{})
+	}
+}
+
+func (bs *builderSuite) TestArgv(c *C) {
+	plan := `
+    from "debian"
+    run "echo -n '#{argv.join(",")}' >/argv"
+  `
+
+	b, err := NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	b.SetArgv([]string{"1.2.3", "with space"})
+	_, err = b.Run(plan)
+	c.Assert(err, IsNil)
+
+	content, err := b.exec.CopyOneFileFromContainer("/argv")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "1.2.3,with space")
+
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+
+	content, err = b.exec.CopyOneFileFromContainer("/argv")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "")
+}
+
+func (bs *builderSuite) TestArg(c *C) {
+	plan := `
+    from arg("BASE", "debian")
+    run "echo -n '#{arg("VERSION", "dev")}' >/version"
+  `
+
+	b, err := runBuilder(plan)
+	c.Assert(err, IsNil)
+
+	content, err := b.exec.CopyOneFileFromContainer("/version")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "dev")
+
+	b, err = NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	b.SetArg("BASE", "alpine")
+	b.SetArg("VERSION", "1.2.3")
+	_, err = b.Run(plan)
+	c.Assert(err, IsNil)
+
+	content, err = b.exec.CopyOneFileFromContainer("/etc/alpine-release")
+	c.Assert(err, IsNil)
+	c.Assert(len(content), Not(Equals), 0)
+
+	content, err = b.exec.CopyOneFileFromContainer("/version")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "1.2.3")
+
+	_, err = runBuilder(`from arg("BASE")`)
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, `.*Build argument "BASE" is not set.*`)
+}
+
+func (bs *builderSuite) TestSetGet(c *C) {
+	b, err := runBuilder(`
+    set "version", "1.2.3"
+    from "debian"
+    env "VERSION" => get("version")
+    run "echo -n #{get("release", "dev")} >/release"
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().Env[len(b.exec.Config().Env)-1], Equals, "VERSION=1.2.3")
+	c.Assert(string(readContainerFile(c, b, "/release")), Equals, "dev")
+
+	_, err = runBuilder(`
+    from "debian"
+    run "echo #{get("version")}"
+  `)
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, `.*"version" was never set.*`)
+
+	// values reach the cache through the arguments of the verbs using them,
+	// including verbs that only change the configuration.
+	os.Setenv("NO_CACHE", "")
+
+	plan := `
+    set "version", %q
+    set "unused", %q
+    from "debian"
+    env "VERSION" => get("version")
+  `
+
+	b, err = runBuilder(fmt.Sprintf(plan, "1.0", "a"))
+	c.Assert(err, IsNil)
+	id := b.ImageID()
+
+	b, err = runBuilder(fmt.Sprintf(plan, "1.0", "b"))
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Equals, id)
+
+	b, err = runBuilder(fmt.Sprintf(plan, "2.0", "a"))
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Not(Equals), id)
+	c.Assert(b.exec.Config().Env[len(b.exec.Config().Env)-1], Equals, "VERSION=2.0")
+}
+
+func (bs *builderSuite) TestRunStdin(c *C) {
+	f, err := ioutil.TempFile("", "box-stdin")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("from a file\n")
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	plan := fmt.Sprintf(`
+    from "debian"
+    run "cat >/file", stdin: %q
+    run "cat >/heredoc", input: <<-EOF
+      from a heredoc
+    EOF
+  `, f.Name())
+
+	b, err := runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/file")), Equals, "from a file\n")
+	c.Assert(string(readContainerFile(c, b, "/heredoc")), Equals, "      from a heredoc\n")
+
+	// the file's content is part of the cache key.
+	os.Setenv("NO_CACHE", "")
+
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	id := b.ImageID()
+
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Equals, id)
+
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("changed\n"), 0644), IsNil)
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Not(Equals), id)
+	c.Assert(string(readContainerFile(c, b, "/file")), Equals, "changed\n")
+
+	for _, script := range []string{
+		`from "debian"; run "cat", stdin: "/nonexistent"`,
+		`from "debian"; run "cat", stdin: 1`,
+		`from "debian"; run "cat", input: 1`,
+		fmt.Sprintf(`from "debian"; run "cat", stdin: %q, input: ""`, f.Name()),
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestRunEnvFile(c *C) {
+	f, err := ioutil.TempFile("", "box-env")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("# build settings\n\nFOO=from file\nBAR=file\n")
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	plan := fmt.Sprintf(`
+    from "debian"
+    run "echo -n $FOO $BAR >/env", env_file: %q, env: { "BAR" => "inline" }
+  `, f.Name())
+
+	b, err := runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/env")), Equals, "from file inline")
+
+	// neither the image nor the configuration of the container it was
+	// committed from, which docker records with it, have the variables.
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.ImageID())
+	c.Assert(err, IsNil)
+	env := inspect.Config.Env
+	if inspect.ContainerConfig != nil {
+		env = append(env, inspect.ContainerConfig.Env...)
+	}
+
+	for _, entry := range env {
+		c.Assert(strings.HasPrefix(entry, "FOO="), Equals, false, Commentf("%v", env))
+		c.Assert(strings.HasPrefix(entry, "BAR="), Equals, false, Commentf("%v", env))
+	}
+
+	// the file's content is part of the cache key.
+	os.Setenv("NO_CACHE", "")
+
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	id := b.ImageID()
+
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("FOO=changed\n"), 0644), IsNil)
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Not(Equals), id)
+	c.Assert(string(readContainerFile(c, b, "/env")), Equals, "changed inline")
+
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("not a variable\n"), 0644), IsNil)
+
+	for _, script := range []string{
+		`from "debian"; run "true", env_file: "/nonexistent"`,
+		`from "debian"; run "true", env_file: 1`,
+		fmt.Sprintf(`from "debian"; run "true", env_file: %q`, f.Name()),
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestRunEntrypoint(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "printf '#!/bin/sh\\necho -n wrapped >/wrapped\\nexec \\"$@\\"\\n' >/wrapper && chmod +x /wrapper"
+    run "echo -n $0 >/shell", entrypoint: "/wrapper"
+    script "echo -n $FOO >/script", entrypoint: ["/usr/bin/env", "FOO=bar"]
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/wrapped")), Equals, "wrapped")
+	c.Assert(string(readContainerFile(c, b, "/shell")), Equals, "/bin/sh")
+	c.Assert(string(readContainerFile(c, b, "/script")), Equals, "bar")
+
+	// the wrapper is not kept in the image.
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.ImageID())
+	c.Assert(err, IsNil)
+	c.Assert(len(inspect.Config.Entrypoint), Equals, 0)
+
+	for _, script := range []string{
+		`from "debian"; run "true", entrypoint: ""`,
+		`from "debian"; run "true", entrypoint: []`,
+		`from "debian"; run "true", entrypoint: "/nonexistent"`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestRunCacheOn(c *C) {
+	dir, err := ioutil.TempDir("", "box-cache-on")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte("{}"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "a.lock"), []byte("a"), 0644), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(dir, "b.lock"), 0755), IsNil)
+
+	plan := fmt.Sprintf(`
+    from "debian"
+    run "date +%%s%%N >/stamp", cache_on: [%q, %q]
+  `, filepath.Join(dir, "package.json"), filepath.Join(dir, "*.lock"))
+
+	os.Setenv("NO_CACHE", "")
+
+	b, err := runBuilder(plan)
+	c.Assert(err, IsNil)
+	id := b.ImageID()
+
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Equals, id)
+
+	// any file the globs match changes the key.
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "c.lock"), []byte("c"), 0644), IsNil)
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Not(Equals), id)
+	id = b.ImageID()
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte(`{"name":"box"}`), 0644), IsNil)
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Not(Equals), id)
+
+	for _, script := range []string{
+		fmt.Sprintf(`from "debian"; run "true", cache_on: %q`, filepath.Join(dir, "*.missing")),
+		fmt.Sprintf(`from "debian"; run "true", cache_on: %q`, filepath.Join(dir, "b.lock")),
+		`from "debian"; run "true", cache_on: 1`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestCacheGraph(c *C) {
+	plan := `
+    from "debian"
+    copy "builder.go", "/"
+    run "true", cache_on: "util.go"
+    inside "/tmp" do
+      run "pwd"
+    end
+  `
+
+	os.Setenv("NO_CACHE", "")
+
+	b, err := runBuilder(plan)
+	c.Assert(err, IsNil)
+
+	graph := b.CacheGraph()
+	verbs := []string{}
+	for _, step := range graph {
+		verbs = append(verbs, step.Verb)
+		c.Assert(step.Key, Not(Equals), "")
+	}
+	c.Assert(verbs, DeepEquals, []string{"from", "copy", "run", "inside", "run"})
+
+	// copy is keyed by what it copies, which is recorded as its input.
+	c.Assert(graph[1].Key, Matches, "box:copy .*")
+	c.Assert(graph[1].Inputs, DeepEquals, []CacheInput{{Path: "builder.go", Sum: graph[1].Key}})
+	c.Assert(graph[1].ParentKey, Equals, graph[0].Key)
+
+	c.Assert(graph[2].Inputs, HasLen, 1)
+	c.Assert(graph[2].Inputs[0].Path, Equals, "util.go")
+	c.Assert(graph[2].ParentKey, Equals, graph[1].Key)
+	c.Assert(graph[2].Parent, Equals, graph[1].Image)
+
+	// the steps of a block follow it, and build on the image before it.
+	c.Assert(graph[4].ParentKey, Equals, graph[2].Key)
+	c.Assert(graph[3].Image, Equals, b.ImageID())
+
+	b, err = runBuilder(plan)
+	c.Assert(err, IsNil)
+
+	graph = b.CacheGraph()
+	c.Assert(graph, HasLen, 4)
+	for _, step := range graph[1:] {
+		c.Assert(step.Cached, Equals, true, Commentf("%v", step))
+	}
+
+	_, err = b.Run(`run "false"`)
+	c.Assert(err, NotNil)
+	graph = b.CacheGraph()
+	c.Assert(graph[len(graph)-1].Failed, Equals, true)
+}
+
+func (bs *builderSuite) TestLogDir(c *C) {
+	dir, err := ioutil.TempDir("", "box-log-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(b.SetLogDir(filepath.Join(dir, "logs"), []string{"hunter2"}), IsNil)
+
+	_, err = b.Run(`
+    from "debian"
+    run "echo hello"
+    script "echo the password is hunter2 >&2"
+  `)
+	c.Assert(err, IsNil)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "logs", "02-run.log"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "hello\n")
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "logs", "03-script.log"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "the password is ***\n")
+
+	_, err = os.Stat(filepath.Join(dir, "logs", "01-from.log"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (bs *builderSuite) TestScript(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "mkdir -p /src/sub"
+    script "cd /src", "version=1.2.3", "cd sub", "echo -n $version >VERSION"
+    script <<-EOF
+      cd /src
+      pwd >/pwd
+    EOF
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/src/sub/VERSION")), Equals, "1.2.3")
+	c.Assert(string(readContainerFile(c, b, "/pwd")), Equals, "/src\n")
+
+	// the image's own command is left alone.
+	c.Assert(b.exec.Config().Cmd, DeepEquals, []string{"bash"})
+
+	// a failing line stops the script.
+	_, err = runBuilder(`
+    from "debian"
+    script "false", "touch /reached"
+  `)
+	c.Assert(err, NotNil)
+
+	for _, script := range []string{
+		`from "debian"; script`,
+		`from "debian"; script "true", shell: "bash"`,
+		`script "true"`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestHealthcheck(c *C) {
+	_, err := runBuilder(`
+    from "debian"
+    healthcheck "test -f /etc/debian_version", interval: 30, timeout: 2.5, retries: 3
+    tag "healthy"
+  `)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "healthy")
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Healthcheck, NotNil)
+	c.Assert(inspect.Config.Healthcheck.Test, DeepEquals, []string{"CMD-SHELL", "test -f /etc/debian_version"})
+	c.Assert(inspect.Config.Healthcheck.Interval, Equals, 30*time.Second)
+	c.Assert(inspect.Config.Healthcheck.Timeout, Equals, 2500*time.Millisecond)
+	c.Assert(inspect.Config.Healthcheck.Retries, Equals, 3)
+
+	// the healthcheck is inherited until disabled.
+	b, err := runBuilder(`
+    from "healthy"
+    run "true"
+  `)
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Healthcheck.Test, DeepEquals, []string{"CMD-SHELL", "test -f /etc/debian_version"})
+
+	b, err = runBuilder(`
+    from "healthy"
+    healthcheck "NONE"
+  `)
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Healthcheck.Test, DeepEquals, []string{"NONE"})
+
+	for _, script := range []string{
+		`from "debian"; healthcheck`,
+		`from "debian"; healthcheck "NONE", retries: 3`,
+		`from "debian"; healthcheck "true", retries: 0`,
+		`from "debian"; healthcheck "true", every: 3`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestShell(c *C) {
+	// [[ is not understood by /bin/sh on debian.
+	b, err := runBuilder(`
+    from "debian"
+    shell "/bin/bash", "-c"
+    run "[[ -n $BASH_VERSION ]] && echo -n run >/run"
+    script "[[ -n $BASH_VERSION ]]", "echo -n script >/script"
+    entrypoint "exec echo $HOME", shell: true
+  `)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Shell, DeepEquals, strslice.StrSlice{"/bin/bash", "-c"})
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/bash", "-c", "exec echo $HOME"})
+
+	c.Assert(string(readContainerFile(c, b, "/run")), Equals, "run")
+	c.Assert(string(readContainerFile(c, b, "/script")), Equals, "script")
+
+	b, err = runBuilder(`
+    from "debian"
+    cmd "echo $HOME", shell: true
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().Cmd, DeepEquals, []string{"/bin/sh", "-c", "echo $HOME"})
+
+	// the same command run by another shell is not a cache hit.
+	os.Setenv("NO_CACHE", "")
+
+	_, err = runBuilder(`
+    from "debian"
+    shell "/bin/bash", "-c"
+    run "[[ -n $BASH_VERSION ]]"
+  `)
+	c.Assert(err, IsNil)
+
+	_, err = runBuilder(`
+    from "debian"
+    run "[[ -n $BASH_VERSION ]]"
+  `)
+	c.Assert(err, NotNil)
+
+	for _, script := range []string{
+		`from "debian"; shell`,
+		`from "debian"; cmd "echo", "hi", shell: true`,
+		`from "debian"; entrypoint "echo hi", login: true`,
+		`shell "/bin/bash", "-c"`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestRetry(c *C) {
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = delay }()
+
+	b, err := runBuilder(`
+    from "debian"
+    $attempt = 0
+    retry 3 do
+      $attempt += 1
+      user "nobody"
+      run "echo -n #{$attempt} >/tmp/attempt && test #{$attempt} -ge 2"
+    end
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().User, Equals, "nobody")
+
+	result := readContainerFile(c, b, "/tmp/attempt")
+	c.Assert(string(result), Equals, "2")
+
+	_, err = runBuilder(`
+    from "debian"
+    retry 2 do
+      run "false"
+    end
+  `)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "Failed after 2 attempts"), Equals, true, Commentf("%v", err))
+	c.Assert(err.(*BuildError).Kind, Equals, ErrStep)
+
+	_, err = runBuilder(`
+    from "debian"
+    retry 0 do
+      run "true"
+    end
+  `)
+	c.Assert(err, NotNil)
+}
+
+func (bs *builderSuite) TestWaitFor(c *C) {
+	ready := time.Now().Add(2 * time.Second).Unix()
+
+	start := time.Now()
+	b, err := runBuilder(fmt.Sprintf(`
+    from "debian"
+    wait_for "test $(date +%%s) -ge %d", interval: 0.5
+    sleep 0.5
+    run "true"
+  `, ready))
+	c.Assert(err, IsNil)
+	c.Assert(b.ImageID(), Not(Equals), "")
+	c.Assert(time.Since(start) >= 2500*time.Millisecond, Equals, true)
+
+	_, err = runBuilder(`
+    from "debian"
+    wait_for "false", timeout: 1, interval: 0.2
+  `)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "Timed out"), Equals, true, Commentf("%v", err))
+	c.Assert(err.(*BuildError).Kind, Equals, ErrStep)
+
+	for _, script := range []string{
+		`from "debian"; wait_for "true", retries: 2`,
+		`from "debian"; wait_for "true", timeout: "soon"`,
+		`from "debian"; sleep -1`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestAssertBase(c *C) {
+	_, err := runBuilder(`
+    from "debian"
+    user "nobody"
+    assert_base user: "root", os: "linux", workdir: "/"
+  `)
+	c.Assert(err, IsNil)
+
+	_, err = runBuilder(`
+    from "debian"
+    assert_base user: "nobody"
+  `)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), `Base image user is "root", expected "nobody"`), Equals, true, Commentf("%v", err))
+	c.Assert(err.(*BuildError).Kind, Equals, ErrStep)
+
+	for _, script := range []string{
+		`assert_base user: "root"`,
+		`from "debian"; assert_base shell: "bash"`,
+		`from "debian"; assert_base "root"`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+		c.Assert(err.(*BuildError).Kind, Equals, ErrPlan, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestBoxVersion(c *C) {
+	run := func(version, script string) error {
+		b, err := NewBuilder(false, []string{})
+		c.Assert(err, IsNil)
+		defer b.Close()
+
+		b.SetVersion(version)
+		_, err = b.Run(script)
+		return err
+	}
+
+	for _, script := range []string{
+		`box_version ">= 0.5"`,
+		`box_version "0.5"`,
+		`box_version "> 0.4.9", "< 1.0"`,
+		`box_version "= 0.5.0"`,
+		`box_version "!= 0.6"`,
+	} {
+		c.Assert(run("0.5", script), IsNil, Commentf("%s", script))
+	}
+
+	err := run("0.2", `box_version ">= 0.5"`)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "This plan requires box >= 0.5, but this is box 0.2"), Equals, true, Commentf("%v", err))
+	c.Assert(err.(*BuildError).Kind, Equals, ErrPlan)
+
+	c.Assert(run("0.6-dev", `box_version ">= 0.6"`), IsNil)
+	c.Assert(run("", `box_version ">= 99"`), IsNil)
+
+	for _, script := range []string{
+		`box_version`,
+		`box_version ">= latest"`,
+		`box_version "~> 0.5"`,
+	} {
+		c.Assert(run("0.5", script), NotNil, Commentf("%s", script))
+	}
+}
+
+func (bs *builderSuite) TestBuildErrorStep(c *C) {
+	_, err := runBuilder(`
+    from "debian"
+    with_user "nobody" do
+      run "true"
+    end
+    run "exit 1"
+    run "true"
+  `)
+	c.Assert(err, NotNil)
+	berr := err.(*BuildError)
+	c.Assert(berr.Kind, Equals, ErrStep)
+	c.Assert(berr.Step, Equals, 4)
+	c.Assert(berr.Verb, Equals, "run")
+	c.Assert(berr.Container, Equals, "")
+
+	// errors raised outside of a verb have no step.
+	_, err = runBuilder(`
+    from "debian"
+    run "true"
+    undefined_verb
+  `)
+	c.Assert(err, NotNil)
+	berr = err.(*BuildError)
+	c.Assert(berr.Kind, Equals, ErrPlan)
+	c.Assert(berr.Step, Equals, 0)
+	c.Assert(berr.Verb, Equals, "")
+
+	// so are verbs given the wrong arguments, within blocks too.
+	for _, script := range []string{
+		`from "debian"; workdir "/a", "/b"`,
+		`from "debian"; mkdir "/a", mode: "755"`,
+		`from "debian"; with_user "nobody" do; run "true", bogus: 1; end`,
+	} {
+		_, err = runBuilder(script)
+		c.Assert(err, NotNil, Commentf("%s", script))
+		c.Assert(err.(*BuildError).Kind, Equals, ErrPlan, Commentf("%s", script))
+		c.Assert(err.(*BuildError).Step, Not(Equals), 0, Commentf("%s", script))
+	}
+
+	b, err := NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	b.SetKeepOnFailure(true)
+	_, err = b.Run(`
+    from "debian"
+    run "exit 1"
+  `)
+	c.Assert(err, NotNil)
+	berr = err.(*BuildError)
+	c.Assert(berr.Container, Not(Equals), "")
+	c.Assert(dockerClient.ContainerRemove(context.Background(), berr.Container, types.ContainerRemoveOptions{Force: true}), IsNil)
+}
+
+func (bs *builderSuite) TestBuildErrorDisk(c *C) {
+	b := &Builder{stepFailed: true}
+
+	err := b.classify(errors.New(`Error response from daemon: write /var/lib/docker/tmp/layer: no space left on device`))
+	c.Assert(err.(*BuildError).Kind, Equals, ErrDisk)
+	c.Assert(err.(*BuildError).Kind.String(), Equals, "disk")
+	c.Assert(strings.Contains(err.Error(), "out of disk space"), Equals, true, Commentf("%v", err))
+	c.Assert(strings.Contains(err.Error(), "/var/lib/docker/tmp/layer"), Equals, true, Commentf("%v", err))
+
+	err = b.classify(errors.New("Command exited with status 1"))
+	c.Assert(err.(*BuildError).Kind, Equals, ErrStep)
+}
+
+func (bs *builderSuite) TestDiffImages(c *C) {
+	a := &container.Config{User: "root", Env: []string{"PATH=/bin", "PORT=8080"}, Labels: map[string]string{"team": "box"}}
+	b := &container.Config{User: "root", Env: []string{"PATH=/bin", "DEBUG="}, Cmd: strslice.StrSlice{"serve"}, Labels: map[string]string{"team": "box"}}
+
+	diffs := diffImages(a, []string{"1", "2"}, b, []string{"1", "3", "4"})
+
+	result := []string{}
+	for _, d := range diffs {
+		result = append(result, d.String())
+	}
+
+	c.Assert(result, DeepEquals, []string{
+		`cmd: (none) -> ["serve"]`,
+		`env DEBUG: (none) -> ""`,
+		`env PORT: 8080 -> (none)`,
+		`layers: 2 -> 3`,
+		`layer 2: 2 -> 3`,
+		`layer 3: (none) -> 4`,
+	})
+
+	c.Assert(diffImages(a, []string{"1"}, a, []string{"1"}), HasLen, 0)
+}
+
+func (bs *builderSuite) TestVerbs(c *C) {
+	signatures := map[string]string{}
+	for _, verb := range Verbs([]string{"debug"}) {
+		signatures[verb.Name] = verb.String()
+	}
+
+	c.Assert(signatures["debug"], Equals, "")
+	c.Assert(signatures["copy"], Equals, "copy(arg1, arg2, arg3 = nil)")
+	c.Assert(signatures["run"], Equals, "run(*args)")
+	c.Assert(signatures["with_user"], Equals, "with_user(arg1, &block)")
+	c.Assert(signatures["ensure_file"], Equals, "ensure_file(arg1, arg2 = nil)")
+	c.Assert(signatures["flatten"], Equals, "flatten()")
+	c.Assert(signatures["getenv"], Equals, "getenv(arg1)")
+}
+
+func (bs *builderSuite) TestRegisterVerb(c *C) {
+	release := func(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+		config := b.Executor().Config()
+		config.Env = setEnv(config.Env, "RELEASE", args[0].String())
+
+		if err := b.Executor().Commit(cacheKey, nil); err != nil {
+			return nil, createException(m, err.Error())
+		}
+
+		return nil, nil
+	}
+
+	c.Assert(RegisterVerb("test_release", release, mruby.ArgsReq(1)), IsNil)
+	defer delete(verbJumpTable, "test_release")
+
+	b, err := runBuilder(`
+    from "debian"
+    test_release "1.2.3"
+  `)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.ImageID())
+	c.Assert(err, IsNil)
+	c.Assert(strings.Join(inspect.Config.Env, "\n"), Matches, `(?s).*RELEASE=1\.2\.3.*`)
+
+	issues, err := Lint(`test_release "1.2.3"`, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(issues[0].Verb, Equals, "test_release")
+
+	c.Assert(RegisterVerb("test_release", release, mruby.ArgsReq(1)), NotNil)
+	c.Assert(RegisterVerb("run", release, mruby.ArgsReq(1)), NotNil)
+	c.Assert(RegisterVerb("getenv", release, mruby.ArgsReq(1)), NotNil)
+}
+
+func (bs *builderSuite) TestPin(c *C) {
+	dir, err := ioutil.TempDir("", "box-pin")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "box.lock")
+
+	plan := `from "debian"`
+
+	b, err := NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(b.SetLockfile(lockPath), IsNil)
+	_, err = b.Run(plan)
+	c.Assert(err, IsNil)
+
+	lf, err := loadLockfile(lockPath)
+	c.Assert(err, IsNil)
+	digest, ok := lf.Get("debian")
+	c.Assert(ok, Equals, true)
+	c.Assert(strings.HasPrefix(digest, "debian@sha256:"), Equals, true, Commentf("%s", digest))
+
+	// a pinned image is used in place of the name.
+	c.Assert(lf.Set("debian", "busybox"), IsNil)
+
+	b, err = NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	c.Assert(b.SetLockfile(lockPath), IsNil)
+	_, err = b.Run(plan)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "busybox")
+	c.Assert(err, IsNil)
+	parent, err := getParent(b, b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(parent, Equals, inspect.ID)
+
+	c.Assert(ioutil.WriteFile(lockPath, []byte("garbage"), 0644), IsNil)
+	c.Assert(b.SetLockfile(lockPath), NotNil)
+}
+
+func (bs *builderSuite) TestHostConfig(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    host_config extra_hosts: ["boxtest:127.0.0.2"], shm_size: "128m"
+    run "getent hosts boxtest > /hosts"
+  `)
+	c.Assert(err, IsNil)
+
+	content, err := b.exec.CopyOneFileFromContainer("/hosts")
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(content), "127.0.0.2"), Equals, true)
+
+	_, err = runBuilder(`
+    from "debian"
+    host_config nonexistent: 1
+  `)
+	c.Assert(err, NotNil)
+
+	// hosts added by the command line survive the plan's own.
+	b, err = NewBuilder(false, []string{})
+	c.Assert(err, IsNil)
+	b.AddHosts([]string{"boxcli:127.0.0.3"})
+	_, err = b.Run(`
+    from "debian"
+    run "getent hosts boxcli > /cli"
+    host_config extra_hosts: ["boxtest:127.0.0.2"]
+    run "getent hosts boxcli boxtest > /both"
+  `)
+	c.Assert(err, IsNil)
+
+	content, err = b.exec.CopyOneFileFromContainer("/cli")
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(content), "127.0.0.3"), Equals, true)
+
+	content, err = b.exec.CopyOneFileFromContainer("/both")
+	c.Assert(err, IsNil)
+	c.Assert(strings.Count(string(content), "\n"), Equals, 2, Commentf("%s", content))
+}
@@ -0,0 +1,168 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/erikh/box/builder/tar"
+)
+
+// CompressTo rewrites the image built to have at most n filesystem layers, for
+// registries that pull few large layers faster than many small ones. The
+// newest image of the build with fewer than n layers, which may be the base
+// image, is kept as it is, and the changes made to it since are squashed into
+// one layer on top of it. The configuration of the image built is kept in
+// full. Images with no more than n layers are left alone.
+func (b *Builder) CompressTo(n int) error {
+	if n < 2 {
+		return fmt.Errorf("Cannot compress to %d layers; use flatten for a single layer", n)
+	}
+
+	final := b.exec.ImageID()
+
+	layers, parent, err := b.exec.ImageLayers(final)
+	if err != nil {
+		return err
+	}
+
+	if layers <= n {
+		return nil
+	}
+
+	// the images of a build are children of the ones before them, up to the
+	// base image.
+	keep := ""
+	for parent != "" {
+		var count int
+		id := parent
+
+		count, parent, err = b.exec.ImageLayers(id)
+		if err != nil {
+			return err
+		}
+
+		if count < n {
+			keep = id
+			break
+		}
+	}
+
+	if keep == "" {
+		return fmt.Errorf("Cannot compress to %d layers: no image of the build has fewer than %d", n, n)
+	}
+
+	before, err := b.exportImage(keep)
+	defer os.Remove(before)
+	if err != nil {
+		return err
+	}
+
+	after, err := b.exportImage(final)
+	defer os.Remove(after)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(before)
+	if err != nil {
+		return err
+	}
+
+	sums, err := tar.Sums(f, "/")
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	changed, _, err := tar.Dedup(after, sums)
+	defer os.Remove(changed)
+	if err != nil {
+		return err
+	}
+
+	removed, err := tar.Removed(before, after)
+	if err != nil {
+		return err
+	}
+
+	// files removed since are removed from the squashed layer as delete
+	// does, which needs a shell in the kept image.
+	if len(removed) > 0 {
+		paths := []string{}
+		for _, path := range removed {
+			paths = append(paths, "'"+strings.Replace(path, "'", `'\''`, -1)+"'")
+		}
+
+		runConfig := *b.exec.Config()
+		runConfig.Image = keep
+		runConfig.Entrypoint = []string{"/bin/sh", "-c"}
+		runConfig.Cmd = []string{"rm -rf -- " + strings.Join(paths, " ")}
+		runConfig.User = "root"
+
+		b.exec.SetRunConfig(&runConfig)
+		defer b.exec.SetRunConfig(nil)
+	}
+
+	hook := func(id string) (string, error) {
+		f, err := os.Open(changed)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		if err := b.exec.CopyToContainer(id, "/", f); err != nil {
+			return "", err
+		}
+
+		if len(removed) > 0 {
+			return b.exec.RunHook(id)
+		}
+
+		return "", nil
+	}
+
+	if err := b.exec.Rebase(keep, hook); err != nil {
+		return err
+	}
+
+	count, _, err := b.exec.ImageLayers(b.exec.ImageID())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("+++ Compressed %d layers to %d: %s\n", layers, count, b.exec.ImageID())
+	return nil
+}
+
+// exportImage writes the filesystem of the image to an archive, and returns
+// its name. The archive is for the caller to remove.
+func (b *Builder) exportImage(image string) (string, error) {
+	current := b.exec.Config().Image
+	b.exec.Config().Image = image
+	id, err := b.exec.Create()
+	b.exec.Config().Image = current
+	if err != nil {
+		return "", err
+	}
+	defer b.exec.Destroy(id)
+
+	rc, err := b.exec.CopyFromContainer(id, "/")
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(b.copyOpts.TempDir, "box-compress.")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, rc); err != nil && err != io.EOF {
+		return f.Name(), err
+	}
+
+	return f.Name(), nil
+}
@@ -6,12 +6,18 @@ import "github.com/docker/engine-api/types/container"
 // by commit routines in the executor. Setting properties here will propogate
 // them to various image-manipulating commands when needed.
 type Config struct {
-	Image      string   // Image Identifier, may be different across executors.
-	User       string   // the currently configured user for this image.
-	WorkDir    string   // the current working directory on entering a container
-	Cmd        []string // the secondary execution form, it is provided to images if given to docker run, otherwise this is used.
-	Entrypoint []string // the primary execution form, the first arguments and the exec() jumping-off point.
-	Env        []string
+	Image       string   // Image Identifier, may be different across executors.
+	User        string   // the currently configured user for this image.
+	WorkDir     string   // the current working directory on entering a container
+	Cmd         []string // the secondary execution form, it is provided to images if given to docker run, otherwise this is used.
+	Entrypoint  []string // the primary execution form, the first arguments and the exec() jumping-off point.
+	Env         []string
+	Shell       []string                // the shell running commands given as a single string, if not the default.
+	ArgsEscaped bool                    // set for a Windows cmd or entrypoint given as one command line, which the shell is passed unsplit.
+	OS          string                  // the operating system of the base image, such as linux or windows; not part of the docker configuration.
+	Healthcheck *container.HealthConfig // the healthcheck of the image; a test of NONE disables the one inherited.
+	Hostname    string                  // the hostname containers of the image are given, if not their ID.
+	Domainname  string
 }
 
 // NewConfig initializes a new configuration.
@@ -40,6 +46,11 @@ func (c *Config) ToDocker(tty, stdin bool) *container.Config {
 		Cmd:          c.Cmd,
 		User:         c.User,
 		WorkingDir:   c.WorkDir,
+		Shell:        c.Shell,
+		ArgsEscaped:  c.ArgsEscaped,
+		Healthcheck:  c.Healthcheck,
+		Hostname:     c.Hostname,
+		Domainname:   c.Domainname,
 	}
 }
 
@@ -51,4 +62,9 @@ func (c *Config) FromDocker(cont *container.Config) {
 	c.Cmd = cont.Cmd
 	c.User = cont.User
 	c.WorkDir = cont.WorkingDir
+	c.Shell = cont.Shell
+	c.ArgsEscaped = cont.ArgsEscaped
+	c.Healthcheck = cont.Healthcheck
+	c.Hostname = cont.Hostname
+	c.Domainname = cont.Domainname
 }
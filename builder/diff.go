@@ -0,0 +1,183 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/engine-api/types/container"
+)
+
+// ImageDiff is a setting or filesystem layer in which the images compared by
+// Diff differ. A and B are nil where an image does not have it at all.
+type ImageDiff struct {
+	Field string  `json:"field"`
+	A     *string `json:"a"`
+	B     *string `json:"b"`
+}
+
+func (d ImageDiff) String() string {
+	value := func(v *string) string {
+		switch {
+		case v == nil:
+			return "(none)"
+		case *v == "":
+			return `""`
+		}
+
+		return *v
+	}
+
+	return fmt.Sprintf("%s: %s -> %s", d.Field, value(d.A), value(d.B))
+}
+
+// Diff compares the configuration and filesystem layers of the images a and
+// other, as docker has them, so the settings box does not track, such as
+// labels and exposed ports, are compared as well. Environment variables and
+// labels are compared one by one, and layers by position.
+func (b *Builder) Diff(a, other string) ([]ImageDiff, error) {
+	configA, layersA, err := b.exec.ImageConfig(a)
+	if err != nil {
+		return nil, err
+	}
+
+	configB, layersB, err := b.exec.ImageConfig(other)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffImages(configA, layersA, configB, layersB), nil
+}
+
+func diffImages(a *container.Config, layersA []string, b *container.Config, layersB []string) []ImageDiff {
+	diffs := []ImageDiff{}
+
+	add := func(field string, x, y *string) {
+		if (x == nil) != (y == nil) || (x != nil && *x != *y) {
+			diffs = append(diffs, ImageDiff{Field: field, A: x, B: y})
+		}
+	}
+
+	str := func(s string) *string { return &s }
+
+	add("user", str(a.User), str(b.User))
+	add("workdir", str(a.WorkingDir), str(b.WorkingDir))
+	add("entrypoint", jsonValue([]string(a.Entrypoint)), jsonValue([]string(b.Entrypoint)))
+	add("cmd", jsonValue([]string(a.Cmd)), jsonValue([]string(b.Cmd)))
+	add("shell", jsonValue([]string(a.Shell)), jsonValue([]string(b.Shell)))
+	add("healthcheck", jsonValue(a.Healthcheck), jsonValue(b.Healthcheck))
+	add("stop signal", str(a.StopSignal), str(b.StopSignal))
+	add("hostname", str(a.Hostname), str(b.Hostname))
+	add("domainname", str(a.Domainname), str(b.Domainname))
+	add("onbuild", jsonValue(a.OnBuild), jsonValue(b.OnBuild))
+
+	envA, envB := envMap(a.Env), envMap(b.Env)
+	for _, name := range unionKeys(envA, envB) {
+		add("env "+name, lookup(envA, name), lookup(envB, name))
+	}
+
+	for _, name := range unionKeys(a.Labels, b.Labels) {
+		add("label "+name, lookup(a.Labels, name), lookup(b.Labels, name))
+	}
+
+	portsA, portsB := []string{}, []string{}
+	for port := range a.ExposedPorts {
+		portsA = append(portsA, string(port))
+	}
+	for port := range b.ExposedPorts {
+		portsB = append(portsB, string(port))
+	}
+	add("expose", jsonValue(sorted(portsA)), jsonValue(sorted(portsB)))
+
+	volumesA, volumesB := []string{}, []string{}
+	for volume := range a.Volumes {
+		volumesA = append(volumesA, volume)
+	}
+	for volume := range b.Volumes {
+		volumesB = append(volumesB, volume)
+	}
+	add("volumes", jsonValue(sorted(volumesA)), jsonValue(sorted(volumesB)))
+
+	add("layers", str(strconv.Itoa(len(layersA))), str(strconv.Itoa(len(layersB))))
+	for i := 0; i < len(layersA) || i < len(layersB); i++ {
+		var x, y *string
+		if i < len(layersA) {
+			x = str(layersA[i])
+		}
+		if i < len(layersB) {
+			y = str(layersB[i])
+		}
+
+		add(fmt.Sprintf("layer %d", i+1), x, y)
+	}
+
+	return diffs
+}
+
+// jsonValue returns the value encoded as JSON, or nil for empty lists and nil
+// pointers, so an unset list and an empty one compare the same.
+func jsonValue(v interface{}) *string {
+	switch value := v.(type) {
+	case []string:
+		if len(value) == 0 {
+			return nil
+		}
+	case *container.HealthConfig:
+		if value == nil {
+			return nil
+		}
+	}
+
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	s := string(content)
+	return &s
+}
+
+// envMap returns the variables of a list of NAME=VALUE entries by name.
+func envMap(env []string) map[string]string {
+	vars := map[string]string{}
+	for _, entry := range env {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+
+		vars[parts[0]] = parts[1]
+	}
+
+	return vars
+}
+
+// unionKeys returns the keys of both maps, sorted.
+func unionKeys(a, b map[string]string) []string {
+	keys := []string{}
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return sorted(keys)
+}
+
+func lookup(m map[string]string, key string) *string {
+	if value, ok := m[key]; ok {
+		return &value
+	}
+
+	return nil
+}
+
+func sorted(list []string) []string {
+	sort.Strings(list)
+	return list
+}
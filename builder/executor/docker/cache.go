@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// cacheIndexFile is the name of the index file kept in the cache directory.
+const cacheIndexFile = "cache.json"
+
+// cacheIndex is a small on-disk map of parent image and cache key to the
+// image that was committed for them. It lets CheckCache avoid enumerating
+// every image on the daemon when the answer is already known. The daemon is
+// still the source of truth; entries are verified before use.
+type cacheIndex struct {
+	path    string
+	Entries map[string]string `json:"entries"`
+}
+
+// loadCacheIndex loads the index from the provided directory, creating the
+// directory if necessary. A missing or unreadable index yields an empty one.
+func loadCacheIndex(dir string) (*cacheIndex, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ci := &cacheIndex{
+		path:    filepath.Join(dir, cacheIndexFile),
+		Entries: map[string]string{},
+	}
+
+	content, err := ioutil.ReadFile(ci.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ci, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, ci); err != nil || ci.Entries == nil {
+		// a corrupt index is just a cold cache.
+		ci.Entries = map[string]string{}
+	}
+
+	return ci, nil
+}
+
+func (ci *cacheIndex) key(parent, cacheKey string) string {
+	return parent + " " + cacheKey
+}
+
+// Get returns the image ID for the parent and cache key, if known.
+func (ci *cacheIndex) Get(parent, cacheKey string) (string, bool) {
+	id, ok := ci.Entries[ci.key(parent, cacheKey)]
+	return id, ok
+}
+
+// Set records the image ID for the parent and cache key and saves the index.
+func (ci *cacheIndex) Set(parent, cacheKey, id string) error {
+	ci.Entries[ci.key(parent, cacheKey)] = id
+	return ci.save()
+}
+
+// Delete removes the entry for the parent and cache key and saves the index.
+func (ci *cacheIndex) Delete(parent, cacheKey string) error {
+	delete(ci.Entries, ci.key(parent, cacheKey))
+	return ci.save()
+}
+
+func (ci *cacheIndex) save() error {
+	content, err := json.MarshalIndent(ci, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(ci.path, content, 0644)
+}
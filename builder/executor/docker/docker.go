@@ -4,48 +4,147 @@ import (
 	"archive/tar"
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/docker/pkg/term"
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
 	"github.com/erikh/box/builder/config"
 	"github.com/erikh/box/builder/executor"
-	"github.com/erikh/box/log"
 	"github.com/fatih/color"
 )
 
 // Docker implements an executor that talks to docker to achieve its goals.
 type Docker struct {
-	client   *client.Client
-	config   *config.Config
-	useCache bool
-	tty      bool
-	stdin    bool
+	client     Client
+	config     *config.Config
+	runConfig  *config.Config
+	execIn     string
+	hostConfig *container.HostConfig
+	cacheIndex *cacheIndex
+	cacheFrom  []string
+	layers     []string
+	changes    []string
+	skipEmpty  bool
+	keep       bool
+	kept       string
+	buildID    string
+	author     string
+	children   map[string][]string
+	runs       int
+	useCache   bool
+	tty        bool
+	imageTTY   bool
+	failStderr bool
+	stdin      bool
+	input      io.Reader
+	log        io.Writer
+}
+
+// BuildIDLabel is the container label holding the ID of the build that
+// created the container.
+const BuildIDLabel = "box.build-id"
+
+// ContainerPrefix starts the names of the containers layers are committed
+// from, followed by the build ID. They are not labeled with it, as docker
+// would copy the label into the image.
+const ContainerPrefix = "box-"
+
+// RoleLabel is the container label set to RoleIntermediate on the containers
+// box creates, other than those layers are committed from, so they can be told
+// apart from other containers.
+const RoleLabel = "box.role"
+
+// RoleIntermediate is the value of RoleLabel on box's containers.
+const RoleIntermediate = "intermediate"
+
+// RoleFinal is the value of RoleLabel on the container of the final image
+// left by a build, which is not removed as the others are.
+const RoleFinal = "final"
+
+// DaemonError is returned when the docker daemon cannot be contacted.
+type DaemonError struct {
+	Host string
+	Err  error
+}
+
+func (e *DaemonError) Error() string {
+	return fmt.Sprintf("Cannot connect to the Docker daemon at %s; is it running? (%v)", e.Host, e.Err)
+}
+
+// IsErrConnectionFailed reports whether the error is a *DaemonError or the
+// client failing to reach the daemon, including as the message of an
+// exception raised with it. The client only reports this by its message.
+func IsErrConnectionFailed(err error) bool {
+	if _, ok := err.(*DaemonError); ok {
+		return true
+	}
+
+	return strings.Contains(err.Error(), client.ErrorConnectionFailed(dockerHost()).Error())
+}
+
+// dockerHost returns the host the environment client will talk to.
+func dockerHost() string {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host
+	}
+
+	return client.DefaultDockerHost
+}
+
+// NewClient returns a client configured from the environment. The daemon is
+// contacted once so that an unreachable daemon is reported here as a
+// *DaemonError instead of during the first operation.
+func NewClient() (Client, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cli.ServerVersion(context.Background()); err != nil {
+		return nil, &DaemonError{Host: dockerHost(), Err: err}
+	}
+
+	return cli, nil
 }
 
 // NewDocker constructs a new docker instance, for executing against docker
-// engines.
+// engines, with a client from NewClient.
 func NewDocker(useCache, tty bool) (*Docker, error) {
-	client, err := client.NewEnvClient()
+	client, err := NewClient()
 	if err != nil {
 		return nil, err
 	}
 
+	return NewDockerWithClient(client, useCache, tty), nil
+}
+
+// NewDockerWithClient constructs a new docker instance which uses the provided
+// client to talk to docker.
+func NewDockerWithClient(client Client, useCache, tty bool) *Docker {
 	return &Docker{
-		tty:      tty,
-		useCache: useCache,
-		client:   client,
-		config:   config.NewConfig(),
-	}, nil
+		tty:        tty,
+		useCache:   useCache,
+		client:     client,
+		config:     config.NewConfig(),
+		hostConfig: &container.HostConfig{},
+	}
 }
 
 // SetStdin turns on the stdin features during run invocations. It is used to
@@ -54,6 +153,28 @@ func (d *Docker) SetStdin(on bool) {
 	d.stdin = on
 }
 
+// SetInput sets content to feed to the stdin of the commands run, until it is
+// set to nil. Unlike SetStdin, no terminal is involved; stdin is closed once
+// the content is written.
+func (d *Docker) SetInput(r io.Reader) {
+	d.input = r
+}
+
+// SetLog copies the output of the commands run to w, without the prefix
+// they are printed with, until it is set to nil.
+func (d *Docker) SetLog(w io.Writer) {
+	d.log = w
+}
+
+// ttyEnabled returns true if containers are given a TTY. Commands fed input
+// never are, so their stdin is not a terminal and can be closed, and neither
+// are the containers of Windows images. A TTY merges stderr into stdout, so
+// commands are not given one when their stderr is checked, unless they are
+// interactive.
+func (d *Docker) ttyEnabled() bool {
+	return d.tty && d.input == nil && d.config.OS != "windows" && (!d.failStderr || d.stdin)
+}
+
 // ImageID returns the image identifier of the most recent layer.
 func (d *Docker) ImageID() string {
 	return d.config.Image
@@ -64,12 +185,55 @@ func (d *Docker) UseCache(arg bool) {
 	d.useCache = arg
 }
 
+// UseCacheDir keeps an index of cache keys to image IDs in the provided
+// directory, which is consulted before scanning the daemon's images.
+func (d *Docker) UseCacheDir(dir string) error {
+	ci, err := loadCacheIndex(dir)
+	if err != nil {
+		return err
+	}
+
+	d.cacheIndex = ci
+	return nil
+}
+
+// SkipEmpty determines whether steps that run a container and leave its
+// filesystem unchanged are committed. When on, no layer is committed for them
+// and the build continues from the parent image.
+func (d *Docker) SkipEmpty(arg bool) {
+	d.skipEmpty = arg
+}
+
+// KeepOnFailure determines whether the container of a step that fails is kept
+// for inspection instead of being removed.
+func (d *Docker) KeepOnFailure(arg bool) {
+	d.keep = arg
+}
+
+// KeptContainer returns the ID of the container kept by the last step to
+// fail, or an empty string if none was kept.
+func (d *Docker) KeptContainer() string {
+	return d.kept
+}
+
 // UseTTY determines whether or not to allow docker to use a TTY for both run
 // and pull operations.
 func (d *Docker) UseTTY(arg bool) {
 	d.tty = arg
 }
 
+// ImageTTY determines whether the images committed ask for a TTY. It is
+// independent of the TTY the build's containers are given.
+func (d *Docker) ImageTTY(arg bool) {
+	d.imageTTY = arg
+}
+
+// FailOnStderr makes commands that write to stderr fail, as if they had exited
+// with a non-zero status. Interactive sessions are not checked.
+func (d *Docker) FailOnStderr(arg bool) {
+	d.failStderr = arg
+}
+
 // LoadConfig loads the configuration into the executor.
 func (d *Docker) LoadConfig(c *config.Config) error {
 	d.config = c
@@ -81,24 +245,52 @@ func (d *Docker) Config() *config.Config {
 	return d.config
 }
 
+// HostConfig returns the host configuration used for created containers.
+func (d *Docker) HostConfig() *container.HostConfig {
+	return d.hostConfig
+}
+
 // Commit commits an entry to the layer list.
 func (d *Docker) Commit(cacheKey string, hook executor.Hook) error {
-	id, err := d.Create()
+	changes := d.changes
+	d.changes = nil
+
+	id, err := d.createCommitted()
 	if err != nil {
 		return err
 	}
+	defer func() { d.execIn = "" }()
 
+	// an interrupted step fails, so with keep on its container is left to the
+	// defer below.
 	signals := make(chan os.Signal)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		_, ok := <-signals
-		if ok {
+		if ok && !d.keep {
 			d.Destroy(id)
 		}
 	}()
 
+	failed := false
+
 	defer func() {
-		d.Destroy(id)
+		if failed && d.keep {
+			// the shell a run step was executed in still waits for commands, so
+			// it is stopped, leaving the container as the step left it.
+			if d.execIn == id {
+				if err := d.client.ContainerKill(context.Background(), id, "KILL"); err != nil {
+					fmt.Printf("+++ Could not stop the kept container %s: %v\n", id, err)
+				}
+			}
+
+			d.kept = id
+			fmt.Printf("+++ Kept container %s of the failed step; inspect it with:\n", id)
+			fmt.Printf("+++   docker diff %s\n", id)
+			fmt.Printf("+++   docker commit %s box-failed && docker run -it --rm --entrypoint /bin/sh box-failed\n", id)
+		} else {
+			d.Destroy(id)
+		}
 		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
 		close(signals)
 	}()
@@ -106,26 +298,71 @@ func (d *Docker) Commit(cacheKey string, hook executor.Hook) error {
 	if hook != nil {
 		tmp, err := hook(id)
 		if err != nil {
+			failed = true
 			return err
 		}
 
 		if tmp != "" {
 			cacheKey = tmp
 		}
+
+		if d.skipEmpty {
+			changes, err := d.client.ContainerDiff(context.Background(), id)
+			if err != nil {
+				return fmt.Errorf("Could not inspect container changes: %v", err)
+			}
+
+			if len(changes) == 0 {
+				fmt.Println("+++ No changes; not committing a layer")
+
+				// the index can remember this, so the step is not run again.
+				if d.cacheIndex != nil && d.config.Image != "" && cacheKey != "" {
+					if err := d.cacheIndex.Set(d.config.Image, cacheKey, d.config.Image); err != nil {
+						return fmt.Errorf("Could not update the cache index: %v", err)
+					}
+				}
+
+				return nil
+			}
+		}
 	}
 
-	commitResp, err := d.client.ContainerCommit(context.Background(), id, types.ContainerCommitOptions{Config: d.config.ToDocker(d.tty, d.stdin), Comment: cacheKey})
+	// Pause ensures nothing is writing to the container's filesystem while it
+	// is committed; containers which have already exited are unaffected.
+	commitConfig := d.config.ToDocker(d.imageTTY && d.config.OS != "windows", d.stdin)
+
+	commitResp, err := d.client.ContainerCommit(context.Background(), id, types.ContainerCommitOptions{Config: commitConfig, Comment: cacheKey, Author: d.author, Changes: changes, Pause: true})
 	if err != nil {
 		return fmt.Errorf("Error during commit: %v", err)
 	}
 
-	// try a clean remove first, otherwise the defer above will take over in a last-ditch attempt
-	err = d.client.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{})
+	// changes may alter the configuration, which later commits must carry on.
+	if len(changes) > 0 {
+		inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), commitResp.ID)
+		if err != nil {
+			return fmt.Errorf("Could not inspect committed image %q: %v", commitResp.ID, err)
+		}
+
+		d.config.FromDocker(inspect.Config)
+	}
+
+	// try a clean remove first, otherwise the defer above will take over in a
+	// last-ditch attempt. A container commands were executed in is still
+	// running.
+	err = d.client.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: id == d.execIn})
 	if err != nil {
 		return fmt.Errorf("Could not remove intermediate container %q: %v", id, err)
 	}
 
+	if d.cacheIndex != nil && d.config.Image != "" && cacheKey != "" {
+		if err := d.cacheIndex.Set(d.config.Image, cacheKey, commitResp.ID); err != nil {
+			return fmt.Errorf("Could not update the cache index: %v", err)
+		}
+	}
+
+	d.addChild(d.config.Image, commitResp.ID)
 	d.config.Image = commitResp.ID
+	d.layers = append(d.layers, commitResp.ID)
 
 	return nil
 }
@@ -139,48 +376,210 @@ func (d *Docker) CheckCache(cacheKey string) (bool, error) {
 	}
 
 	if d.config.Image != "" {
-		images, err := d.client.ImageList(context.Background(), types.ImageListOptions{All: true})
+		if d.cacheIndex != nil {
+			cached, err := d.checkCacheIndex(cacheKey)
+			if err != nil || cached {
+				return cached, err
+			}
+		}
+
+		children, err := d.imageChildren()
 		if err != nil {
 			return false, err
 		}
 
-		for _, img := range images {
-			if img.ParentID == d.config.Image {
-				inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), img.ID)
-				if err != nil {
-					return false, err
-				}
+		for _, id := range children[d.config.Image] {
+			inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), id)
+			if err != nil {
+				// removed since the images were listed.
+				continue
+			}
 
-				if inspect.Comment == cacheKey {
-					log.CacheHit(img.ID)
-					d.config.FromDocker(inspect.Config)
-					d.config.Image = img.ID
-					return true, nil
-				}
+			if inspect.Comment == cacheKey {
+				return true, d.useCached(cacheKey, inspect)
 			}
 		}
+
+		if len(d.cacheFrom) > 0 {
+			return d.checkCacheSources(cacheKey)
+		}
+	}
+
+	return false, nil
+}
+
+// imageChildren returns the IDs of the images on the daemon, keyed by their
+// parent. The images are listed once per executor; those committed and
+// imported since are added with addChild as they are made, as a step can
+// return to an image it built on before, such as in a retry or after a
+// repeated from.
+func (d *Docker) imageChildren() (map[string][]string, error) {
+	if d.children != nil {
+		return d.children, nil
+	}
+
+	images, err := d.client.ImageList(context.Background(), types.ImageListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	d.children = map[string][]string{}
+	for _, img := range images {
+		d.children[img.ParentID] = append(d.children[img.ParentID], img.ID)
+	}
+
+	return d.children, nil
+}
+
+// addChild records an image made during the build as a child of its parent,
+// if the images were listed.
+func (d *Docker) addChild(parent, id string) {
+	if d.children != nil {
+		d.children[parent] = append(d.children[parent], id)
+	}
+}
+
+// checkCacheSources consults the images provided with AddCacheSource. Pulled
+// images do not retain their parent, so a source matches when it carries the
+// cache key, its layers extend the current image's layers, and it is exactly
+// one step further along in history.
+func (d *Docker) checkCacheSources(cacheKey string) (bool, error) {
+	parent, _, err := d.client.ImageInspectWithRaw(context.Background(), d.config.Image)
+	if err != nil {
+		return false, err
+	}
+
+	parentHistory, err := d.client.ImageHistory(context.Background(), d.config.Image)
+	if err != nil {
+		return false, err
+	}
+
+	for _, id := range d.cacheFrom {
+		inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), id)
+		if err != nil {
+			return false, err
+		}
+
+		if inspect.Comment != cacheKey || !isLayerPrefix(parent.RootFS.Layers, inspect.RootFS.Layers) {
+			continue
+		}
+
+		history, err := d.client.ImageHistory(context.Background(), id)
+		if err != nil {
+			return false, err
+		}
+
+		if len(history) != len(parentHistory)+1 {
+			continue
+		}
+
+		return true, d.useCached(cacheKey, inspect)
 	}
 
 	return false, nil
 }
 
+// useCached moves the build onto a cached image, recording it in the cache
+// index if one is in use.
+func (d *Docker) useCached(cacheKey string, inspect types.ImageInspect) error {
+	if d.cacheIndex != nil {
+		if id, _ := d.cacheIndex.Get(d.config.Image, cacheKey); id != inspect.ID {
+			if err := d.cacheIndex.Set(d.config.Image, cacheKey, inspect.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	d.config.FromDocker(inspect.Config)
+	d.config.Image = inspect.ID
+	d.layers = append(d.layers, inspect.ID)
+
+	return nil
+}
+
+// isLayerPrefix returns true if child contains all of parent's layers in
+// order, plus at most one more.
+func isLayerPrefix(parent, child []string) bool {
+	if len(child) < len(parent) || len(child) > len(parent)+1 {
+		return false
+	}
+
+	for i := range parent {
+		if parent[i] != child[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkCacheIndex consults the on-disk cache index. Entries whose image is no
+// longer present, or no longer matches, are removed from the index.
+func (d *Docker) checkCacheIndex(cacheKey string) (bool, error) {
+	id, ok := d.cacheIndex.Get(d.config.Image, cacheKey)
+	if !ok {
+		return false, nil
+	}
+
+	// the step changed nothing and was not committed; see SkipEmpty.
+	if id == d.config.Image {
+		return true, nil
+	}
+
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), id)
+	if err != nil || inspect.Parent != d.config.Image || inspect.Comment != cacheKey {
+		return false, d.cacheIndex.Delete(d.config.Image, cacheKey)
+	}
+
+	return true, d.useCached(cacheKey, inspect)
+}
+
 // CopyOneFileFromContainer copies a file from the container and returns its content.
-// An error is returned, if any.
+// An error is returned, if any. Large files should be read with
+// OpenFileFromContainer instead.
 func (d *Docker) CopyOneFileFromContainer(fn string) ([]byte, error) {
-	id, err := d.Create()
+	rc, err := d.OpenFileFromContainer(fn)
 	if err != nil {
 		return nil, err
 	}
+	defer rc.Close()
 
-	defer d.Destroy(id)
+	return ioutil.ReadAll(rc)
+}
+
+// containerFile streams a file out of a container. Closing it removes the
+// container.
+type containerFile struct {
+	io.Reader
+	rc io.ReadCloser
+	d  *Docker
+	id string
+}
+
+func (cf *containerFile) Close() error {
+	err := cf.rc.Close()
+	if derr := cf.d.Destroy(cf.id); err == nil {
+		err = derr
+	}
+
+	return err
+}
+
+// OpenFileFromContainer opens a file in the container for reading, without
+// reading it into memory. The caller must close it.
+func (d *Docker) OpenFileFromContainer(fn string) (io.ReadCloser, error) {
+	id, err := d.Create()
+	if err != nil {
+		return nil, err
+	}
 
 	rc, _, err := d.client.CopyFromContainer(context.Background(), id, fn)
 	if err != nil {
+		d.Destroy(id)
 		return nil, err
 	}
 
 	tr := tar.NewReader(rc)
-	defer rc.Close()
 
 	var header *tar.Header
 
@@ -191,6 +590,8 @@ func (d *Docker) CopyOneFileFromContainer(fn string) ([]byte, error) {
 		}
 
 		if err != nil {
+			rc.Close()
+			d.Destroy(id)
 			return nil, err
 		}
 
@@ -200,25 +601,145 @@ func (d *Docker) CopyOneFileFromContainer(fn string) ([]byte, error) {
 	}
 
 	if header == nil || header.Name != filepath.Base(fn) {
+		rc.Close()
+		d.Destroy(id)
 		return nil, fmt.Errorf("Could not find %q in container", fn)
 	}
 
-	return ioutil.ReadAll(tr)
+	return &containerFile{Reader: tr, rc: rc, d: d, id: id}, nil
+}
+
+// AddChanges adds Dockerfile instructions, such as "LABEL x=y", to apply to
+// the image during the next Commit.
+func (d *Docker) AddChanges(changes ...string) {
+	d.changes = append(d.changes, changes...)
+}
+
+// SetAuthor sets the author of the images committed from here on.
+func (d *Docker) SetAuthor(author string) {
+	d.author = author
+}
+
+// SetBuildID labels the containers created from here on with the build ID,
+// under BuildIDLabel, and names those layers are committed from after it.
+func (d *Docker) SetBuildID(id string) {
+	d.buildID = id
+}
+
+// SetRunConfig sets a configuration that RunHook runs commands with in place
+// of the image configuration, until it is set to nil. Containers created with
+// Create use it in full. Docker carries the configuration of a container into
+// the image committed from it, so the containers Commit and Rebase commit
+// from are created with the image configuration instead, and the command is
+// executed in them with the user and environment of the run configuration.
+func (d *Docker) SetRunConfig(c *config.Config) {
+	d.runConfig = c
 }
 
 // Create creates a new container based on the existing configuration.
 func (d *Docker) Create() (string, error) {
+	c := d.config
+	if d.runConfig != nil {
+		c = d.runConfig
+	}
+
+	cfg := c.ToDocker(d.ttyEnabled(), d.stdin || d.input != nil)
+	cfg.StdinOnce = d.input != nil
+
+	return d.create(cfg, RoleIntermediate)
+}
+
+// CreateFinal creates a container of the current image to be left once the
+// build is done, labeled with RoleFinal.
+func (d *Docker) CreateFinal() (string, error) {
+	return d.create(d.config.ToDocker(d.ttyEnabled(), false), RoleFinal)
+}
+
+// createCommitted creates the container a layer is committed from, with the
+// image configuration. With a run configuration set, the container is started
+// with only the shell, reading a stdin nothing writes to, so it waits for
+// RunHook to execute the command in it.
+func (d *Docker) createCommitted() (string, error) {
+	cfg := d.config.ToDocker(d.ttyEnabled(), d.stdin || d.input != nil)
+	cfg.StdinOnce = d.input != nil
+
+	if d.runConfig != nil {
+		cfg = d.config.ToDocker(false, true)
+		cfg.Entrypoint = d.waitShell()
+		cfg.Cmd = nil
+	}
+
+	// docker carries the labels of the container into the image, so it is
+	// not labeled as box's, and the build ID is given in its name instead.
+	id, err := d.createNamed(cfg, d.containerName())
+	if err != nil || d.runConfig == nil {
+		return id, err
+	}
+
+	if err := d.client.ContainerStart(context.Background(), id, types.ContainerStartOptions{}); err != nil {
+		d.Destroy(id)
+		return "", fmt.Errorf("Could not start container: %v", err)
+	}
+
+	d.execIn = id
+
+	return id, nil
+}
+
+// waitShell returns the shell of the image without its arguments, which
+// reads commands from stdin.
+func (d *Docker) waitShell() []string {
+	switch {
+	case len(d.config.Shell) > 0:
+		return d.config.Shell[:1]
+	case d.config.OS == "windows":
+		return []string{"cmd"}
+	default:
+		return []string{"/bin/sh"}
+	}
+}
+
+// create creates a container with the configuration, labeled as box's with
+// the role.
+func (d *Docker) create(cfg *container.Config, role string) (string, error) {
+	cfg.Labels = map[string]string{RoleLabel: role}
+	if d.buildID != "" {
+		cfg.Labels[BuildIDLabel] = d.buildID
+	}
+
+	return d.createNamed(cfg, "")
+}
+
+// createNamed creates a container with the configuration and name. Docker
+// names containers given an empty name.
+func (d *Docker) createNamed(cfg *container.Config, name string) (string, error) {
 	cont, err := d.client.ContainerCreate(
 		context.Background(),
-		d.config.ToDocker(d.tty, d.stdin),
+		cfg,
+		d.hostConfig,
 		nil,
-		nil,
-		"",
+		name,
 	)
 
 	return cont.ID, err
 }
 
+// containerName returns the name of a container layers are committed from,
+// ContainerPrefix, the build ID and a random suffix, or an empty name without
+// a build ID.
+func (d *Docker) containerName() string {
+	if d.buildID == "" {
+		return ""
+	}
+
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+
+	return ContainerPrefix + d.buildID + "-" + hex.EncodeToString(buf)
+}
+
 // Destroy destroys a container for the given id.
 func (d *Docker) Destroy(id string) error {
 	return d.client.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true})
@@ -231,6 +752,31 @@ func (d *Docker) CopyFromContainer(id, path string) (io.Reader, error) {
 	return rc, err
 }
 
+// FileMode returns the mode of a path in the current image, following
+// symlinks.
+func (d *Docker) FileMode(path string) (os.FileMode, error) {
+	id, err := d.Create()
+	if err != nil {
+		return 0, err
+	}
+	defer d.Destroy(id)
+
+	stat, err := d.client.ContainerStatPath(context.Background(), id, path)
+	if err != nil {
+		return 0, err
+	}
+
+	// the daemon resolves the link target to a path in the container.
+	if stat.Mode&os.ModeSymlink != 0 && stat.LinkTarget != "" {
+		stat, err = d.client.ContainerStatPath(context.Background(), id, stat.LinkTarget)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return stat.Mode, nil
+}
+
 // CopyToContainer copies a tarred up series of files (passed in through the
 // io.Reader handle) to the container where they are untarred.
 func (d *Docker) CopyToContainer(id, path string, tw io.Reader) error {
@@ -244,11 +790,254 @@ func (d *Docker) Tag(tag string) error {
 
 // Fetch retrieves a docker image, overwrites the container configuration, and returns its id.
 func (d *Docker) Fetch(name string) (string, error) {
+	inspect, err := d.pull(name)
+	if err != nil {
+		return "", err
+	}
+
+	d.config.FromDocker(inspect.Config)
+	d.config.OS = inspect.Os
+	d.layers = []string{}
+
+	return inspect.ID, nil
+}
+
+// Import creates an image from the root filesystem archive read from r, and
+// starts the build from it as Fetch does. The image carries the key as its
+// comment; with the cache on, an image imported earlier with the same key is
+// used instead of importing again.
+func (d *Docker) Import(r io.Reader, key string) (string, error) {
+	id := ""
+
+	if d.useCache {
+		children, err := d.imageChildren()
+		if err != nil {
+			return "", err
+		}
+
+		// imported images have no parent.
+		for _, candidate := range children[""] {
+			inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), candidate)
+			if err == nil && inspect.Comment == key {
+				id = inspect.ID
+				break
+			}
+		}
+	}
+
+	if id == "" {
+		reader, err := d.client.ImageImport(context.Background(), types.ImageImportSource{Source: r, SourceName: "-"}, "", types.ImageImportOptions{Message: key})
+		if err != nil {
+			return "", fmt.Errorf("Could not import the image: %v", err)
+		}
+		defer reader.Close()
+
+		if id, err = importedID(reader); err != nil {
+			return "", fmt.Errorf("Could not import the image: %v", err)
+		}
+
+		d.addChild("", id)
+	}
+
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), id)
+	if err != nil {
+		return "", err
+	}
+
+	// imported images have no configuration of their own.
+	if inspect.Config == nil {
+		inspect.Config = &container.Config{}
+	}
+
+	d.config.FromDocker(inspect.Config)
+	d.config.OS = inspect.Os
+	d.layers = []string{}
+
+	return inspect.ID, nil
+}
+
+// importedID reads the JSON stream docker answers an import with, and returns
+// the ID of the image created, which is the status of the last message.
+func importedID(reader io.Reader) (string, error) {
+	id := ""
+	dec := json.NewDecoder(reader)
+
+	for {
+		var msg struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		if msg.Error != "" {
+			return "", errors.New(msg.Error)
+		}
+
+		if msg.Status != "" {
+			id = strings.TrimSpace(msg.Status)
+		}
+	}
+
+	if id == "" {
+		return "", errors.New("docker did not report the ID of the image")
+	}
+
+	return id, nil
+}
+
+// Digest returns the digest reference (name@sha256:...) of the named image,
+// or an empty string if the image was not pulled from a registry.
+func (d *Docker) Digest(name string) (string, error) {
+	if strings.Contains(name, "@") {
+		return name, nil
+	}
+
 	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), name)
 	if err != nil {
+		return "", err
+	}
+
+	repo, _ := SplitTag(name)
+	for _, digest := range inspect.RepoDigests {
+		if strings.HasPrefix(digest, repo+"@") {
+			return digest, nil
+		}
+	}
+
+	if len(inspect.RepoDigests) > 0 {
+		return inspect.RepoDigests[0], nil
+	}
+
+	return "", nil
+}
+
+// ImageProperties returns the user, workdir, os and architecture of the image
+// ID. An empty user or workdir is reported as docker uses it: root, or /.
+func (d *Docker) ImageProperties(id string) (map[string]string, error) {
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	props := map[string]string{
+		"user":         "root",
+		"workdir":      "/",
+		"os":           inspect.Os,
+		"architecture": inspect.Architecture,
+	}
+
+	if inspect.Config != nil {
+		if inspect.Config.User != "" {
+			props["user"] = inspect.Config.User
+		}
+
+		if inspect.Config.WorkingDir != "" {
+			props["workdir"] = inspect.Config.WorkingDir
+		}
+	}
+
+	return props, nil
+}
+
+// ImageSize returns the size of the image ID, including its parents.
+func (d *Docker) ImageSize(id string) (int64, error) {
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), id)
+	if err != nil {
+		return 0, err
+	}
+
+	return inspect.Size, nil
+}
+
+// ImageConfig returns the configuration of the image ID and the IDs of its
+// filesystem layers. An image without a configuration has an empty one.
+func (d *Docker) ImageConfig(id string) (*container.Config, []string, error) {
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if inspect.Config == nil {
+		inspect.Config = &container.Config{}
+	}
+
+	return inspect.Config, inspect.RootFS.Layers, nil
+}
+
+// ImageLayers returns the number of filesystem layers of the image, and the
+// ID of its parent.
+func (d *Docker) ImageLayers(id string) (int, string, error) {
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), id)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return len(inspect.RootFS.Layers), inspect.Parent, nil
+}
+
+// Rebase commits a container of the base image, modified by the hook, with
+// the configuration of the current image as docker has it, so the settings
+// box does not track, such as labels and exposed ports, are kept. The result
+// becomes the current image.
+func (d *Docker) Rebase(base string, hook executor.Hook) error {
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), d.config.Image)
+	if err != nil {
+		return err
+	}
+
+	if inspect.Config == nil {
+		inspect.Config = &container.Config{}
+	}
+
+	current := d.config.Image
+	d.config.Image = base
+
+	id, err := d.createCommitted()
+	d.config.Image = current
+	if err != nil {
+		return err
+	}
+	defer d.Destroy(id)
+	defer func() { d.execIn = "" }()
+
+	if _, err := hook(id); err != nil {
+		return err
+	}
+
+	commitConfig := inspect.Config
+	commitConfig.Image = base
+
+	commitResp, err := d.client.ContainerCommit(context.Background(), id, types.ContainerCommitOptions{Config: commitConfig, Author: d.author, Pause: true})
+	if err != nil {
+		return fmt.Errorf("Error during commit: %v", err)
+	}
+
+	d.config.Image = commitResp.ID
+	d.layers = append(d.layers, commitResp.ID)
+
+	return nil
+}
+
+// imageIDPattern matches full image IDs, with or without the digest algorithm.
+var imageIDPattern = regexp.MustCompile(`^(sha256:)?[0-9a-f]{64}$`)
+
+// pull inspects the named image, pulling it first if it is not present. Image
+// IDs, such as one returned by an earlier build, are never pulled.
+func (d *Docker) pull(name string) (types.ImageInspect, error) {
+	inspect, _, err := d.client.ImageInspectWithRaw(context.Background(), name)
+	if err != nil {
+		if imageIDPattern.MatchString(name) {
+			return inspect, fmt.Errorf("Image %q does not exist locally: %v", name, err)
+		}
+
 		reader, err := d.client.ImagePull(context.Background(), name, types.ImagePullOptions{})
 		if err != nil {
-			return "", err
+			return inspect, err
 		}
 
 		if !d.tty {
@@ -256,32 +1045,150 @@ func (d *Docker) Fetch(name string) (string, error) {
 			os.Stdout.Sync()
 			_, err := ioutil.ReadAll(reader)
 			if err != nil {
-				return "", err
+				return inspect, err
 			}
 			fmt.Println("done.")
 		} else {
 			if err := printPull(reader); err != nil {
-				return "", err
+				return inspect, err
 			}
 		}
 
-		// this will fallthrough to the assignment below
 		inspect, _, err = d.client.ImageInspectWithRaw(context.Background(), name)
 		if err != nil {
-			return "", err
+			return inspect, err
 		}
 	}
 
-	d.config.FromDocker(inspect.Config)
+	return inspect, nil
+}
 
-	return inspect.ID, nil
+// AddCacheSource pulls the named image if necessary and considers it during
+// CheckCache in addition to the images built locally. This allows images
+// pushed from other hosts to seed the build cache. The layer images tagged
+// with the same name by a build using --cache-to (tag-1, tag-2, ...) are
+// pulled and considered as well.
+func (d *Docker) AddCacheSource(name string) error {
+	inspect, err := d.pull(name)
+	if err != nil {
+		return err
+	}
+
+	d.cacheFrom = append(d.cacheFrom, inspect.ID)
+
+	repo, tag := SplitTag(name)
+	for i := 1; ; i++ {
+		inspect, err := d.pull(fmt.Sprintf("%s:%s-%d", repo, tag, i))
+		if err != nil {
+			break
+		}
+
+		d.cacheFrom = append(d.cacheFrom, inspect.ID)
+	}
+
+	return nil
+}
+
+// SplitTag splits an image reference into its repository and tag. The tag is
+// "latest" if none is provided.
+func SplitTag(ref string) (string, string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ref, "latest"
+	}
+
+	return ref[:i], ref[i+1:]
+}
+
+// Layers returns the images committed or reused from cache since the last
+// Fetch, in order.
+func (d *Docker) Layers() []string {
+	return d.layers
+}
+
+// TagImage tags the provided image ID with the provided name.
+func (d *Docker) TagImage(id, name string) error {
+	return d.client.ImageTag(context.Background(), id, name)
+}
+
+// Push pushes the named image to its registry.
+func (d *Docker) Push(name string) error {
+	fmt.Printf("+++ Pushing %q...", name)
+	os.Stdout.Sync()
+
+	reader, err := d.client.ImagePush(context.Background(), name, types.ImagePushOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := checkStream(reader); err != nil {
+		return err
+	}
+
+	fmt.Println("done.")
+	return nil
+}
+
+// Save writes the named images, as a tar archive that docker load accepts, to
+// the writer.
+func (d *Docker) Save(names []string, w io.Writer) error {
+	reader, err := d.client.ImageSave(context.Background(), names)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// RemoveImage removes the named image, or just the tag if the image has other
+// names. With prune, the untagged parents of a removed image are removed too.
+func (d *Docker) RemoveImage(name string, prune bool) error {
+	_, err := d.client.ImageRemove(context.Background(), name, types.ImageRemoveOptions{PruneChildren: prune})
+	return err
+}
+
+// checkStream reads a JSON progress stream from docker to the end and returns
+// the first error reported within it.
+func checkStream(reader io.Reader) error {
+	dec := json.NewDecoder(reader)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
 }
 
-// RunHook is the run hook for docker agents.
+// RunHook is the run hook for docker agents. In the containers Commit creates
+// with a run configuration, the command is executed; other containers are
+// started.
 func (d *Docker) RunHook(id string) (string, error) {
-	cearesp, err := d.client.ContainerAttach(context.Background(), id, types.ContainerAttachOptions{Stream: true, Stdin: d.stdin, Stdout: true, Stderr: true})
+	var (
+		cearesp types.HijackedResponse
+		wait    func(context.Context) (int, error)
+		err     error
+	)
+
+	if id == d.execIn {
+		cearesp, wait, err = d.execCommand(id)
+	} else {
+		cearesp, wait, err = d.attachContainer(id)
+	}
+
 	if err != nil {
-		return "", fmt.Errorf("Could not attach to container: %v", err)
+		return "", err
 	}
 
 	stopChan := make(chan struct{})
@@ -296,23 +1203,50 @@ func (d *Docker) RunHook(id string) (string, error) {
 		defer term.RestoreTerminal(0, state)
 
 		go doCopy(cearesp.Conn, os.Stdin, errChan, stopChan)
+	} else if d.input != nil {
+		// closing our end closes the command's stdin, as the container is
+		// created with StdinOnce.
+		go func() {
+			if _, err := io.Copy(cearesp.Conn, d.input); err != nil {
+				fmt.Printf("+++ Error writing to stdin: %v\n", err)
+			}
+			cearesp.CloseWrite()
+		}()
 	}
 
 	defer cearesp.Close()
 
-	err = d.client.ContainerStart(context.Background(), id, types.ContainerStartOptions{})
-	if err != nil {
-		return "", fmt.Errorf("Could not start container: %v", err)
-	}
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	written := &countWriter{}
 
 	if !d.stdin {
 		color.New(color.FgRed, color.Bold, color.BgWhite).Printf("------ BEGIN OUTPUT ------\n")
+
+		// interactive sessions are left alone; everything else is prefixed with
+		// the run it came from.
+		d.runs++
+		prefix := fmt.Sprintf("[run %d] ", d.runs)
+		stdout = newPrefixWriter(os.Stdout, prefix)
+		stderr = newPrefixWriter(os.Stderr, prefix)
+
+		if d.log != nil {
+			stdout = io.MultiWriter(stdout, d.log)
+			stderr = io.MultiWriter(stderr, d.log)
+		}
+
+		if d.failStderr {
+			stderr = io.MultiWriter(stderr, written)
+		}
 	}
 
-	if !d.tty {
+	copied := make(chan struct{})
+
+	if !d.ttyEnabled() {
 		go func() {
+			defer close(copied)
+
 			// docker mux's the streams, and requires this stdcopy library to unpack them.
-			_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, cearesp.Reader)
+			_, err := stdcopy.StdCopy(stdout, stderr, cearesp.Reader)
 			if err != nil && err != io.EOF {
 				select {
 				case <-stopChan:
@@ -323,17 +1257,23 @@ func (d *Docker) RunHook(id string) (string, error) {
 				errChan <- err
 			}
 		}()
-	} else if d.tty {
-		go doCopy(os.Stdout, cearesp.Reader, errChan, stopChan)
+	} else {
+		go func() {
+			defer close(copied)
+			doCopy(stdout, cearesp.Reader, errChan, stopChan)
+		}()
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(stopChan) }) }
+
 	go func() {
 		err, ok := <-errChan
 		if ok {
 			fmt.Printf("+++ Error: %v", err)
-			close(stopChan)
+			stop()
 			cancel()
 		}
 	}()
@@ -350,9 +1290,27 @@ func (d *Docker) RunHook(id string) (string, error) {
 
 	defer close(intSig)
 	defer close(errChan)
-	defer close(stopChan)
+	defer stop()
+
+	stat, err := wait(ctx)
+
+	// the output may still be in flight when the command exits, and the
+	// writers it goes to, such as the step log, are closed once this returns.
+	// Processes the command left running can keep the stream open, so it is
+	// closed after a grace period, which ends the copy.
+	grace := outputGrace
+	if err != nil {
+		grace = 0
+	}
+
+	select {
+	case <-copied:
+	case <-time.After(grace):
+		stop()
+		cearesp.Close()
+		<-copied
+	}
 
-	stat, err := d.client.ContainerWait(ctx, id)
 	if err != nil {
 		return "", err
 	}
@@ -365,9 +1323,96 @@ func (d *Docker) RunHook(id string) (string, error) {
 		return "", fmt.Errorf("Command exited with status %d for container %q", stat, id)
 	}
 
+	if d.failStderr && !d.stdin {
+		if written.n > 0 {
+			return "", fmt.Errorf("Command wrote %d bytes to stderr for container %q", written.n, id)
+		}
+	}
+
 	return "", nil
 }
 
+// outputGrace is how long RunHook waits for the output of a command that has
+// exited.
+const outputGrace = 5 * time.Second
+
+// attachContainer attaches to the container and starts it. The function
+// returned waits for it to exit.
+func (d *Docker) attachContainer(id string) (types.HijackedResponse, func(context.Context) (int, error), error) {
+	cearesp, err := d.client.ContainerAttach(context.Background(), id, types.ContainerAttachOptions{Stream: true, Stdin: d.stdin || d.input != nil, Stdout: true, Stderr: true})
+	if err != nil {
+		return types.HijackedResponse{}, nil, fmt.Errorf("Could not attach to container: %v", err)
+	}
+
+	err = d.client.ContainerStart(context.Background(), id, types.ContainerStartOptions{})
+	if err != nil {
+		cearesp.Close()
+		return types.HijackedResponse{}, nil, fmt.Errorf("Could not start container: %v", err)
+	}
+
+	wait := func(ctx context.Context) (int, error) {
+		return d.client.ContainerWait(ctx, id)
+	}
+
+	return cearesp, wait, nil
+}
+
+// execCommand executes the command of the run configuration in the running
+// container, as its user and with its environment. The function returned
+// waits for the command to exit.
+func (d *Docker) execCommand(id string) (types.HijackedResponse, func(context.Context) (int, error), error) {
+	execConfig := types.ExecConfig{
+		User:         d.runConfig.User,
+		Env:          d.runConfig.Env,
+		Cmd:          append(append([]string{}, d.runConfig.Entrypoint...), d.runConfig.Cmd...),
+		Tty:          d.ttyEnabled(),
+		AttachStdin:  d.stdin || d.input != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+
+	execResp, err := d.client.ContainerExecCreate(context.Background(), id, execConfig)
+	if err != nil {
+		return types.HijackedResponse{}, nil, fmt.Errorf("Could not create command in container: %v", err)
+	}
+
+	cearesp, err := d.client.ContainerExecAttach(context.Background(), execResp.ID, execConfig)
+	if err != nil {
+		return types.HijackedResponse{}, nil, fmt.Errorf("Could not attach to command in container: %v", err)
+	}
+
+	wait := func(ctx context.Context) (int, error) {
+		for {
+			inspect, err := d.client.ContainerExecInspect(ctx, execResp.ID)
+			if err != nil {
+				return 0, err
+			}
+
+			if !inspect.Running {
+				return inspect.ExitCode, nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+
+	return cearesp, wait, nil
+}
+
+// countWriter counts the bytes written to it, and discards them.
+type countWriter struct {
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
 func printPull(reader io.Reader) error {
 	idmap := map[string][]string{}
 	idlist := []string{}
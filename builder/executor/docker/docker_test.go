@@ -0,0 +1,898 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	. "testing"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/engine-api/types/network"
+	"github.com/erikh/box/builder/config"
+	"golang.org/x/net/context"
+
+	. "gopkg.in/check.v1"
+)
+
+type dockerSuite struct{}
+
+var _ = Suite(&dockerSuite{})
+
+func TestDocker(t *T) {
+	TestingT(t)
+}
+
+// mockClient implements Client against an in-memory set of images. Methods
+// not overridden here panic through the nil embedded interface.
+type mockClient struct {
+	Client
+	images    map[string]types.ImageInspect
+	history   map[string][]types.ImageHistory
+	tags      map[string]string
+	files     map[string][]byte
+	links     map[string]string
+	changes   []types.ContainerChange
+	created   *container.Config
+	name      string
+	started   int
+	killed    []string
+	execs     []types.ExecConfig
+	output    []byte
+	listCalls int
+	committed int
+	removed   int
+	commits   []types.ContainerCommitOptions
+	imported  int
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{images: map[string]types.ImageInspect{}, history: map[string][]types.ImageHistory{}, tags: map[string]string{}, files: map[string][]byte{}, links: map[string]string{}}
+}
+
+func (mc *mockClient) ImageHistory(ctx context.Context, imageID string) ([]types.ImageHistory, error) {
+	return mc.history[imageID], nil
+}
+
+func (mc *mockClient) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.Image, error) {
+	mc.listCalls++
+	images := []types.Image{}
+	for id, inspect := range mc.images {
+		images = append(images, types.Image{ID: id, ParentID: inspect.Parent})
+	}
+	return images, nil
+}
+
+func (mc *mockClient) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	inspect, ok := mc.images[imageID]
+	if !ok {
+		return types.ImageInspect{}, nil, errors.New("no such image")
+	}
+	return inspect, nil, nil
+}
+
+func (mc *mockClient) ImageImport(ctx context.Context, source types.ImageImportSource, ref string, options types.ImageImportOptions) (io.ReadCloser, error) {
+	content, err := ioutil.ReadAll(source.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	mc.imported++
+	id := fmt.Sprintf("sha256:imported%d", mc.imported)
+	mc.images[id] = types.ImageInspect{ID: id, Comment: options.Message, Size: int64(len(content)), Os: "linux"}
+	return ioutil.NopCloser(strings.NewReader(fmt.Sprintf("{\"status\":%q}\n", id))), nil
+}
+
+func (mc *mockClient) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	return nil, errors.New("no such image")
+}
+
+func (mc *mockClient) ImageTag(ctx context.Context, imageID, ref string) error {
+	mc.tags[ref] = imageID
+	return nil
+}
+
+func (mc *mockClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (types.ContainerCreateResponse, error) {
+	mc.created = config
+	mc.name = containerName
+	return types.ContainerCreateResponse{ID: "container"}, nil
+}
+
+func (mc *mockClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	mc.started++
+	return nil
+}
+
+func (mc *mockClient) ContainerKill(ctx context.Context, containerID, signal string) error {
+	mc.killed = append(mc.killed, containerID)
+	return nil
+}
+
+func (mc *mockClient) ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.ContainerExecCreateResponse, error) {
+	mc.execs = append(mc.execs, config)
+	return types.ContainerExecCreateResponse{ID: "exec"}, nil
+}
+
+// ContainerExecAttach returns a connection on which the command writes the
+// output set, a byte at a time, to stdout.
+func (mc *mockClient) ContainerExecAttach(ctx context.Context, execID string, config types.ExecConfig) (types.HijackedResponse, error) {
+	conn, _ := net.Pipe()
+
+	r, w := io.Pipe()
+	go func() {
+		stdout := stdcopy.NewStdWriter(w, stdcopy.Stdout)
+		for _, b := range mc.output {
+			stdout.Write([]byte{b})
+		}
+		w.Close()
+	}()
+
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(r)}, nil
+}
+
+func (mc *mockClient) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	return types.ContainerExecInspect{ExecID: execID}, nil
+}
+
+func (mc *mockClient) ContainerDiff(ctx context.Context, containerID string) ([]types.ContainerChange, error) {
+	return mc.changes, nil
+}
+
+func (mc *mockClient) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	mc.removed++
+	return nil
+}
+
+func (mc *mockClient) CopyFromContainer(ctx context.Context, container, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	content, ok := mc.files[srcPath]
+	if !ok {
+		return nil, types.ContainerPathStat{}, errors.New("no such file")
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: filepath.Base(srcPath), Mode: 0644, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+
+	return ioutil.NopCloser(buf), types.ContainerPathStat{}, nil
+}
+
+func (mc *mockClient) ContainerStatPath(ctx context.Context, containerID, path string) (types.ContainerPathStat, error) {
+	if target, ok := mc.links[path]; ok {
+		return types.ContainerPathStat{Name: filepath.Base(path), Mode: os.ModeSymlink | 0777, LinkTarget: target}, nil
+	}
+
+	content, ok := mc.files[path]
+	if !ok {
+		return types.ContainerPathStat{}, errors.New("no such file")
+	}
+
+	return types.ContainerPathStat{Name: filepath.Base(path), Mode: 0755, Size: int64(len(content))}, nil
+}
+
+func (mc *mockClient) ContainerCommit(ctx context.Context, id string, options types.ContainerCommitOptions) (types.ContainerCommitResponse, error) {
+	mc.committed++
+	mc.commits = append(mc.commits, options)
+	return types.ContainerCommitResponse{ID: "committed"}, nil
+}
+
+func (ds *dockerSuite) TestIsErrConnectionFailed(c *C) {
+	os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:1")
+	defer os.Unsetenv("DOCKER_HOST")
+
+	cli, err := client.NewEnvClient()
+	c.Assert(err, IsNil)
+	_, err = cli.ServerVersion(context.Background())
+	c.Assert(err, NotNil)
+
+	c.Assert(IsErrConnectionFailed(err), Equals, true)
+	// as the message of the exception raised in the plan.
+	c.Assert(IsErrConnectionFailed(fmt.Errorf("Could not commit: %v", err)), Equals, true)
+	c.Assert(IsErrConnectionFailed(&DaemonError{Host: "tcp://127.0.0.1:1", Err: err}), Equals, true)
+	c.Assert(IsErrConnectionFailed(errors.New("Command exited with status 1")), Equals, false)
+}
+
+func (ds *dockerSuite) TestCheckCache(c *C) {
+	mc := newMockClient()
+	mc.images["child"] = types.ImageInspect{ID: "child", Parent: "base", Comment: "key", Config: &container.Config{User: "nobody"}}
+
+	d := NewDockerWithClient(mc, false, false)
+	d.config.Image = "base"
+
+	cached, err := d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, false)
+
+	d.UseCache(true)
+
+	cached, err = d.CheckCache("other")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, false)
+	c.Assert(d.config.Image, Equals, "base")
+
+	cached, err = d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, true)
+	c.Assert(d.config.Image, Equals, "child")
+	c.Assert(d.config.User, Equals, "nobody")
+
+	// the daemon's images are only listed once, and those committed since are
+	// found as well.
+	d.config.Image = "base"
+	c.Assert(d.Commit("again", nil), IsNil)
+	mc.images["committed"] = types.ImageInspect{ID: "committed", Parent: "base", Comment: "again", Config: &container.Config{}}
+	d.config.Image = "base"
+
+	cached, err = d.CheckCache("again")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, true)
+	c.Assert(d.config.Image, Equals, "committed")
+	c.Assert(mc.listCalls, Equals, 1)
+}
+
+func (ds *dockerSuite) TestCacheRetaggedBase(c *C) {
+	dir, err := ioutil.TempDir("", "box-cache-index")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	// a layer built on the image debian:latest used to name.
+	mc := newMockClient()
+	mc.images["old"] = types.ImageInspect{ID: "old", RootFS: types.RootFS{Layers: []string{"a"}}, Config: &container.Config{}}
+	mc.images["new"] = types.ImageInspect{ID: "new", RootFS: types.RootFS{Layers: []string{"z"}}, Config: &container.Config{}}
+	mc.history["new"] = []types.ImageHistory{{}}
+	mc.images["child"] = types.ImageInspect{ID: "child", Parent: "old", Comment: "key", RootFS: types.RootFS{Layers: []string{"a", "b"}}, Config: &container.Config{}}
+	mc.history["child"] = []types.ImageHistory{{}, {}}
+
+	d := NewDockerWithClient(mc, true, false)
+	c.Assert(d.UseCacheDir(dir), IsNil)
+	c.Assert(d.cacheIndex.Set("old", "key", "child"), IsNil)
+	c.Assert(d.AddCacheSource("child"), IsNil)
+
+	// the cache is keyed by the parent's image ID, not the name it was pulled
+	// by, so once the tag moves the layer is no longer found by any means.
+	d.config.Image = "new"
+
+	cached, err := d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, false)
+	c.Assert(d.config.Image, Equals, "new")
+
+	d.config.Image = "old"
+
+	cached, err = d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, true)
+	c.Assert(d.config.Image, Equals, "child")
+}
+
+func (ds *dockerSuite) TestCacheIndex(c *C) {
+	dir, err := ioutil.TempDir("", "box-cache-index")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	mc := newMockClient()
+	d := NewDockerWithClient(mc, true, false)
+	c.Assert(d.UseCacheDir(dir), IsNil)
+	d.config.Image = "base"
+
+	c.Assert(d.Commit("key", nil), IsNil)
+	c.Assert(d.config.Image, Equals, "committed")
+	mc.images["committed"] = types.ImageInspect{ID: "committed", Parent: "base", Comment: "key", Config: &container.Config{}}
+
+	// a fresh executor picks the entry up from disk without listing images.
+	d = NewDockerWithClient(mc, true, false)
+	c.Assert(d.UseCacheDir(dir), IsNil)
+	d.config.Image = "base"
+	mc.listCalls = 0
+
+	cached, err := d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, true)
+	c.Assert(d.config.Image, Equals, "committed")
+	c.Assert(mc.listCalls, Equals, 0)
+
+	// stale entries are dropped and the daemon is scanned instead.
+	delete(mc.images, "committed")
+	d.config.Image = "base"
+
+	cached, err = d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, false)
+	c.Assert(mc.listCalls, Equals, 1)
+
+	_, ok := d.cacheIndex.Get("base", "key")
+	c.Assert(ok, Equals, false)
+}
+
+func (ds *dockerSuite) TestDigest(c *C) {
+	mc := newMockClient()
+	mc.images["debian:bullseye"] = types.ImageInspect{ID: "debian", RepoDigests: []string{"mirror/debian@sha256:1", "debian@sha256:2"}}
+	mc.images["local"] = types.ImageInspect{ID: "local"}
+
+	d := NewDockerWithClient(mc, true, false)
+
+	digest, err := d.Digest("debian:bullseye")
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, "debian@sha256:2")
+
+	digest, err = d.Digest("debian@sha256:3")
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, "debian@sha256:3")
+
+	digest, err = d.Digest("local")
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, "")
+}
+
+func (ds *dockerSuite) TestFetchImageID(c *C) {
+	id := "sha256:" + strings.Repeat("a", 64)
+
+	mc := newMockClient()
+	mc.images[id] = types.ImageInspect{ID: id, Config: &container.Config{WorkingDir: "/app"}}
+
+	d := NewDockerWithClient(mc, true, false)
+
+	fetched, err := d.Fetch(id)
+	c.Assert(err, IsNil)
+	c.Assert(fetched, Equals, id)
+	c.Assert(d.Config().WorkDir, Equals, "/app")
+
+	_, err = d.Fetch(strings.Repeat("b", 64))
+	c.Assert(err, ErrorMatches, ".*does not exist locally.*")
+}
+
+func (ds *dockerSuite) TestRebase(c *C) {
+	mc := newMockClient()
+	mc.images["base"] = types.ImageInspect{ID: "base", RootFS: types.RootFS{Layers: []string{"1"}}}
+	mc.images["final"] = types.ImageInspect{
+		ID:     "final",
+		Parent: "step",
+		RootFS: types.RootFS{Layers: []string{"1", "2", "3"}},
+		Config: &container.Config{Image: "step", Labels: map[string]string{"app": "box"}, Cmd: []string{"serve"}},
+	}
+
+	d := NewDockerWithClient(mc, true, false)
+	d.Config().Image = "final"
+
+	layers, parent, err := d.ImageLayers("final")
+	c.Assert(err, IsNil)
+	c.Assert(layers, Equals, 3)
+	c.Assert(parent, Equals, "step")
+
+	hooked := ""
+	err = d.Rebase("base", func(id string) (string, error) {
+		hooked = id
+		return "", nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(hooked, Equals, "container")
+	c.Assert(mc.created.Image, Equals, "base")
+	c.Assert(mc.removed, Equals, 1)
+
+	// the configuration of the image rebased is kept in full.
+	c.Assert(mc.commits, HasLen, 1)
+	c.Assert(mc.commits[0].Config.Image, Equals, "base")
+	c.Assert(mc.commits[0].Config.Labels, DeepEquals, map[string]string{"app": "box"})
+	c.Assert([]string(mc.commits[0].Config.Cmd), DeepEquals, []string{"serve"})
+	c.Assert(d.ImageID(), Equals, "committed")
+}
+
+func (ds *dockerSuite) TestImport(c *C) {
+	mc := newMockClient()
+	d := NewDockerWithClient(mc, true, false)
+	d.Config().WorkDir = "/app"
+
+	id, err := d.Import(strings.NewReader("rootfs"), "box:copy 1")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "sha256:imported1")
+	c.Assert(mc.images[id].Comment, Equals, "box:copy 1")
+	// imported images carry no configuration.
+	c.Assert(d.Config().WorkDir, Equals, "")
+	c.Assert(d.Config().OS, Equals, "linux")
+
+	// the same root filesystem is imported once.
+	d = NewDockerWithClient(mc, true, false)
+	id, err = d.Import(strings.NewReader("rootfs"), "box:copy 1")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "sha256:imported1")
+	c.Assert(mc.imported, Equals, 1)
+
+	id, err = d.Import(strings.NewReader("changed"), "box:copy 2")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "sha256:imported2")
+
+	d = NewDockerWithClient(mc, false, false)
+	id, err = d.Import(strings.NewReader("rootfs"), "box:copy 1")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "sha256:imported3")
+}
+
+func (ds *dockerSuite) TestImportedID(c *C) {
+	id, err := importedID(strings.NewReader(`{"status":"sha256:abc"}` + "\n"))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "sha256:abc")
+
+	_, err = importedID(strings.NewReader(`{"error":"archive/tar: invalid tar header"}`))
+	c.Assert(err, ErrorMatches, "archive/tar: invalid tar header")
+
+	_, err = importedID(strings.NewReader(""))
+	c.Assert(err, NotNil)
+}
+
+func (ds *dockerSuite) TestFetchWindows(c *C) {
+	id := "sha256:" + strings.Repeat("a", 64)
+
+	mc := newMockClient()
+	mc.images[id] = types.ImageInspect{ID: id, Os: "windows", Config: &container.Config{Cmd: []string{"cmd /S /C dir"}, ArgsEscaped: true}}
+
+	d := NewDockerWithClient(mc, true, false)
+
+	_, err := d.Fetch(id)
+	c.Assert(err, IsNil)
+	c.Assert(d.Config().OS, Equals, "windows")
+	c.Assert(d.Config().ArgsEscaped, Equals, true)
+
+	// windows containers are not given a terminal, even when asked for.
+	_, err = d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.Tty, Equals, false)
+	c.Assert(mc.created.ArgsEscaped, Equals, true)
+
+	err = d.Commit("key", nil)
+	c.Assert(err, IsNil)
+	c.Assert(mc.commits[len(mc.commits)-1].Config.Tty, Equals, false)
+	c.Assert(mc.commits[len(mc.commits)-1].Config.ArgsEscaped, Equals, true)
+}
+
+func (ds *dockerSuite) TestChanges(c *C) {
+	mc := newMockClient()
+	mc.images["committed"] = types.ImageInspect{ID: "committed", Config: &container.Config{User: "nobody", Env: []string{"A=1"}}}
+
+	d := NewDockerWithClient(mc, true, false)
+	d.config.Image = "base"
+
+	d.AddChanges("USER nobody", "LABEL a=b")
+	c.Assert(d.Commit("key", nil), IsNil)
+	c.Assert(mc.commits[0].Changes, DeepEquals, []string{"USER nobody", "LABEL a=b"})
+	c.Assert(d.config.User, Equals, "nobody")
+	c.Assert(d.config.Env, DeepEquals, []string{"A=1"})
+	c.Assert(d.config.Image, Equals, "committed")
+
+	// changes only apply to the next commit.
+	c.Assert(d.Commit("key2", nil), IsNil)
+	c.Assert(len(mc.commits[1].Changes), Equals, 0)
+}
+
+func (ds *dockerSuite) TestAuthor(c *C) {
+	mc := newMockClient()
+	d := NewDockerWithClient(mc, true, false)
+	d.config.Image = "base"
+
+	c.Assert(d.Commit("key", nil), IsNil)
+	c.Assert(mc.commits[0].Author, Equals, "")
+
+	d.SetAuthor("Jane Doe <jane@example.com> (git abc1234)")
+	c.Assert(d.Commit("key2", nil), IsNil)
+	c.Assert(mc.commits[1].Author, Equals, "Jane Doe <jane@example.com> (git abc1234)")
+	c.Assert(mc.commits[1].Comment, Equals, "key2")
+
+	// the container committed from has none of box's labels for docker to
+	// carry into the image.
+	c.Assert(mc.created.Labels, HasLen, 0)
+	c.Assert(mc.commits[1].Config.Labels, HasLen, 0)
+}
+
+func (ds *dockerSuite) TestImageProperties(c *C) {
+	mc := newMockClient()
+	mc.images["debian"] = types.ImageInspect{ID: "debian", Os: "linux", Architecture: "amd64", Config: &container.Config{}}
+	mc.images["app"] = types.ImageInspect{ID: "app", Os: "linux", Architecture: "arm64", Config: &container.Config{User: "app", WorkingDir: "/app"}}
+
+	d := NewDockerWithClient(mc, true, false)
+
+	props, err := d.ImageProperties("debian")
+	c.Assert(err, IsNil)
+	c.Assert(props, DeepEquals, map[string]string{"user": "root", "workdir": "/", "os": "linux", "architecture": "amd64"})
+
+	props, err = d.ImageProperties("app")
+	c.Assert(err, IsNil)
+	c.Assert(props, DeepEquals, map[string]string{"user": "app", "workdir": "/app", "os": "linux", "architecture": "arm64"})
+
+	_, err = d.ImageProperties("missing")
+	c.Assert(err, NotNil)
+}
+
+func (ds *dockerSuite) TestImageConfig(c *C) {
+	mc := newMockClient()
+	mc.images["imported"] = types.ImageInspect{ID: "imported", RootFS: types.RootFS{Layers: []string{"sha256:1"}}}
+	mc.images["app"] = types.ImageInspect{ID: "app", Config: &container.Config{Labels: map[string]string{"app": "box"}}, RootFS: types.RootFS{Layers: []string{"sha256:1", "sha256:2"}}}
+
+	d := NewDockerWithClient(mc, true, false)
+
+	cfg, layers, err := d.ImageConfig("app")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Labels, DeepEquals, map[string]string{"app": "box"})
+	c.Assert(layers, DeepEquals, []string{"sha256:1", "sha256:2"})
+
+	// images without a configuration have an empty one.
+	cfg, layers, err = d.ImageConfig("imported")
+	c.Assert(err, IsNil)
+	c.Assert(cfg, NotNil)
+	c.Assert(layers, HasLen, 1)
+
+	_, _, err = d.ImageConfig("missing")
+	c.Assert(err, NotNil)
+}
+
+func (ds *dockerSuite) TestImageSize(c *C) {
+	mc := newMockClient()
+	mc.images["debian"] = types.ImageInspect{ID: "debian", Size: 1024}
+
+	d := NewDockerWithClient(mc, true, false)
+
+	size, err := d.ImageSize("debian")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(1024))
+
+	_, err = d.ImageSize("missing")
+	c.Assert(err, NotNil)
+}
+
+func (ds *dockerSuite) TestCreate(c *C) {
+	mc := newMockClient()
+	d := NewDockerWithClient(mc, true, false)
+	d.config.Image = "base"
+
+	_, err := d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.Labels, DeepEquals, map[string]string{RoleLabel: RoleIntermediate})
+	c.Assert(mc.created.User, Equals, "root")
+
+	d.SetBuildID("build")
+	d.SetRunConfig(&config.Config{Image: "base", User: "nobody"})
+
+	_, err = d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.Labels, DeepEquals, map[string]string{RoleLabel: RoleIntermediate, BuildIDLabel: "build"})
+	c.Assert(mc.created.User, Equals, "nobody")
+
+	// the container left of the final image is told apart from the build's.
+	_, err = d.CreateFinal()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.Labels, DeepEquals, map[string]string{RoleLabel: RoleFinal, BuildIDLabel: "build"})
+	c.Assert(mc.created.User, Equals, "root")
+
+	// the run configuration is not committed.
+	d.SetRunConfig(nil)
+	_, err = d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.User, Equals, "root")
+	c.Assert(mc.name, Equals, "")
+
+	// the containers committed from are named after the build instead, as
+	// docker would copy the label into the image.
+	c.Assert(d.Commit("key", nil), IsNil)
+	c.Assert(mc.name, Matches, ContainerPrefix+"build-[0-9a-f]{8}")
+	c.Assert(mc.created.Labels, HasLen, 0)
+	c.Assert(mc.commits[0].Config.Labels, HasLen, 0)
+}
+
+func (ds *dockerSuite) TestRunConfig(c *C) {
+	mc := newMockClient()
+	d := NewDockerWithClient(mc, true, false)
+	d.config.Image = "base"
+	d.config.Env = []string{"KEEP=yes"}
+
+	d.SetRunConfig(&config.Config{Image: "base", Env: []string{"KEEP=yes", "FOO=bar"}, User: "nobody", Entrypoint: []string{"/bin/sh", "-c"}, Cmd: []string{"true"}})
+	c.Assert(d.Commit("key", d.RunHook), IsNil)
+
+	// the container committed from has the image configuration, so docker has
+	// nothing of the run configuration to carry into the image.
+	c.Assert(mc.created.Env, DeepEquals, []string{"KEEP=yes"})
+	c.Assert(mc.created.User, Equals, "root")
+	c.Assert([]string(mc.created.Entrypoint), DeepEquals, []string{"/bin/sh"})
+	c.Assert(mc.created.Cmd, HasLen, 0)
+	c.Assert(mc.started, Equals, 1)
+
+	c.Assert(mc.execs, HasLen, 1)
+	c.Assert(mc.execs[0].Env, DeepEquals, []string{"KEEP=yes", "FOO=bar"})
+	c.Assert(mc.execs[0].User, Equals, "nobody")
+	c.Assert(mc.execs[0].Cmd, DeepEquals, []string{"/bin/sh", "-c", "true"})
+
+	c.Assert(mc.commits, HasLen, 1)
+	c.Assert(mc.commits[0].Config.Env, DeepEquals, []string{"KEEP=yes"})
+	c.Assert(mc.commits[0].Config.User, Equals, "root")
+
+	// containers which are not committed are created with it.
+	_, err := d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.User, Equals, "nobody")
+	c.Assert(mc.started, Equals, 1)
+}
+
+func (ds *dockerSuite) TestRunHookOutput(c *C) {
+	mc := newMockClient()
+	mc.output = []byte("all of the output\n")
+
+	d := NewDockerWithClient(mc, true, false)
+	d.config.Image = "base"
+	d.SetRunConfig(&config.Config{Image: "base", Entrypoint: []string{"/bin/sh", "-c"}, Cmd: []string{"true"}})
+
+	// the output is written to the log before the hook returns, and the log
+	// can be closed.
+	log := new(bytes.Buffer)
+	d.SetLog(log)
+	c.Assert(d.Commit("key", d.RunHook), IsNil)
+	c.Assert(log.String(), Equals, "all of the output\n")
+}
+
+func (ds *dockerSuite) TestHealthcheck(c *C) {
+	id := "sha256:" + strings.Repeat("a", 64)
+
+	mc := newMockClient()
+	mc.images[id] = types.ImageInspect{ID: id, Config: &container.Config{Healthcheck: &container.HealthConfig{Test: []string{"CMD", "true"}}}}
+
+	d := NewDockerWithClient(mc, false, false)
+
+	_, err := d.Fetch(id)
+	c.Assert(err, IsNil)
+	c.Assert(d.Config().Healthcheck.Test, DeepEquals, []string{"CMD", "true"})
+
+	d.Config().Healthcheck = &container.HealthConfig{Test: []string{"NONE"}}
+	c.Assert(d.Commit("key", nil), IsNil)
+	c.Assert(mc.commits[0].Config.Healthcheck.Test, DeepEquals, []string{"NONE"})
+}
+
+func (ds *dockerSuite) TestImageTTY(c *C) {
+	mc := newMockClient()
+	d := NewDockerWithClient(mc, true, true)
+	d.config.Image = "base"
+
+	// the build's terminal is not recorded in the image.
+	_, err := d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.Tty, Equals, true)
+	c.Assert(d.Commit("key", nil), IsNil)
+	c.Assert(mc.commits[0].Config.Tty, Equals, false)
+
+	d.ImageTTY(true)
+	d.UseTTY(false)
+	_, err = d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.Tty, Equals, false)
+	c.Assert(d.Commit("key", nil), IsNil)
+	c.Assert(mc.commits[1].Config.Tty, Equals, true)
+}
+
+func (ds *dockerSuite) TestInput(c *C) {
+	mc := newMockClient()
+	d := NewDockerWithClient(mc, true, true)
+	d.config.Image = "base"
+
+	_, err := d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.Tty, Equals, true)
+	c.Assert(mc.created.OpenStdin, Equals, false)
+
+	// commands fed input get a stdin that closes, and no terminal.
+	d.SetInput(strings.NewReader("input"))
+	_, err = d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.Tty, Equals, false)
+	c.Assert(mc.created.OpenStdin, Equals, true)
+	c.Assert(mc.created.AttachStdin, Equals, true)
+	c.Assert(mc.created.StdinOnce, Equals, true)
+
+	d.SetInput(nil)
+	_, err = d.Create()
+	c.Assert(err, IsNil)
+	c.Assert(mc.created.Tty, Equals, true)
+	c.Assert(mc.created.StdinOnce, Equals, false)
+}
+
+func (ds *dockerSuite) TestSkipEmpty(c *C) {
+	dir, err := ioutil.TempDir("", "box-cache-index")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	hook := func(id string) (string, error) { return "", nil }
+
+	mc := newMockClient()
+	d := NewDockerWithClient(mc, true, false)
+	c.Assert(d.UseCacheDir(dir), IsNil)
+	d.SkipEmpty(true)
+	d.config.Image = "base"
+
+	c.Assert(d.Commit("key", hook), IsNil)
+	c.Assert(mc.committed, Equals, 0)
+	c.Assert(d.config.Image, Equals, "base")
+	c.Assert(d.Layers(), HasLen, 0)
+
+	cached, err := d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, true)
+	c.Assert(d.config.Image, Equals, "base")
+
+	// steps without a hook only change the configuration, and are committed.
+	c.Assert(d.Commit("config", nil), IsNil)
+	c.Assert(mc.committed, Equals, 1)
+
+	mc.changes = []types.ContainerChange{{Kind: 1, Path: "/tmp"}}
+	d.config.Image = "base"
+	c.Assert(d.Commit("other", hook), IsNil)
+	c.Assert(mc.committed, Equals, 2)
+	c.Assert(d.config.Image, Equals, "committed")
+}
+
+func (ds *dockerSuite) TestKeepOnFailure(c *C) {
+	failure := func(id string) (string, error) { return "", errors.New("failed") }
+	success := func(id string) (string, error) { return "", nil }
+
+	mc := newMockClient()
+	d := NewDockerWithClient(mc, true, false)
+	d.config.Image = "base"
+
+	c.Assert(d.Commit("key", failure), NotNil)
+	c.Assert(mc.removed, Equals, 1)
+
+	c.Assert(d.KeptContainer(), Equals, "")
+
+	d.KeepOnFailure(true)
+	c.Assert(d.Commit("key", failure), NotNil)
+	c.Assert(mc.removed, Equals, 1)
+	c.Assert(d.KeptContainer(), Equals, "container")
+	c.Assert(mc.committed, Equals, 0)
+	c.Assert(mc.killed, HasLen, 0)
+
+	// the shell the commands of a run step are executed in is stopped.
+	d.SetRunConfig(&config.Config{Image: "base", Entrypoint: []string{"/bin/sh", "-c"}, Cmd: []string{"false"}})
+	c.Assert(d.Commit("key", failure), NotNil)
+	c.Assert(mc.started, Equals, 1)
+	c.Assert(mc.killed, DeepEquals, []string{"container"})
+	c.Assert(d.KeptContainer(), Equals, "container")
+	d.SetRunConfig(nil)
+
+	// successful steps are cleaned up as usual.
+	c.Assert(d.Commit("key", success), IsNil)
+	c.Assert(mc.committed, Equals, 1)
+	c.Assert(mc.removed > 1, Equals, true)
+}
+
+func (ds *dockerSuite) TestCacheSource(c *C) {
+	mc := newMockClient()
+	mc.images["base"] = types.ImageInspect{ID: "base", RootFS: types.RootFS{Layers: []string{"a"}}, Config: &container.Config{}}
+	mc.history["base"] = []types.ImageHistory{{}}
+
+	// pulled images have no parent; only their layers and history relate them.
+	mc.images["pulled"] = types.ImageInspect{ID: "pulled", Comment: "key", RootFS: types.RootFS{Layers: []string{"a", "b"}}, Config: &container.Config{User: "nobody"}}
+	mc.history["pulled"] = []types.ImageHistory{{}, {}}
+	mc.images["unrelated"] = types.ImageInspect{ID: "unrelated", Comment: "key", RootFS: types.RootFS{Layers: []string{"z", "b"}}, Config: &container.Config{}}
+	mc.history["unrelated"] = []types.ImageHistory{{}, {}}
+
+	d := NewDockerWithClient(mc, true, false)
+	c.Assert(d.AddCacheSource("unrelated"), IsNil)
+	d.config.Image = "base"
+
+	cached, err := d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, false)
+
+	c.Assert(d.AddCacheSource("pulled"), IsNil)
+
+	cached, err = d.CheckCache("other")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, false)
+
+	cached, err = d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, true)
+	c.Assert(d.config.Image, Equals, "pulled")
+	c.Assert(d.config.User, Equals, "nobody")
+}
+
+func (ds *dockerSuite) TestLayers(c *C) {
+	mc := newMockClient()
+	mc.images["base"] = types.ImageInspect{ID: "base", Config: &container.Config{}}
+	mc.images["child"] = types.ImageInspect{ID: "child", Parent: "base", Comment: "key", Config: &container.Config{}}
+
+	d := NewDockerWithClient(mc, true, false)
+	id, err := d.Fetch("base")
+	c.Assert(err, IsNil)
+	d.config.Image = id
+	c.Assert(d.Layers(), DeepEquals, []string{})
+
+	cached, err := d.CheckCache("key")
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, true)
+	c.Assert(d.Commit("other", nil), IsNil)
+	c.Assert(d.Layers(), DeepEquals, []string{"child", "committed"})
+
+	c.Assert(d.TagImage("child", "app:cache-1"), IsNil)
+	c.Assert(mc.tags["app:cache-1"], Equals, "child")
+}
+
+func (ds *dockerSuite) TestSplitTag(c *C) {
+	for ref, parts := range map[string][2]string{
+		"app":                     {"app", "latest"},
+		"app:cache":               {"app", "cache"},
+		"registry:5000/app":       {"registry:5000/app", "latest"},
+		"registry:5000/app:cache": {"registry:5000/app", "cache"},
+	} {
+		repo, tag := SplitTag(ref)
+		c.Assert([2]string{repo, tag}, Equals, parts)
+	}
+}
+
+func (ds *dockerSuite) TestPrefixWriter(c *C) {
+	buf := new(bytes.Buffer)
+	pw := newPrefixWriter(buf, "[run 1] ")
+
+	for _, str := range []string{"one\ntw", "o\n", "\nthree"} {
+		n, err := pw.Write([]byte(str))
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(str))
+	}
+
+	c.Assert(buf.String(), Equals, "[run 1] one\n[run 1] two\n[run 1] \n[run 1] three")
+}
+
+func (ds *dockerSuite) TestOpenFileFromContainer(c *C) {
+	mc := newMockClient()
+	mc.files["/etc/manifest"] = bytes.Repeat([]byte("box"), 1024)
+
+	d := NewDockerWithClient(mc, false, false)
+
+	rc, err := d.OpenFileFromContainer("/etc/manifest")
+	c.Assert(err, IsNil)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(rc, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "box")
+	c.Assert(mc.removed, Equals, 0)
+	c.Assert(rc.Close(), IsNil)
+	c.Assert(mc.removed, Equals, 1)
+
+	content, err := d.CopyOneFileFromContainer("/etc/manifest")
+	c.Assert(err, IsNil)
+	c.Assert(content, DeepEquals, mc.files["/etc/manifest"])
+	c.Assert(mc.removed, Equals, 2)
+
+	_, err = d.OpenFileFromContainer("/nonexistent")
+	c.Assert(err, NotNil)
+	c.Assert(mc.removed, Equals, 3)
+}
+
+func (ds *dockerSuite) TestFileMode(c *C) {
+	mc := newMockClient()
+	mc.files["/usr/bin/app-1.2"] = []byte("#!/bin/sh")
+	mc.links["/usr/bin/app"] = "/usr/bin/app-1.2"
+
+	d := NewDockerWithClient(mc, false, false)
+
+	mode, err := d.FileMode("/usr/bin/app")
+	c.Assert(err, IsNil)
+	c.Assert(mode, Equals, os.FileMode(0755))
+	c.Assert(mc.removed, Equals, 1)
+
+	_, err = d.FileMode("/usr/bin/missing")
+	c.Assert(err, NotNil)
+	c.Assert(mc.removed, Equals, 2)
+}
+
+func (ds *dockerSuite) TestIsLayerPrefix(c *C) {
+	c.Assert(isLayerPrefix([]string{"a"}, []string{"a", "b"}), Equals, true)
+	c.Assert(isLayerPrefix([]string{"a"}, []string{"a"}), Equals, true)
+	c.Assert(isLayerPrefix([]string{"a"}, []string{"a", "b", "c"}), Equals, false)
+	c.Assert(isLayerPrefix([]string{"a", "b"}, []string{"a"}), Equals, false)
+	c.Assert(isLayerPrefix([]string{"a"}, []string{"b", "c"}), Equals, false)
+}
@@ -0,0 +1,48 @@
+package docker
+
+import (
+	"bytes"
+	"io"
+)
+
+// prefixWriter writes the prefix before every line written through it, so
+// output from different steps can be told apart.
+type prefixWriter struct {
+	writer  io.Writer
+	prefix  []byte
+	midLine bool
+}
+
+func newPrefixWriter(writer io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{writer: writer, prefix: []byte(prefix)}
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		if !pw.midLine {
+			if _, err := pw.writer.Write(pw.prefix); err != nil {
+				return 0, err
+			}
+			pw.midLine = true
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if _, err := pw.writer.Write(p); err != nil {
+				return 0, err
+			}
+			break
+		}
+
+		if _, err := pw.writer.Write(p[:i+1]); err != nil {
+			return 0, err
+		}
+
+		pw.midLine = false
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
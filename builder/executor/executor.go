@@ -2,7 +2,9 @@ package executor
 
 import (
 	"io"
+	"os"
 
+	"github.com/docker/engine-api/types/container"
 	"github.com/erikh/box/builder/config"
 )
 
@@ -18,6 +20,10 @@ type Executor interface {
 	// Config returns the current *Config for the executor.
 	Config() *config.Config
 
+	// HostConfig returns the host configuration used for the containers the
+	// executor creates. It never becomes part of the image.
+	HostConfig() *container.HostConfig
+
 	// ImageID returns the image identifier of the most recent layer.
 	ImageID() string
 
@@ -27,6 +33,10 @@ type Executor interface {
 	// CheckCache consults the cache to see if there are any items which fit it.
 	CheckCache(string) (bool, error)
 
+	// AddCacheSource fetches the named image and considers it a candidate for
+	// cache hits.
+	AddCacheSource(string) error
+
 	// CopyToContainer copies a tarred up series of files (passed in through the
 	// io.Reader handle) to the container where they are untarred.
 	CopyToContainer(string, string, io.Reader) error
@@ -38,29 +48,131 @@ type Executor interface {
 	// CopyOneFileFromContainer copies a file from the container and returns its content.
 	CopyOneFileFromContainer(string) ([]byte, error)
 
+	// OpenFileFromContainer opens a file in the container for streaming. The
+	// returned handle must be closed.
+	OpenFileFromContainer(string) (io.ReadCloser, error)
+
+	// FileMode returns the mode of a path in the current image, following
+	// symlinks.
+	FileMode(string) (os.FileMode, error)
+
 	// Create a container. Returns the container ID.
 	Create() (string, error)
 
+	// CreateFinal creates a container of the current image that is left once
+	// the build is done, labeled apart from the build's own containers.
+	// Returns the container ID.
+	CreateFinal() (string, error)
+
 	// Destroy a container by ID.
 	Destroy(string) error
 
 	// Tag the current layer. Takes a tag name as argument.
 	Tag(string) error
 
+	// TagImage tags the image ID (first argument) with the name (second).
+	TagImage(string, string) error
+
+	// Push pushes the named image to its registry.
+	Push(string) error
+
+	// Save writes the named images to the writer as a tar archive.
+	Save([]string, io.Writer) error
+
+	// RemoveImage removes the named image, or the tag if it is a tag. If the
+	// second argument is true, untagged parents are removed as well.
+	RemoveImage(string, bool) error
+
+	// Layers returns the images committed, or reused from cache, since the
+	// last Fetch.
+	Layers() []string
+
+	// Digest returns the repository digest for the named image, or an empty
+	// string if it has none.
+	Digest(string) (string, error)
+
+	// ImageProperties returns properties of the image ID that plans may make
+	// assertions about: its user, workdir, os and architecture.
+	ImageProperties(string) (map[string]string, error)
+
+	// ImageSize returns the size of the image ID, including its parents.
+	ImageSize(string) (int64, error)
+
+	// ImageConfig returns the configuration of the image ID as docker has it,
+	// including the settings box does not track, and the IDs of its
+	// filesystem layers, oldest first.
+	ImageConfig(string) (*container.Config, []string, error)
+
+	// ImageLayers returns the number of filesystem layers of the image ID,
+	// and the ID of its parent image, which is empty for pulled images.
+	ImageLayers(string) (int, string, error)
+
+	// Rebase commits a container of the image ID given, modified by the hook,
+	// with the complete configuration of the current image, and makes the
+	// result the current image.
+	Rebase(string, Hook) error
+
 	// Pull an image. Takes a name and returns an image ID+error.
 	Fetch(string) (string, error)
 
+	// Import creates an image from the root filesystem archive read from the
+	// reader, keyed by the second argument, and starts from it as Fetch does.
+	// Returns the image ID.
+	Import(io.Reader, string) (string, error)
+
 	// RunHook is used to manage run invocations, and is processed by the run
 	// statement.
 	RunHook(string) (string, error)
 
+	// AddChanges adds Dockerfile instructions to apply during the next commit.
+	AddChanges(...string)
+
+	// SetAuthor sets the author recorded in the images committed.
+	SetAuthor(string)
+
+	// SetBuildID sets the build ID containers are labeled with.
+	SetBuildID(string)
+
+	// SetRunConfig sets the configuration containers are created with, without
+	// altering the image configuration that is committed. nil unsets it.
+	SetRunConfig(*config.Config)
+
 	// SetStdin turns on the stdin features during run invocations. It is used to
 	// facilitate debugging.
 	SetStdin(bool)
 
+	// SetInput sets content to feed to the stdin of run invocations. nil unsets
+	// it.
+	SetInput(io.Reader)
+
+	// SetLog copies the output of run invocations to the writer. nil unsets it.
+	SetLog(io.Writer)
+
 	// UseCache determines if the cache should be considered or not.
 	UseCache(bool)
 
+	// UseCacheDir keeps a cache index in the provided directory to speed up
+	// cache lookups.
+	UseCacheDir(string) error
+
+	// ImageTTY determines whether the images committed ask for a TTY.
+	ImageTTY(bool)
+
+	// FailOnStderr determines whether commands that write to stderr fail.
+	FailOnStderr(bool)
+
+	// SkipEmpty determines whether steps that leave the container's
+	// filesystem unchanged are committed.
+	SkipEmpty(bool)
+
+	// KeepOnFailure determines whether the container of a failed step is kept
+	// for inspection instead of being removed.
+	KeepOnFailure(bool)
+
+	// KeptContainer returns the ID of the container kept by the last failed
+	// step, if any.
+	KeptContainer() string
+
 	// UseTTY determines whether or not to allow docker to use a TTY for both run and pull operations.
 	UseTTY(bool)
 }
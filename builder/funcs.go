@@ -13,7 +13,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	mruby "github.com/mitchellh/go-mruby"
 )
@@ -27,13 +29,35 @@ type funcFunc func(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value,
 
 // mrubyJumpTable is the dispatch instructions sent to the mruby interpreter at builder setup.
 var funcJumpTable = map[string]funcDefinition{
-	"import": {importFunc, mruby.ArgsReq(1)},
-	"getenv": {getenv, mruby.ArgsReq(1)},
-	"getuid": {getuid, mruby.ArgsReq(1)},
-	"getgid": {getgid, mruby.ArgsReq(1)},
-	"read":   {read, mruby.ArgsReq(1)},
+	"import":      {importFunc, mruby.ArgsReq(1)},
+	"getenv":      {getenv, mruby.ArgsReq(1)},
+	"getuid":      {getuid, mruby.ArgsReq(1)},
+	"getgid":      {getgid, mruby.ArgsReq(1)},
+	"read":        {read, mruby.ArgsReq(1)},
+	"target":      {target, mruby.ArgsNone()},
+	"only_in":     {onlyIn, mruby.ArgsAny() | mruby.ArgsBlock()},
+	"argv":        {argv, mruby.ArgsNone()},
+	"arg":         {arg, mruby.ArgsReq(1) | mruby.ArgsOpt(1)},
+	"set":         {set, mruby.ArgsReq(2)},
+	"get":         {get, mruby.ArgsReq(1) | mruby.ArgsOpt(1)},
+	"retry":       {retry, mruby.ArgsReq(1) | mruby.ArgsBlock()},
+	"sleep":       {sleep, mruby.ArgsReq(1)},
+	"assert_base": {assertBase, mruby.ArgsReq(1)},
+	"wait_for":    {waitFor, mruby.ArgsAny()},
+	"box_version": {boxVersion, mruby.ArgsAny()},
 }
 
+// retryDelay is the wait before the second attempt of a retry block. It
+// doubles with each attempt after.
+var retryDelay = time.Second
+
+// waitForTimeout and waitForInterval are the defaults for wait_for: how long
+// to keep trying the command, and how long to wait between attempts.
+var (
+	waitForTimeout  = 30 * time.Second
+	waitForInterval = time.Second
+)
+
 // importFunc implements the import function.
 //
 // import loads a new ruby file at the point of the function call. it is
@@ -45,7 +69,16 @@ func importFunc(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mr
 		return nil, createException(m, err.Error())
 	}
 
-	content, err := ioutil.ReadFile(args[0].String())
+	// in safe mode, files are imported from the build context, as copy does.
+	path := args[0].String()
+	if b.safe {
+		var err error
+		if path, err = b.safePath(path); err != nil {
+			return nil, createException(m, err.Error())
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, createException(m, err.Error())
 	}
@@ -68,6 +101,10 @@ func getenv(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.
 		return nil, createException(m, err.Error())
 	}
 
+	if b.safe {
+		return nil, createException(m, "getenv is not allowed in safe mode; pass the value with --arg and read it with arg")
+	}
+
 	return mruby.String(os.Getenv(args[0].String())), nil
 }
 
@@ -78,6 +115,10 @@ func read(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Va
 		return nil, createException(m, err.Error())
 	}
 
+	if b.lint != nil {
+		return mruby.String(""), nil
+	}
+
 	content, err := b.exec.CopyOneFileFromContainer(args[0].String())
 	if err != nil {
 		return nil, createException(m, err.Error())
@@ -93,44 +134,457 @@ func getuid(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.
 		return nil, createException(m, err.Error())
 	}
 
-	content, err := b.exec.CopyOneFileFromContainer("/etc/passwd")
+	if b.lint != nil {
+		return mruby.String(""), nil
+	}
+
+	fields, err := lookupEntry(b, "/etc/passwd", args[0].String())
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return mruby.String(fields[2]), nil
+}
+
+func getgid(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	args := m.GetArgs()
+
+	if err := standardCheck(b, args, 1); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	if b.lint != nil {
+		return mruby.String(""), nil
+	}
+
+	fields, err := lookupEntry(b, "/etc/group", args[0].String())
 	if err != nil {
 		return nil, createException(m, err.Error())
 	}
 
-	user := args[0].String()
+	return mruby.String(fields[2]), nil
+}
+
+// target returns the build target provided with --target, or an empty string.
+func target(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	return mruby.String(b.target), nil
+}
+
+// argv returns an array of the positional arguments provided after the build
+// file (and --) on the command line.
+func argv(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	arr, err := m.LoadString("[]")
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
 
-	entries := strings.Split(string(content), "\n")
-	for _, ent := range entries {
-		parts := strings.Split(ent, ":")
-		if parts[0] == user {
-			return mruby.String(parts[2]), nil
+	for _, arg := range b.argv {
+		if _, err := arr.Call("push", mruby.String(arg)); err != nil {
+			return nil, createException(m, err.Error())
 		}
 	}
 
-	return nil, createException(m, fmt.Sprintf("Could not find user %q", user))
+	return arr, nil
 }
 
-func getgid(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+// arg returns the value of the named build argument given with --arg, or the
+// default if it was not given. Without a default, an argument that was not
+// given is an error. When linting, the default or an empty string is returned.
+func arg(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 	args := m.GetArgs()
 
-	if err := standardCheck(b, args, 1); err != nil {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, createException(m, "arg requires a name and, optionally, a default")
+	}
+
+	name := args[0].String()
+
+	if value, ok := b.buildArgs[name]; ok {
+		return mruby.String(value), nil
+	}
+
+	if len(args) == 2 {
+		return args[1], nil
+	}
+
+	if b.lint != nil {
+		return mruby.String(""), nil
+	}
+
+	return nil, createException(m, fmt.Sprintf("Build argument %q is not set and has no default; provide it with --arg %s=<value>", name, name))
+}
+
+// set records a named value of the plan, returned later by get. Values are
+// stored as strings.
+func set(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	args := m.GetArgs()
+
+	if len(args) != 2 {
+		return nil, createException(m, "set requires a name and a value")
+	}
+
+	if b.vars == nil {
+		b.vars = map[string]string{}
+	}
+
+	b.vars[args[0].String()] = args[1].String()
+
+	return args[1], nil
+}
+
+// get returns the value recorded by set under the name, or the default if
+// nothing was. Without a default, an unset name is an error. When linting, the
+// default or an empty string is returned.
+func get(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	args := m.GetArgs()
+
+	if len(args) < 1 || len(args) > 2 {
+		return nil, createException(m, "get requires a name and, optionally, a default")
+	}
+
+	name := args[0].String()
+
+	if value, ok := b.vars[name]; ok {
+		return mruby.String(value), nil
+	}
+
+	if len(args) == 2 {
+		return args[1], nil
+	}
+
+	if b.lint != nil {
+		return mruby.String(""), nil
+	}
+
+	return nil, createException(m, fmt.Sprintf("%q was never set", name))
+}
+
+// onlyIn yields the block only when the build target matches one of the
+// provided names. Otherwise the block is skipped entirely. When linting, the
+// block is always yielded.
+func onlyIn(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	args := m.GetArgs()
+
+	if len(args) < 2 || args[len(args)-1].Type() != mruby.TypeProc {
+		return nil, createException(m, "only_in requires at least one target name and a block")
+	}
+
+	for _, name := range extractStringArgs(args) {
+		if name == b.target || b.lint != nil {
+			val, err := m.Yield(args[len(args)-1])
+			if err != nil {
+				return nil, createException(m, fmt.Sprintf("Could not yield: %v", err))
+			}
+
+			return val, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// retry yields the block up to the provided number of times, until it does not
+// raise an error. Before each new attempt, the image and its configuration are
+// reset to where they were before the block, so only a successful attempt
+// contributes to the build.
+func retry(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	args := m.GetArgs()
+
+	if len(args) != 2 || args[0].Type() != mruby.TypeFixnum || args[1].Type() != mruby.TypeProc {
+		return nil, createException(m, "retry requires a number of attempts and a block")
+	}
+
+	attempts := args[0].Fixnum()
+	if attempts < 1 {
+		return nil, createException(m, fmt.Sprintf("retry requires at least one attempt, not %d", attempts))
+	}
+
+	// the block's steps are recorded once when linting.
+	if b.lint != nil {
+		val, err := m.Yield(args[1])
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Could not yield: %v", err))
+		}
+
+		return val, nil
+	}
+
+	stepFailed := b.stepFailed
+	config := *b.exec.Config()
+	hostConfig := *b.exec.HostConfig()
+	delay := retryDelay
+
+	for i := 1; ; i++ {
+		val, err := m.Yield(args[1])
+		if err == nil {
+			b.stepFailed = stepFailed
+			return val, nil
+		}
+
+		if i == attempts {
+			return nil, createException(m, fmt.Sprintf("Failed after %d attempts: %v", attempts, err))
+		}
+
+		fmt.Printf("!!! Attempt %d of %d failed: %v; retrying in %v\n", i, attempts, err, delay)
+
+		*b.exec.Config() = config
+		*b.exec.HostConfig() = hostConfig
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// sleep pauses the build for the provided number of seconds.
+func sleep(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	args := m.GetArgs()
+
+	if err := checkArgs(args, 1); err != nil {
 		return nil, createException(m, err.Error())
 	}
 
-	content, err := b.exec.CopyOneFileFromContainer("/etc/group")
+	d, err := extractSeconds(args[0])
 	if err != nil {
 		return nil, createException(m, err.Error())
 	}
 
-	group := args[0].String()
-	entries := strings.Split(string(content), "\n")
-	for _, ent := range entries {
-		parts := strings.Split(ent, ":")
-		if parts[0] == group {
-			return mruby.String(parts[2]), nil
+	if b.lint == nil {
+		time.Sleep(d)
+	}
+
+	return nil, nil
+}
+
+// waitFor runs the command in a new container from the current image until it
+// succeeds, or the timeout passes. Nothing is committed. A hash following the
+// command may set the timeout and the interval between attempts, in seconds.
+func waitFor(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	args := m.GetArgs()
+
+	if len(args) == 0 || len(args) > 2 || args[0].Type() != mruby.TypeString {
+		return nil, createException(m, "wait_for requires a command and, optionally, a hash of options")
+	}
+
+	command := args[0].String()
+	timeout, interval := waitForTimeout, waitForInterval
+
+	if len(args) == 2 {
+		if args[1].Type() != mruby.TypeHash {
+			return nil, createException(m, fmt.Sprintf("Options for wait_for must be a hash, not %q", args[1].String()))
+		}
+
+		err := iterateRubyHash(args[1], func(key, value *mruby.MrbValue) error {
+			d, err := extractSeconds(value)
+			if err != nil {
+				return fmt.Errorf("%s for wait_for: %v", key.String(), err)
+			}
+
+			switch key.String() {
+			case "timeout":
+				timeout = d
+			case "interval":
+				interval = d
+			default:
+				return fmt.Errorf("Invalid option %q for wait_for", key.String())
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, createException(m, err.Error())
+		}
+	}
+
+	if b.lint != nil {
+		return nil, nil
+	}
+
+	if err := checkImage(b); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	runConfig := *b.exec.Config()
+	runConfig.Entrypoint = []string{"/bin/sh", "-c"}
+	runConfig.Cmd = []string{command}
+	runConfig.Env = b.withProxy(runConfig.Env)
+
+	b.exec.SetRunConfig(&runConfig)
+	defer b.exec.SetRunConfig(nil)
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := waitForAttempt(b)
+		if err == nil {
+			return nil, nil
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			b.stepFailed = true
+			return nil, createException(m, fmt.Sprintf("Timed out after %v waiting for %q: %v", timeout, command, err))
+		}
+
+		fmt.Printf("+++ Waiting for %q: %v; trying again in %v\n", command, err, interval)
+		time.Sleep(interval)
+	}
+}
+
+// waitForAttempt runs the run configuration once in a container that is
+// removed afterwards.
+func waitForAttempt(b *Builder) error {
+	id, err := b.exec.Create()
+	if err != nil {
+		return err
+	}
+	defer b.exec.Destroy(id)
+
+	_, err = b.exec.RunHook(id)
+	return err
+}
+
+// assertBase fails the build if the image given to the last from does not
+// have the properties in the provided hash, such as its user or os.
+func assertBase(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	args := m.GetArgs()
+
+	if len(args) != 1 || args[0].Type() != mruby.TypeHash {
+		return nil, createException(m, "assert_base requires a hash of expected properties")
+	}
+
+	if b.lint != nil {
+		return nil, nil
+	}
+
+	if b.base == "" {
+		return nil, createException(m, "assert_base must be called after from")
+	}
+
+	props, err := b.exec.ImageProperties(b.base)
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	mismatch := false
+
+	err = iterateRubyHash(args[0], func(key, value *mruby.MrbValue) error {
+		actual, ok := props[key.String()]
+		if !ok {
+			return fmt.Errorf("Invalid property %q for assert_base", key.String())
+		}
+
+		if actual != value.String() {
+			mismatch = true
+			return fmt.Errorf("Base image %s is %q, expected %q", key.String(), actual, value.String())
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		// a base image that does not match fails the build like a failed step,
+		// rather than a mistake in the plan.
+		b.stepFailed = mismatch
+		return nil, createException(m, err.Error())
+	}
+
+	return nil, nil
+}
+
+// versionOperators are the comparisons box_version accepts, longest first so
+// they are matched before their prefixes.
+var versionOperators = []string{">=", "<=", "!=", ">", "<", "="}
+
+// boxVersion fails the build unless the running box satisfies every
+// constraint given, such as ">= 0.5". A constraint without an operator is a
+// minimum.
+func boxVersion(b *Builder, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	constraints := extractStringArgs(m.GetArgs())
+	if len(constraints) == 0 {
+		return nil, createException(m, "box_version requires a version constraint, such as \">= 0.5\"")
+	}
+
+	for _, constraint := range constraints {
+		op, want := ">=", strings.TrimSpace(constraint)
+		for _, candidate := range versionOperators {
+			if strings.HasPrefix(want, candidate) {
+				op, want = candidate, strings.TrimSpace(strings.TrimPrefix(want, candidate))
+				break
+			}
+		}
+
+		wanted, err := parseVersion(want)
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Invalid box_version constraint %q: %v", constraint, err))
+		}
+
+		// lint, and programs embedding box without a version, check nothing.
+		if b.version == "" {
+			continue
+		}
+
+		running, err := parseVersion(b.version)
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Cannot compare the version of box, %q: %v", b.version, err))
+		}
+
+		cmp := compareVersions(running, wanted)
+		ok := map[string]bool{
+			">=": cmp >= 0,
+			"<=": cmp <= 0,
+			"!=": cmp != 0,
+			">":  cmp > 0,
+			"<":  cmp < 0,
+			"=":  cmp == 0,
+		}[op]
+
+		if !ok {
+			return nil, createException(m, fmt.Sprintf("This plan requires box %s %s, but this is box %s", op, want, b.version))
+		}
+	}
+
+	return nil, nil
+}
+
+// parseVersion returns the numeric parts of a version such as 0.5.1. A
+// suffix following - or +, such as -dev, is ignored.
+func parseVersion(version string) ([]int, error) {
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+
+	parts := []int{}
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not a version, such as 0.5", version)
+		}
+
+		parts = append(parts, n)
+	}
+
+	return parts, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as, or
+// newer than b. Missing parts count as 0, so 0.5 and 0.5.0 are the same.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		x, y := 0, 0
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
 		}
 	}
 
-	return nil, createException(m, fmt.Sprintf("Could not find group %q", group))
+	return 0
 }
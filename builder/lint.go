@@ -0,0 +1,205 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	mruby "github.com/mitchellh/go-mruby"
+)
+
+// installPattern matches run commands that are likely to install dependencies.
+var installPattern = regexp.MustCompile(`\b((apt-get|apt|yum|dnf|zypper|gem|composer) +install|apk +add|npm +(install|ci)|yarn +install|pip3? +install|bundle +install|go +mod +download)\b`)
+
+// LintIssue is a likely problem in a plan reported by Lint.
+type LintIssue struct {
+	// Step is the 1-indexed verb call the issue was found at, or 0 if the issue
+	// concerns the plan as a whole.
+	Step    int
+	Verb    string
+	Message string
+}
+
+func (li LintIssue) String() string {
+	if li.Step == 0 {
+		return li.Message
+	}
+
+	return fmt.Sprintf("step %d (%s): %s", li.Step, li.Verb, li.Message)
+}
+
+// lintStep is a verb call recorded while linting.
+type lintStep struct {
+	verb    string
+	args    []string
+	omitted bool
+}
+
+// linter records the verbs called by a plan in place of executing them.
+type linter struct {
+	steps   []lintStep
+	omitted map[string]bool
+	image   string
+}
+
+// Lint evaluates the script without building it and returns the likely
+// problems found within it. Verbs record their arguments instead of executing,
+// and all blocks are evaluated, including only_in blocks for every target.
+// Returned errors are problems evaluating the plan, such as syntax errors.
+func Lint(script string, omitFuncs []string) ([]LintIssue, error) {
+	l := &linter{omitted: map[string]bool{}}
+	for _, name := range omitFuncs {
+		l.omitted[name] = true
+	}
+
+	b := &Builder{
+		mrb:  mruby.NewMrb(),
+		lint: l,
+	}
+	defer b.Close()
+
+	for name, def := range verbJumpTable {
+		b.addVerb(name, def)
+	}
+
+	for name, def := range funcJumpTable {
+		if l.omitted[name] {
+			omitted := name
+			fn := func(m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+				l.steps = append(l.steps, lintStep{verb: omitted, omitted: true})
+				return nil, nil
+			}
+
+			b.mrb.TopSelf().SingletonClass().DefineMethod(name, fn, def.argSpec)
+			continue
+		}
+
+		b.addFunc(name, def)
+	}
+
+	if _, err := b.Run(script); err != nil {
+		return nil, err
+	}
+
+	return l.issues(), nil
+}
+
+// record records the verb call and evaluates its block, if any.
+func (l *linter) record(name string, args []*mruby.MrbValue, m *mruby.Mrb) (mruby.Value, mruby.Value) {
+	step := lintStep{verb: name, args: extractStringArgs(args), omitted: l.omitted[name]}
+
+	var block *mruby.MrbValue
+	blockArgs := []mruby.Value{}
+
+	for _, arg := range args {
+		if arg.Type() == mruby.TypeProc {
+			block = arg
+		} else {
+			blockArgs = append(blockArgs, arg)
+		}
+	}
+
+	l.steps = append(l.steps, step)
+
+	if name == "from" && len(step.args) > 0 {
+		l.image = step.args[0]
+	}
+
+	if block != nil {
+		val, err := m.Yield(block, blockArgs...)
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Could not yield: %v", err))
+		}
+
+		return val, nil
+	}
+
+	return nil, nil
+}
+
+// issues inspects the recorded steps for likely problems.
+func (l *linter) issues() []LintIssue {
+	issues := []LintIssue{}
+
+	// the first directory copied, and its step
+	copyDir, copyStep := "", 0
+	// the step of a cmd call in shell form, and of the entrypoint call, if
+	// still in effect
+	shellCmd, entrypointStep := 0, 0
+	shellEntrypoint := false
+	seenFrom := false
+	// the first copy into the current image, and its step
+	appCopy, appCopyStep := "", 0
+
+	for i, step := range l.steps {
+		issue := func(format string, args ...interface{}) {
+			issues = append(issues, LintIssue{Step: i + 1, Verb: step.verb, Message: fmt.Sprintf(format, args...)})
+		}
+
+		if step.omitted {
+			issue("%s is omitted and will fail the build", step.verb)
+			continue
+		}
+
+		if step.verb == "from" || step.verb == "from_layer" {
+			seenFrom = true
+		} else if !seenFrom {
+			issue("called before from")
+		}
+
+		switch step.verb {
+		case "from", "from_layer":
+			shellCmd, entrypointStep, shellEntrypoint = 0, 0, false
+			appCopy, appCopyStep = "", 0
+		case "copy":
+			if len(step.args) > 0 && copyDir == "" {
+				if fi, err := os.Stat(step.args[0]); err == nil && fi.IsDir() {
+					copyDir, copyStep = step.args[0], i+1
+				}
+			}
+
+			if len(step.args) > 0 && appCopy == "" {
+				appCopy, appCopyStep = step.args[0], i+1
+			}
+		case "copy_deps":
+			if appCopy != "" {
+				issue("%q is copied at step %d before these dependencies; any change to it will rerun this step and the ones after. Use copy_deps before copy", appCopy, appCopyStep)
+			}
+		case "run", "script":
+			if copyDir != "" && installPattern.MatchString(strings.Join(step.args, " ")) {
+				issue("directory %q is copied at step %d before installing dependencies; any change to it will rerun this step. Copy only the files needed to install them first", copyDir, copyStep)
+			}
+		case "entrypoint":
+			// entrypoint clears cmd
+			shellCmd, entrypointStep = 0, i+1
+			shellEntrypoint = isShellForm(step.args)
+		case "cmd":
+			shellCmd = 0
+			if isShellForm(step.args) {
+				shellCmd = i + 1
+			}
+		}
+	}
+
+	if shellCmd != 0 && entrypointStep != 0 {
+		message := fmt.Sprintf("cmd is a single string containing spaces, and is passed to the entrypoint (step %d) as one argument, not split as a shell would. Pass each argument separately, or use shell: true", entrypointStep)
+		if shellEntrypoint {
+			message = fmt.Sprintf("cmd and entrypoint (step %d) are both a single string containing spaces; each is passed as one argument, not split as a shell would. Pass each argument separately, or use shell: true", entrypointStep)
+		}
+
+		issues = append(issues, LintIssue{Step: shellCmd, Verb: "cmd", Message: message})
+	}
+
+	if !seenFrom {
+		issues = append(issues, LintIssue{Message: "from is never called"})
+	}
+
+	return issues
+}
+
+// isShellForm returns true if the arguments look like a command line meant
+// for a shell: a single string carrying several words.
+func isShellForm(args []string) bool {
+	return len(args) == 1 && strings.ContainsAny(strings.TrimSpace(args[0]), " \t")
+}
@@ -0,0 +1,57 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// lockfile records the digest each image named in from resolved to, so later
+// builds use exactly the same images.
+type lockfile struct {
+	path   string
+	Images map[string]string `json:"images"`
+}
+
+// loadLockfile loads the lockfile at the provided path. A missing lockfile
+// yields an empty one, which is written on the first Set.
+func loadLockfile(path string) (*lockfile, error) {
+	lf := &lockfile{path: path, Images: map[string]string{}}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lf, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, lf); err != nil {
+		return nil, fmt.Errorf("Could not parse lockfile %q: %v", path, err)
+	}
+
+	if lf.Images == nil {
+		lf.Images = map[string]string{}
+	}
+
+	return lf, nil
+}
+
+// Get returns the digest the image name was pinned to, if any.
+func (lf *lockfile) Get(name string) (string, bool) {
+	digest, ok := lf.Images[name]
+	return digest, ok
+}
+
+// Set pins the image name to the digest and saves the lockfile.
+func (lf *lockfile) Set(name, digest string) error {
+	lf.Images[name] = digest
+
+	content, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(lf.path, append(content, '\n'), 0644)
+}
@@ -0,0 +1,123 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/engine-api/types/container"
+)
+
+// unsafeRuby removes what an interpreter built with more gems than box's
+// could use to reach the host directly, such as files, sockets and
+// subprocesses, so plans can only do so through the verbs and functions.
+// box's own build of mruby has none of them; this guards against one that
+// does.
+const unsafeRuby = `
+[:File, :FileTest, :IO, :Dir, :Socket, :BasicSocket, :IPSocket, :TCPSocket, :TCPServer,
+ :UDPSocket, :UNIXSocket, :UNIXServer, :Addrinfo, :Process, :Signal].each do |name|
+  Object.send(:remove_const, name) if Object.const_defined?(name)
+end
+
+[:` + "`" + `, :system, :exec, :spawn, :fork, :open, :require, :require_relative, :load,
+ :eval, :exit, :exit!, :abort, :trap, :syscall].each do |name|
+  Kernel.send(:undef_method, name) if Kernel.method_defined?(name)
+  Kernel.singleton_class.send(:undef_method, name) if Kernel.respond_to?(name)
+end
+`
+
+// SetSafe restricts what the plan can do on the host, for building plans that
+// are not trusted: files on the host are only read from within the build
+// context, or the current directory if there is none, getenv is not
+// available, and host_config cannot give the build containers privileges or
+// the host's network. It must be called before Run.
+func (b *Builder) SetSafe(safe bool) error {
+	b.safe = safe
+
+	if !safe {
+		return nil
+	}
+
+	if _, err := b.mrb.LoadString(unsafeRuby); err != nil {
+		return fmt.Errorf("Could not restrict the interpreter: %v", err)
+	}
+
+	return nil
+}
+
+// safePath returns where the path given to a verb is found on the host, as
+// contextPath does. In safe mode, paths that lead outside of the build
+// context, including through symlinks, are an error.
+func (b *Builder) safePath(path string) (string, error) {
+	path, err := b.contextPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	if err := b.checkSafe(path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// checkSafe returns an error in safe mode if the path on the host leads
+// outside of the build context, or the current directory without one,
+// including through symlinks.
+func (b *Builder) checkSafe(path string) error {
+	if !b.safe {
+		return nil
+	}
+
+	root := b.copyOpts.Root
+	if root == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+
+		root = wd
+	}
+
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	// files that do not exist are left for the verb to report.
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	} else if resolved, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		abs = filepath.Join(resolved, filepath.Base(abs))
+	}
+
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of the build context, which safe mode does not allow", path)
+	}
+
+	return nil
+}
+
+// safeHostConfig returns an error if the host configuration gives the build
+// containers more than safe mode allows.
+func safeHostConfig(hc *container.HostConfig) error {
+	switch {
+	case hc.Privileged:
+		return fmt.Errorf("host_config cannot make containers privileged in safe mode")
+	case hc.NetworkMode == "host" || strings.HasPrefix(string(hc.NetworkMode), "container:"):
+		return fmt.Errorf("host_config cannot use network_mode %q in safe mode", hc.NetworkMode)
+	case len(hc.CapAdd) > 0:
+		return fmt.Errorf("host_config cannot add capabilities in safe mode")
+	case len(hc.SecurityOpt) > 0:
+		return fmt.Errorf("host_config cannot set security options in safe mode")
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/erikh/box/log"
+)
+
+// pipeToShellPattern matches commands that pipe a download into a shell.
+var pipeToShellPattern = regexp.MustCompile(`\b(curl|wget)\b[^|;&]*\|\s*(sudo\s+)?(\S*/)?(ba|da|k|z)?sh\b`)
+
+// imageIDPattern matches image IDs given without their algorithm.
+var imageIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// StrictMode is how the policy checks enabled with SetStrict are enforced.
+type StrictMode int
+
+const (
+	// StrictOff runs no policy checks.
+	StrictOff StrictMode = iota
+	// StrictWarn reports violations and builds on.
+	StrictWarn
+	// StrictFail fails the build at the first violation.
+	StrictFail
+)
+
+// stepViolation returns the violation of the policy by the verb call, or an
+// empty string.
+func stepViolation(verb string, args []string) string {
+	switch verb {
+	case "from":
+		if len(args) > 0 && isLatest(args[0]) {
+			return fmt.Sprintf("image %q is not pinned to a tag other than latest", args[0])
+		}
+	case "run", "script":
+		for _, arg := range args {
+			if pipeToShellPattern.MatchString(arg) {
+				return "a download is piped into a shell; download it, verify it, and run it as separate steps"
+			}
+		}
+	}
+
+	return ""
+}
+
+// imageViolation returns the violation of the policy by the configuration of
+// the image built, or an empty string.
+func imageViolation(user string) string {
+	name := strings.SplitN(user, ":", 2)[0]
+	if name == "root" || name == "0" {
+		return "the image runs as root; set another user with user"
+	}
+
+	return ""
+}
+
+// isLatest returns true if the image name has the latest tag, or no tag at
+// all. Digests and image IDs are pinned.
+func isLatest(name string) bool {
+	if strings.Contains(name, "@") || strings.HasPrefix(name, "sha256:") || imageIDPattern.MatchString(name) {
+		return false
+	}
+
+	// a colon before the last slash separates a registry port.
+	i := strings.LastIndex(name, ":")
+	if i == -1 || i < strings.LastIndex(name, "/") {
+		return true
+	}
+
+	return name[i+1:] == "latest"
+}
+
+// violate enforces the policy of strict mode on a violation found at the step,
+// or in the image built if step is 0: the violation is reported, and with
+// StrictFail, returned as an error.
+func (b *Builder) violate(step int, verb, message string) error {
+	if message == "" || b.strict == StrictOff {
+		return nil
+	}
+
+	if b.strict == StrictFail {
+		return fmt.Errorf("strict: %s", message)
+	}
+
+	log.Violation(step, verb, message)
+	return nil
+}
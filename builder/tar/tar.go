@@ -9,94 +9,404 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/erikh/box/log"
 )
 
+// Options control how Archive archives files.
+type Options struct {
+	// Strict makes entries that cannot be read an error, instead of skipping
+	// them with a warning.
+	Strict bool
+
+	// Normalize makes the archive depend only on the names, contents and
+	// permissions of the files, so archiving the same files on another machine
+	// gives the same result. Ownership is reset to root, and modification times
+	// later than ModTime are set to it.
+	Normalize bool
+	ModTime   time.Time
+
+	// Chown sets the owner of every entry to Uid and Gid, in place of the
+	// owner of the file archived, such as the CI user that built it.
+	Chown bool
+	Uid   int
+	Gid   int
+
+	// TempDir is the directory the archive is written to; os.TempDir() if
+	// empty.
+	TempDir string
+
+	// Root is the directory the source given to Archive is relative to; the
+	// current directory if empty. The names of the entries are not affected.
+	Root string
+}
+
 // Archive takes a source and target directory and returns a filename and/or
 // error. The source will be archived relative to the target. The file will
-// live in the user's os.TempDir().
-func Archive(rel, target string) (string, error) {
-	fi, err := os.Lstat(rel)
+// live in opts.TempDir, and is for the caller to remove; if
+// archiving fails, it is removed before returning.
+//
+// Entries are archived in lexical order. Symlinks are archived as symlinks and
+// are never followed.
+func Archive(rel, target string, opts Options) (string, error) {
+	source := rel
+	if opts.Root != "" && !filepath.IsAbs(rel) {
+		source = filepath.Join(opts.Root, rel)
+	}
+
+	fi, err := os.Lstat(source)
 	if err != nil {
 		return "", err
 	}
 
-	f, err := ioutil.TempFile("", "box-copy.")
+	f, err := ioutil.TempFile(opts.TempDir, "box-copy.")
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
 
 	tw := tar.NewWriter(f)
 
+	skip := func(path string, err error) error {
+		if opts.Strict {
+			return err
+		}
+
+		log.CopySkip(path, err)
+		return nil
+	}
+
 	if fi.IsDir() {
-		err := filepath.Walk(rel, func(path string, fi os.FileInfo, err error) error {
+		err := filepath.Walk(source, func(path string, fi os.FileInfo, err error) error {
+			// entries are named as if source were rel.
+			name, relErr := filepath.Rel(source, path)
+			if relErr != nil {
+				return relErr
+			}
+			name = filepath.Join(rel, name)
+
 			if err != nil {
-				return err
+				if err := skip(path, err); err != nil {
+					return err
+				}
+
+				// the directory itself was archived, but not its contents.
+				if fi != nil && fi.IsDir() {
+					return filepath.SkipDir
+				}
+
+				return nil
 			}
 
-			log.CopyPath(path, filepath.Join(target, path))
+			log.CopyPath(name, filepath.Join(target, name))
+
+			return writeEntry(tw, path, filepath.Join(target, name), fi, opts, skip)
+		})
+		if err != nil {
+			return discard(f, err)
+		}
+	} else if err := writeEntry(tw, source, target, fi, opts, skip); err != nil {
+		return discard(f, err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return discard(f, err)
+	}
+
+	return f.Name(), nil
+}
+
+// discard closes and removes the partly written archive f after a failure,
+// and returns the error.
+func discard(f *os.File, err error) (string, error) {
+	f.Close()
+	os.Remove(f.Name())
+	return "", err
+}
+
+// writeEntry writes the file at path to the archive under name. Problems
+// reading the file are passed to skip, which decides whether they are fatal.
+func writeEntry(tw *tar.Writer, path, name string, fi os.FileInfo, opts Options, skip func(string, error) error) error {
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return skip(path, err)
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return skip(path, err)
+	}
+
+	header.Name = name
+
+	if opts.Normalize {
+		normalize(header, opts.ModTime)
+	}
+
+	if opts.Chown {
+		header.Uid, header.Gid = opts.Uid, opts.Gid
+		header.Uname, header.Gname = "", ""
+	}
+
+	var p *os.File
+
+	// regular files are opened before the header is written, so an
+	// unreadable file can be left out entirely.
+	if header.Typeflag == tar.TypeReg {
+		if p, err = os.Open(path); err != nil {
+			return skip(path, err)
+		}
+		defer p.Close()
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if p != nil {
+		if _, err := io.Copy(tw, p); err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalize resets the parts of the header that differ between machines
+// archiving the same files.
+func normalize(header *tar.Header, modTime time.Time) {
+	header.Uid, header.Gid = 0, 0
+	header.Uname, header.Gname = "", ""
+	header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+
+	if header.ModTime.After(modTime) {
+		header.ModTime = modTime
+	}
+	header.ModTime = header.ModTime.Truncate(time.Second)
+}
+
+// Directories returns the filename of an archive holding an empty directory
+// for each of the provided paths, with the given mode and ownership. The file
+// lives in dir, or os.TempDir() if dir is empty, as with ioutil.TempFile.
+func Directories(dir string, paths []string, mode int64, uid, gid int) (string, error) {
+	f, err := ioutil.TempFile(dir, "box-mkdir.")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	for _, path := range paths {
+		header := &tar.Header{
+			Name:     filepath.Clean(path) + "/",
+			Mode:     mode | 040000,
+			Uid:      uid,
+			Gid:      gid,
+			Typeflag: tar.TypeDir,
+			ModTime:  time.Now(),
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return discard(f, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return discard(f, err)
+	}
+
+	return f.Name(), nil
+}
+
+// File is a regular file and its header, read by ReadFiles or written by
+// Files.
+type File struct {
+	Header  *tar.Header
+	Content []byte
+}
+
+// ReadFiles reads the archive from r, and returns the regular files in it with
+// the provided names. Names not found, or not regular files, are absent from
+// the result.
+func ReadFiles(r io.Reader, names ...string) (map[string]*File, error) {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	files := map[string]*File{}
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !wanted[header.Name] || header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		files[header.Name] = &File{Header: header, Content: content}
+	}
+}
+
+// Files returns the filename of an archive holding the provided files in
+// order. Each header is written with the size of the file's content. Like
+// Directories, the file lives in dir.
+func Files(dir string, files []*File) (string, error) {
+	f, err := ioutil.TempFile(dir, "box-files.")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	for _, file := range files {
+		header := *file.Header
+		header.Typeflag = tar.TypeReg
+		header.Size = int64(len(file.Content))
+
+		if err := tw.WriteHeader(&header); err != nil {
+			return discard(f, err)
+		}
+
+		if _, err := tw.Write(file.Content); err != nil {
+			return discard(f, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return discard(f, err)
+	}
+
+	return f.Name(), nil
+}
+
+// Extract unpacks the archive read from r into dir, which must exist.
+// Directories, regular files, symlinks and hard links are extracted; other
+// entries are skipped. Entries that would be written outside of dir, directly
+// or through a symlink extracted before them, are an error.
+func Extract(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		path, err := extractPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
 
-			header, err := tar.FileInfoHeader(fi, filepath.Join(target, path))
+		mode := os.FileMode(header.Mode) & os.ModePerm
+
+		// a later entry replaces an earlier one, and is never written through
+		// a symlink left by it.
+		if header.Typeflag != tar.TypeDir {
+			if fi, err := os.Lstat(path); err == nil && !fi.IsDir() {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 			if err != nil {
 				return err
 			}
 
-			header.Linkname = filepath.Join(target, path)
-			header.Name = filepath.Join(target, path)
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
 
-			if err := tw.WriteHeader(header); err != nil {
+			if err := os.Symlink(header.Linkname, path); err != nil {
 				return err
 			}
 
-			p, err := os.Open(path)
+			continue
+		case tar.TypeLink:
+			target, err := extractPath(dir, header.Linkname)
 			if err != nil {
 				return err
 			}
 
-			if header.Typeflag == tar.TypeReg {
-				_, err = io.Copy(tw, p)
-				if err != nil && err != io.EOF {
-					p.Close()
-					return err
-				}
-
-				p.Close()
+			if err := os.Link(target, path); err != nil {
+				return err
 			}
-			return nil
-		})
-		if err != nil {
-			return "", err
+		default:
+			continue
 		}
-	} else if !fi.IsDir() {
-		header, err := tar.FileInfoHeader(fi, target)
-		if err != nil {
-			return "", err
+
+		if err := os.Chtimes(path, header.ModTime, header.ModTime); err != nil {
+			return err
 		}
+	}
+}
 
-		header.Name = target
-		header.Linkname = target
+// extractPath returns where the entry name is extracted to in dir. Names
+// leaving dir, or passing through a symlink, are refused.
+func extractPath(dir, name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is outside of the archive's root", name)
+	}
 
-		if err := tw.WriteHeader(header); err != nil {
-			return "", err
+	parent := dir
+	parts := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+	for _, part := range parts {
+		if part == "." {
+			continue
 		}
 
-		p, err := os.Open(rel)
-		if err != nil {
-			return "", err
+		parent = filepath.Join(parent, part)
+		if fi, err := os.Lstat(parent); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%q is beneath the symlink %q", name, part)
 		}
-		_, err = io.Copy(tw, p)
-		if err != nil && err != io.EOF {
-			p.Close()
-			return "", err
-		}
-		p.Close()
 	}
 
-	tw.Close()
-	f.Close()
-
-	return f.Name(), nil
+	return filepath.Join(dir, rel), nil
 }
 
 // SumFile reads a file an returns a hex-encoded sha512/256.
@@ -117,3 +427,172 @@ func SumFile(fn string) (string, error) {
 
 	return cacheKey, nil
 }
+
+// describe returns a string that is equal for regular files with the same
+// content, permissions and ownership.
+func describe(header *tar.Header, r io.Reader) (string, error) {
+	hash := sha512.New512_256()
+	if _, err := io.Copy(hash, r); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return fmt.Sprintf("%o %d %d %s", header.Mode&07777, header.Uid, header.Gid, hex.EncodeToString(hash.Sum(nil))), nil
+}
+
+// Sums reads a tar stream, such as one copied out of a container, and
+// describes each regular file within it. The descriptions are keyed by the
+// file's path under dir, and are meant to be passed to Dedup.
+func Sums(r io.Reader, dir string) (map[string]string, error) {
+	sums := map[string]string{}
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return sums, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		desc, err := describe(header, tr)
+		if err != nil {
+			return nil, err
+		}
+
+		sums[filepath.Join(dir, header.Name)] = desc
+	}
+}
+
+// Dedup rewrites the archive in fn, leaving out the regular files whose
+// description matches the one for their path in existing. The name of the new
+// archive, which lives in the same directory as fn, and the number of files
+// left out are returned.
+func Dedup(fn string, existing map[string]string) (string, int, error) {
+	// the first pass finds the entries to leave out, so the second can copy
+	// the rest without reading any content twice.
+	skip := map[int]bool{}
+
+	err := readArchive(fn, func(i int, header *tar.Header, tr *tar.Reader) error {
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			return nil
+		}
+
+		want, ok := existing[filepath.Join("/", header.Name)]
+		if !ok {
+			return nil
+		}
+
+		desc, err := describe(header, tr)
+		if err != nil {
+			return err
+		}
+
+		skip[i] = desc == want
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fn), "box-copy.")
+	if err != nil {
+		return "", 0, err
+	}
+
+	tw := tar.NewWriter(f)
+	skipped := 0
+
+	err = readArchive(fn, func(i int, header *tar.Header, tr *tar.Reader) error {
+		if skip[i] {
+			skipped++
+			return nil
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		_, err := io.Copy(tw, tr)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+
+	f.Close()
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+
+	return f.Name(), skipped, nil
+}
+
+// Removed returns the paths, under /, of the entries of the archive in before
+// that the archive in after does not have, in order. Paths within a removed
+// directory are left out.
+func Removed(before, after string) ([]string, error) {
+	kept := map[string]bool{}
+
+	err := readArchive(after, func(i int, header *tar.Header, tr *tar.Reader) error {
+		kept[filepath.Join("/", header.Name)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+
+	err = readArchive(before, func(i int, header *tar.Header, tr *tar.Reader) error {
+		name := filepath.Join("/", header.Name)
+		if kept[name] {
+			return nil
+		}
+
+		if len(removed) > 0 && strings.HasPrefix(name, removed[len(removed)-1]+"/") {
+			return nil
+		}
+
+		removed = append(removed, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// readArchive calls fn with each entry in the archive, in order.
+func readArchive(fn string, entryFn func(int, *tar.Header, *tar.Reader) error) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+
+	for i := 0; ; i++ {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := entryFn(i, header, tr); err != nil {
+			return err
+		}
+	}
+}
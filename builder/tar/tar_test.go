@@ -0,0 +1,403 @@
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type tarSuite struct{}
+
+var _ = Suite(&tarSuite{})
+
+func TestTar(t *T) {
+	TestingT(t)
+}
+
+type entry struct {
+	name    string
+	content string
+	mode    int64
+}
+
+func writeArchive(c *C, w io.Writer, entries []entry) {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		c.Assert(tw.WriteHeader(&tar.Header{Name: e.name, Mode: e.mode, Size: int64(len(e.content)), Typeflag: tar.TypeReg}), IsNil)
+		_, err := tw.Write([]byte(e.content))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+}
+
+func (ts *tarSuite) TestDedup(c *C) {
+	// as copied out of a container from /app
+	parent := new(bytes.Buffer)
+	writeArchive(c, parent, []entry{
+		{"app/same", "same", 0644},
+		{"app/changed", "old", 0644},
+		{"app/chmod", "chmod", 0644},
+	})
+
+	sums, err := Sums(parent, "/")
+	c.Assert(err, IsNil)
+	c.Assert(len(sums), Equals, 3)
+
+	f, err := ioutil.TempFile("", "box-tar-test.")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	writeArchive(c, f, []entry{
+		{"/app/same", "same", 0644},
+		{"/app/changed", "new", 0644},
+		{"/app/chmod", "chmod", 0755},
+		{"/app/new", "new", 0644},
+	})
+	f.Close()
+
+	fn, skipped, err := Dedup(f.Name(), sums)
+	c.Assert(err, IsNil)
+	defer os.Remove(fn)
+	c.Assert(skipped, Equals, 1)
+
+	kept := map[string]string{}
+	err = readArchive(fn, func(i int, header *tar.Header, tr *tar.Reader) error {
+		content, err := ioutil.ReadAll(tr)
+		kept[header.Name] = string(content)
+		return err
+	})
+	c.Assert(err, IsNil)
+	c.Assert(kept, DeepEquals, map[string]string{"/app/changed": "new", "/app/chmod": "chmod", "/app/new": "new"})
+}
+
+func (ts *tarSuite) TestRemoved(c *C) {
+	archives := []string{}
+	for _, entries := range [][]entry{
+		{{"app", "", 0755}, {"app/kept", "", 0644}, {"app/removed", "", 0644}, {"app/cache", "", 0755}, {"app/cache/a", "", 0644}, {"etc/removed", "", 0644}},
+		{{"app", "", 0755}, {"app/kept", "changed", 0644}, {"app/new", "", 0644}},
+	} {
+		f, err := ioutil.TempFile("", "box-tar-test.")
+		c.Assert(err, IsNil)
+		defer os.Remove(f.Name())
+		writeArchive(c, f, entries)
+		f.Close()
+
+		archives = append(archives, f.Name())
+	}
+
+	removed, err := Removed(archives[0], archives[1])
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{"/app/removed", "/app/cache", "/etc/removed"})
+}
+
+func (ts *tarSuite) TestDirectories(c *C) {
+	fn, err := Directories("", []string{"/var/log/app", "/srv/"}, 0750, 1000, 1001)
+	c.Assert(err, IsNil)
+	defer os.Remove(fn)
+
+	headers := []*tar.Header{}
+	err = readArchive(fn, func(i int, header *tar.Header, tr *tar.Reader) error {
+		headers = append(headers, header)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(len(headers), Equals, 2)
+
+	for i, name := range []string{"/var/log/app/", "/srv/"} {
+		c.Assert(headers[i].Name, Equals, name)
+		c.Assert(headers[i].Typeflag, Equals, byte(tar.TypeDir))
+		c.Assert(headers[i].FileInfo().Mode().Perm(), Equals, os.FileMode(0750))
+		c.Assert(headers[i].Uid, Equals, 1000)
+		c.Assert(headers[i].Gid, Equals, 1001)
+	}
+}
+
+func (ts *tarSuite) TestFiles(c *C) {
+	buf := bytes.NewBuffer(nil)
+	writeArchive(c, buf, []entry{
+		{name: "etc/hostname", content: "box", mode: 0644},
+		{name: "etc/passwd", content: "root:x:0:0:root:/root:/bin/sh\n", mode: 0644},
+		{name: "etc/shadow", content: "root:*::0:99999:7:::\n", mode: 0640},
+	})
+
+	files, err := ReadFiles(buf, "etc/passwd", "etc/shadow", "etc/group")
+	c.Assert(err, IsNil)
+	c.Assert(len(files), Equals, 2)
+	c.Assert(files["etc/group"], IsNil)
+	c.Assert(string(files["etc/passwd"].Content), Equals, "root:x:0:0:root:/root:/bin/sh\n")
+
+	files["etc/shadow"].Content = append(files["etc/shadow"].Content, "app:!::0:99999:7:::\n"...)
+
+	fn, err := Files("", []*File{files["etc/passwd"], files["etc/shadow"]})
+	c.Assert(err, IsNil)
+	defer os.Remove(fn)
+
+	f, err := os.Open(fn)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	written, err := ReadFiles(f, "etc/passwd", "etc/shadow")
+	c.Assert(err, IsNil)
+	c.Assert(len(written), Equals, 2)
+	c.Assert(string(written["etc/shadow"].Content), Equals, "root:*::0:99999:7:::\napp:!::0:99999:7:::\n")
+	c.Assert(written["etc/shadow"].Header.FileInfo().Mode().Perm(), Equals, os.FileMode(0640))
+}
+
+func (ts *tarSuite) TestArchiveSkip(c *C) {
+	dir, err := ioutil.TempDir("", "box-tar-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	c.Assert(os.Chdir(dir), IsNil)
+	defer os.Chdir(wd)
+
+	c.Assert(os.MkdirAll("src/sub", 0755), IsNil)
+	c.Assert(ioutil.WriteFile("src/file", []byte("file"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile("src/secret", []byte("secret"), 0000), IsNil)
+	// a cycle, which must not be followed.
+	c.Assert(os.Symlink("..", "src/sub/parent"), IsNil)
+
+	// root can read the file regardless of its permissions.
+	unreadable := true
+	if f, err := os.Open("src/secret"); err == nil {
+		f.Close()
+		unreadable = false
+	}
+
+	fn, err := Archive("src", "/", Options{})
+	c.Assert(err, IsNil)
+	defer os.Remove(fn)
+
+	links := map[string]string{}
+	err = readArchive(fn, func(i int, header *tar.Header, tr *tar.Reader) error {
+		links[header.Name] = header.Linkname
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	expected := map[string]string{"/src": "", "/src/file": "", "/src/sub": "", "/src/sub/parent": ".."}
+	if !unreadable {
+		expected["/src/secret"] = ""
+	}
+	c.Assert(links, DeepEquals, expected)
+
+	if unreadable {
+		fn, err = Archive("src", "/", Options{Strict: true})
+		os.Remove(fn)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (ts *tarSuite) TestArchiveNormalize(c *C) {
+	wd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	defer os.Chdir(wd)
+
+	epoch := time.Unix(1500000000, 0)
+	sums := []string{}
+
+	for i, mtime := range []time.Time{time.Now(), time.Now().Add(time.Hour)} {
+		dir, err := ioutil.TempDir("", "box-tar-test.")
+		c.Assert(err, IsNil)
+		defer os.RemoveAll(dir)
+		c.Assert(os.Chdir(dir), IsNil)
+
+		c.Assert(os.MkdirAll("src/sub", 0755), IsNil)
+		c.Assert(ioutil.WriteFile("src/sub/file", []byte("file"), 0644), IsNil)
+		c.Assert(ioutil.WriteFile("src/old", []byte("old"), 0644), IsNil)
+		c.Assert(os.Chtimes("src/old", epoch.Add(-time.Hour), epoch.Add(-time.Hour)), IsNil)
+		for _, path := range []string{"src/sub/file", "src/sub", "src"} {
+			c.Assert(os.Chtimes(path, mtime, mtime), IsNil)
+		}
+
+		fn, err := Archive("src", "/", Options{Normalize: true, ModTime: epoch})
+		c.Assert(err, IsNil)
+		defer os.Remove(fn)
+
+		sum, err := SumFile(fn)
+		c.Assert(err, IsNil)
+		sums = append(sums, sum)
+
+		if i == 0 {
+			times := map[string]int64{}
+			err = readArchive(fn, func(i int, header *tar.Header, tr *tar.Reader) error {
+				c.Assert(header.Uid, Equals, 0)
+				c.Assert(header.Gid, Equals, 0)
+				times[header.Name] = header.ModTime.Unix()
+				return nil
+			})
+			c.Assert(err, IsNil)
+			c.Assert(times["/src/sub/file"], Equals, epoch.Unix())
+			// earlier times are kept.
+			c.Assert(times["/src/old"], Equals, epoch.Add(-time.Hour).Unix())
+		}
+	}
+
+	c.Assert(sums[0], Equals, sums[1])
+}
+
+func (ts *tarSuite) TestArchiveChown(c *C) {
+	dir, err := ioutil.TempDir("", "box-tar-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(os.MkdirAll(filepath.Join(dir, "src/sub"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "src/sub/file"), []byte("file"), 0644), IsNil)
+
+	// the owner given applies with Normalize as well, which resets it to root.
+	for _, opts := range []Options{
+		{Root: dir, Chown: true, Uid: 1000, Gid: 1001},
+		{Root: dir, Chown: true, Uid: 1000, Gid: 1001, Normalize: true},
+	} {
+		fn, err := Archive("src", "/", opts)
+		c.Assert(err, IsNil)
+		defer os.Remove(fn)
+
+		names := []string{}
+		err = readArchive(fn, func(i int, header *tar.Header, tr *tar.Reader) error {
+			names = append(names, header.Name)
+			c.Assert(header.Uid, Equals, 1000)
+			c.Assert(header.Gid, Equals, 1001)
+			c.Assert(header.Uname, Equals, "")
+			return nil
+		})
+		c.Assert(err, IsNil)
+		c.Assert(names, HasLen, 3)
+	}
+}
+
+func (ts *tarSuite) TestTempDir(c *C) {
+	dir, err := ioutil.TempDir("", "box-tar-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	c.Assert(ioutil.WriteFile(src, []byte("src"), 0644), IsNil)
+
+	scratch := filepath.Join(dir, "scratch")
+	c.Assert(os.Mkdir(scratch, 0755), IsNil)
+
+	fn, err := Archive(src, "/src", Options{TempDir: scratch})
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Dir(fn), Equals, scratch)
+
+	dedupFn, _, err := Dedup(fn, map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Dir(dedupFn), Equals, scratch)
+
+	fn, err = Directories(scratch, []string{"/srv"}, 0755, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Dir(fn), Equals, scratch)
+
+	fn, err = Files(scratch, []*File{})
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Dir(fn), Equals, scratch)
+}
+
+func (ts *tarSuite) TestArchiveRoot(c *C) {
+	dir, err := ioutil.TempDir("", "box-tar-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(os.MkdirAll(filepath.Join(dir, "src", "sub"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "src", "sub", "file"), []byte("file"), 0644), IsNil)
+
+	fn, err := Archive("src", "/dest", Options{Root: dir})
+	c.Assert(err, IsNil)
+	defer os.Remove(fn)
+
+	f, err := os.Open(fn)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	names := []string{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, header.Name)
+	}
+
+	c.Assert(names, DeepEquals, []string{"/dest/src", "/dest/src/sub", "/dest/src/sub/file"})
+}
+
+func (ts *tarSuite) TestExtract(c *C) {
+	dir, err := ioutil.TempDir("", "box-tar-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	archive := func(headers ...*tar.Header) io.Reader {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		for _, header := range headers {
+			c.Assert(tw.WriteHeader(header), IsNil)
+			if header.Typeflag == tar.TypeReg {
+				_, err := tw.Write([]byte(header.Name))
+				c.Assert(err, IsNil)
+			}
+		}
+		c.Assert(tw.Close(), IsNil)
+		return buf
+	}
+
+	reg := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0640, Size: int64(len(name)), ModTime: time.Unix(1500000000, 0)}
+	}
+
+	err = Extract(archive(
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		reg("dir/file"),
+		reg("nested/file"),
+		&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir/file"},
+		&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+	), dir)
+	c.Assert(err, IsNil)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "dir", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "dir/file")
+
+	fi, err := os.Stat(filepath.Join(dir, "nested", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0640))
+	c.Assert(fi.ModTime().Unix(), Equals, int64(1500000000))
+
+	target, err := os.Readlink(filepath.Join(dir, "link"))
+	c.Assert(err, IsNil)
+	c.Assert(target, Equals, "dir/file")
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "hard"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "dir/file")
+
+	outside, err := ioutil.TempDir("", "box-tar-test.")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(outside)
+
+	for _, headers := range [][]*tar.Header{
+		{reg("../escape")},
+		{reg("/escape")},
+		{&tar.Header{Name: "out", Typeflag: tar.TypeSymlink, Linkname: outside}, reg("out/escape")},
+		{&tar.Header{Name: "hardout", Typeflag: tar.TypeLink, Linkname: "../escape"}},
+	} {
+		c.Assert(Extract(archive(headers...), dir), NotNil)
+	}
+
+	// a symlink is replaced rather than written through.
+	c.Assert(os.Symlink(filepath.Join(outside, "file"), filepath.Join(dir, "replaced")), IsNil)
+	c.Assert(Extract(archive(reg("replaced")), dir), IsNil)
+
+	_, err = os.Stat(filepath.Join(outside, "file"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
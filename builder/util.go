@@ -3,7 +3,12 @@ package builder
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/docker/go-units"
 	mruby "github.com/mitchellh/go-mruby"
 )
 
@@ -16,6 +21,9 @@ func createException(m *mruby.Mrb, msg string) mruby.Value {
 	return val
 }
 
+// extractStringArgs returns the string form of each argument, skipping any
+// block. Verbs should use this rather than iterating their arguments, so a
+// block is never mistaken for an argument.
 func extractStringArgs(args []*mruby.MrbValue) []string {
 	strArgs := []string{}
 
@@ -28,6 +36,86 @@ func extractStringArgs(args []*mruby.MrbValue) []string {
 	return strArgs
 }
 
+// setEnv returns a copy of the KEY=VALUE environment with the variable set. A
+// key that is already set keeps its place with the new value; otherwise the
+// variable is appended.
+func setEnv(env []string, key, value string) []string {
+	entry := fmt.Sprintf("%s=%s", key, value)
+	result := make([]string, 0, len(env)+1)
+	found := false
+
+	for _, existing := range env {
+		if strings.SplitN(existing, "=", 2)[0] == key {
+			if found {
+				continue
+			}
+
+			existing, found = entry, true
+		}
+
+		result = append(result, existing)
+	}
+
+	if !found {
+		result = append(result, entry)
+	}
+
+	return result
+}
+
+// ReadKeyValueFile reads the KEY=VALUE lines of a file, such as the env_file
+// given to run, box.env or a --label-file, as pairs of the key and the value. Blank lines and lines starting with # are ignored, and values are
+// taken as written, without unquoting.
+func ReadKeyValueFile(path string) ([][]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := [][]string{}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("%s, line %d: %q must be KEY=VALUE", path, i+1, line)
+		}
+
+		pairs = append(pairs, []string{strings.TrimSpace(parts[0]), parts[1]})
+	}
+
+	return pairs, nil
+}
+
+// hasBlock returns true if a block was passed with the arguments.
+func hasBlock(args []*mruby.MrbValue) bool {
+	return len(args) > 0 && args[len(args)-1].Type() == mruby.TypeProc
+}
+
+// extractSeconds converts a number of seconds, which may be fractional, to a
+// duration.
+func extractSeconds(value *mruby.MrbValue) (time.Duration, error) {
+	var seconds float64
+
+	switch value.Type() {
+	case mruby.TypeFixnum:
+		seconds = float64(value.Fixnum())
+	case mruby.TypeFloat:
+		seconds = value.Float()
+	default:
+		return 0, fmt.Errorf("Value %q is not a number of seconds", value.String())
+	}
+
+	if seconds < 0 {
+		return 0, fmt.Errorf("Seconds must not be negative, not %v", seconds)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
 func iterateRubyHash(arg *mruby.MrbValue, fn func(*mruby.MrbValue, *mruby.MrbValue) error) error {
 	hash := arg.Hash()
 
@@ -57,6 +145,43 @@ func iterateRubyHash(arg *mruby.MrbValue, fn func(*mruby.MrbValue, *mruby.MrbVal
 	return nil
 }
 
+func extractStringArray(value *mruby.MrbValue) ([]string, error) {
+	if value.Type() != mruby.TypeArray {
+		return nil, fmt.Errorf("Value %q is not array, must be array", value.String())
+	}
+
+	strArgs := []string{}
+	a := value.Array()
+
+	for i := 0; i < a.Len(); i++ {
+		val, err := a.Get(i)
+		if err != nil {
+			return nil, err
+		}
+		strArgs = append(strArgs, val.String())
+	}
+
+	return strArgs, nil
+}
+
+// extractBytes accepts either an integer or a human-readable size such as
+// "512m" and returns the number of bytes.
+func extractBytes(value *mruby.MrbValue) (int64, error) {
+	if value.Type() == mruby.TypeFixnum {
+		return int64(value.Fixnum()), nil
+	}
+
+	return units.RAMInBytes(value.String())
+}
+
+// planException returns the exception a verb raises for an error in the plan,
+// such as invalid arguments, which classify reports as such rather than as a
+// failed step.
+func (b *Builder) planException(m *mruby.Mrb, msg string) mruby.Value {
+	b.planError = true
+	return createException(m, msg)
+}
+
 func checkArgs(args []*mruby.MrbValue, l int) error {
 	if len(args) != l {
 		return fmt.Errorf("Expected %d arg, got %d", l, len(args))
@@ -80,3 +205,98 @@ func standardCheck(b *Builder, args []*mruby.MrbValue, l int) error {
 
 	return checkImage(b)
 }
+
+// globQuote quotes a path for the shell, leaving glob characters (*, ?, and
+// brackets) unquoted so they are still expanded.
+func globQuote(path string) string {
+	quoted := ""
+	literal := ""
+
+	flush := func() {
+		if literal != "" {
+			quoted += "'" + strings.Replace(literal, "'", `'\''`, -1) + "'"
+			literal = ""
+		}
+	}
+
+	for _, r := range path {
+		if strings.ContainsRune("*?[]", r) {
+			flush()
+			quoted += string(r)
+		} else {
+			literal += string(r)
+		}
+	}
+
+	flush()
+
+	return quoted
+}
+
+// lookupEntry finds the named entry in a passwd-style file (such as
+// /etc/passwd or /etc/group) in the image, returning its fields.
+func lookupEntry(b *Builder, file, name string) ([]string, error) {
+	content, err := b.exec.CopyOneFileFromContainer(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ent := range strings.Split(string(content), "\n") {
+		fields := strings.Split(ent, ":")
+		if fields[0] == name && len(fields) > 3 {
+			return fields, nil
+		}
+	}
+
+	kind := "user"
+	if file == "/etc/group" {
+		kind = "group"
+	}
+
+	return nil, fmt.Errorf("Could not find %s %q", kind, name)
+}
+
+// lookupOwner resolves an owner given as "user" or "user:group" to a uid and
+// gid, using the image's /etc/passwd and /etc/group for names that are not
+// numeric. Without a group, the user's primary group is used, or a gid equal
+// to the uid if the user is numeric.
+func lookupOwner(b *Builder, owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+
+	uid, err := strconv.Atoi(parts[0])
+	gid := uid
+
+	if err != nil {
+		fields, err := lookupEntry(b, "/etc/passwd", parts[0])
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if uid, err = strconv.Atoi(fields[2]); err != nil {
+			return 0, 0, fmt.Errorf("Invalid uid %q for user %q", fields[2], parts[0])
+		}
+
+		if gid, err = strconv.Atoi(fields[3]); err != nil {
+			return 0, 0, fmt.Errorf("Invalid gid %q for user %q", fields[3], parts[0])
+		}
+	}
+
+	if len(parts) == 1 {
+		return uid, gid, nil
+	}
+
+	if gid, err = strconv.Atoi(parts[1]); err == nil {
+		return uid, gid, nil
+	}
+
+	fields, err := lookupEntry(b, "/etc/group", parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if gid, err = strconv.Atoi(fields[2]); err != nil {
+		return 0, 0, fmt.Errorf("Invalid gid %q for group %q", fields[2], parts[1])
+	}
+
+	return uid, gid, nil
+}
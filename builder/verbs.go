@@ -8,14 +8,18 @@ package builder
 */
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/go-units"
 	"github.com/erikh/box/builder/tar"
 	"github.com/erikh/box/log"
 	mruby "github.com/mitchellh/go-mruby"
@@ -24,30 +28,58 @@ import (
 // Definition is a jump table definition used for programming the DSL into the
 // mruby interpreter.
 type verbDefinition struct {
-	verbFunc verbFunc
+	verbFunc VerbFunc
 	argSpec  mruby.ArgSpec
+	// inputKey returns the sum of the files on the host the call reads, which
+	// is added to its cache key, and the files, for verbs whose key depends on
+	// more than their arguments.
+	inputKey func(b *Builder, verb string, args []*mruby.MrbValue) (string, []CacheInput, error)
+	// checksCache is set for verbs that are cached by the content they copy,
+	// and check the cache themselves.
+	checksCache bool
+	// alwaysRuns is set for verbs that run even when the cache has them.
+	alwaysRuns bool
+	// replacesImage is set for verbs that replace the image rather than
+	// building on it; they have no layer to size or tag.
+	replacesImage bool
 }
 
 // verbJumpTable is the dispatch instructions sent to the builder at preparation time.
 var verbJumpTable = map[string]verbDefinition{
-	"debug":      {debug, mruby.ArgsOpt(1)},
-	"flatten":    {flatten, mruby.ArgsNone()},
-	"tag":        {tag, mruby.ArgsReq(1)},
-	"copy":       {copy, mruby.ArgsReq(2)},
-	"from":       {from, mruby.ArgsReq(1)},
-	"run":        {run, mruby.ArgsAny()},
-	"user":       {user, mruby.ArgsReq(1)},
-	"with_user":  {withUser, mruby.ArgsBlock() | mruby.ArgsReq(1)},
-	"workdir":    {workdir, mruby.ArgsReq(1)},
-	"inside":     {inside, mruby.ArgsBlock() | mruby.ArgsReq(1)},
-	"env":        {env, mruby.ArgsAny()},
-	"cmd":        {cmd, mruby.ArgsAny()},
-	"entrypoint": {entrypoint, mruby.ArgsAny()},
-	"set_exec":   {setExec, mruby.ArgsReq(1)},
-}
-
-// verbFunc is a builder DSL function used to interact with docker.
-type verbFunc func(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value)
+	"debug":       {verbFunc: debug, argSpec: mruby.ArgsOpt(1), alwaysRuns: true},
+	"flatten":     {verbFunc: flatten, argSpec: mruby.ArgsNone()},
+	"tag":         {verbFunc: tag, argSpec: mruby.ArgsReq(1)},
+	"checkpoint":  {verbFunc: checkpoint, argSpec: mruby.ArgsReq(1)},
+	"copy":        {verbFunc: copy, argSpec: mruby.ArgsReq(2) | mruby.ArgsOpt(1), checksCache: true},
+	"copy_deps":   {verbFunc: copy, argSpec: mruby.ArgsReq(2) | mruby.ArgsOpt(1), checksCache: true},
+	"from":        {verbFunc: from, argSpec: mruby.ArgsReq(1), replacesImage: true},
+	"from_layer":  {verbFunc: fromLayer, argSpec: mruby.ArgsReq(1), replacesImage: true},
+	"run":         {verbFunc: run, argSpec: mruby.ArgsAny(), inputKey: (*Builder).runInputKey},
+	"script":      {verbFunc: script, argSpec: mruby.ArgsAny(), inputKey: (*Builder).runInputKey},
+	"shell":       {verbFunc: shell, argSpec: mruby.ArgsAny()},
+	"user":        {verbFunc: user, argSpec: mruby.ArgsReq(1)},
+	"with_user":   {verbFunc: withUser, argSpec: mruby.ArgsBlock() | mruby.ArgsReq(1)},
+	"workdir":     {verbFunc: workdir, argSpec: mruby.ArgsReq(1)},
+	"hostname":    {verbFunc: hostname, argSpec: mruby.ArgsReq(1) | mruby.ArgsOpt(1)},
+	"inside":      {verbFunc: inside, argSpec: mruby.ArgsBlock() | mruby.ArgsReq(1)},
+	"env":         {verbFunc: env, argSpec: mruby.ArgsAny()},
+	"cmd":         {verbFunc: cmd, argSpec: mruby.ArgsAny()},
+	"entrypoint":  {verbFunc: entrypoint, argSpec: mruby.ArgsAny()},
+	"set_exec":    {verbFunc: setExec, argSpec: mruby.ArgsReq(1)},
+	"host_config": {verbFunc: hostConfig, argSpec: mruby.ArgsReq(1)},
+	"delete":      {verbFunc: deleteFiles, argSpec: mruby.ArgsAny()},
+	"mkdir":       {verbFunc: mkdir, argSpec: mruby.ArgsAny()},
+	"useradd":     {verbFunc: useradd, argSpec: mruby.ArgsAny()},
+	"change":      {verbFunc: change, argSpec: mruby.ArgsAny()},
+	"ensure_file": {verbFunc: ensureFile, argSpec: mruby.ArgsReq(1) | mruby.ArgsOpt(1)},
+	"run_expect":  {verbFunc: runExpect, argSpec: mruby.ArgsReq(2)},
+	"healthcheck": {verbFunc: healthcheck, argSpec: mruby.ArgsAny()},
+}
+
+// VerbFunc is a builder DSL function used to interact with docker. The
+// cacheKey identifies the call in the build cache, and is passed to the
+// executor's Commit.
+type VerbFunc func(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value)
 
 func debug(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 	var shell string
@@ -81,25 +113,15 @@ func debug(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, se
 
 func setExec(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 	if err := standardCheck(b, args, 1); err != nil {
-		return nil, createException(m, err.Error())
+		return nil, b.planException(m, err.Error())
 	}
 
 	err := iterateRubyHash(args[0], func(key, value *mruby.MrbValue) error {
-		if value.Type() != mruby.TypeArray {
+		strArgs, err := extractStringArray(value)
+		if err != nil {
 			return fmt.Errorf("Value for key %q is not array, must be array", key.String())
 		}
 
-		strArgs := []string{}
-		a := value.Array()
-
-		for i := 0; i < a.Len(); i++ {
-			val, err := a.Get(i)
-			if err != nil {
-				return err
-			}
-			strArgs = append(strArgs, val.String())
-		}
-
 		switch key.String() {
 		case "entrypoint":
 			b.exec.Config().Entrypoint = strArgs
@@ -112,7 +134,7 @@ func setExec(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb,
 	})
 
 	if err != nil {
-		return nil, createException(m, err.Error())
+		return nil, b.planException(m, err.Error())
 	}
 
 	if err := b.exec.Commit(cacheKey, nil); err != nil {
@@ -124,14 +146,44 @@ func setExec(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb,
 
 func workdir(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 	if err := standardCheck(b, args, 1); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	// relative paths resolve against the current workdir, as they do in
+	// Dockerfiles.
+	dir := args[0].String()
+	if !path.IsAbs(dir) {
+		cwd := b.exec.Config().WorkDir
+		if cwd == "" {
+			cwd = "/"
+		}
+		dir = path.Join(cwd, dir)
+	}
+
+	b.exec.Config().WorkDir = dir
+
+	if err := b.exec.Commit(cacheKey, nil); err != nil {
 		return nil, createException(m, err.Error())
 	}
 
-	if !path.IsAbs(args[0].String()) {
-		return nil, createException(m, fmt.Sprintf("path %q is not absolute in workdir", args[0].String()))
+	return nil, nil
+}
+
+// hostname sets the hostname, and optionally the domain name, containers of
+// the image are given. Empty strings clear those inherited from the parent.
+func hostname(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, b.planException(m, fmt.Sprintf("Expected 1 or 2 args, got %d", len(args)))
 	}
 
-	b.exec.Config().WorkDir = args[0].String()
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	b.exec.Config().Hostname = args[0].String()
+	if len(args) > 1 {
+		b.exec.Config().Domainname = args[1].String()
+	}
 
 	if err := b.exec.Commit(cacheKey, nil); err != nil {
 		return nil, createException(m, err.Error())
@@ -142,7 +194,7 @@ func workdir(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb,
 
 func user(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 	if err := standardCheck(b, args, 1); err != nil {
-		return nil, createException(m, err.Error())
+		return nil, b.planException(m, err.Error())
 	}
 
 	b.exec.Config().User = args[0].String()
@@ -167,7 +219,7 @@ func flatten(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb,
 		return nil, createException(m, err.Error())
 	}
 
-	f, err := ioutil.TempFile("", "box-flatten.")
+	f, err := ioutil.TempFile(b.copyOpts.TempDir, "box-flatten.")
 	if err != nil {
 		return nil, createException(m, err.Error())
 	}
@@ -206,7 +258,7 @@ func flatten(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb,
 
 func tag(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 	if err := standardCheck(b, args, 1); err != nil {
-		return nil, createException(m, err.Error())
+		return nil, b.planException(m, err.Error())
 	}
 
 	name := args[0].String()
@@ -220,19 +272,57 @@ func tag(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self
 		return nil, createException(m, err.Error())
 	}
 
+	b.bases.forget(name)
 	log.Tag(name)
 
 	return nil, nil
 }
 
+// checkpointRepository is the repository checkpoint tags images in.
+const checkpointRepository = "box-checkpoint"
+
+// checkpointPattern matches the names docker accepts as a tag.
+var checkpointPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// checkpoint tags the current image as box-checkpoint:name, so another plan
+// can start from it while the steps after it are worked on.
+func checkpoint(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := standardCheck(b, args, 1); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	name := args[0].String()
+	if !checkpointPattern.MatchString(name) {
+		return nil, b.planException(m, fmt.Sprintf("Invalid checkpoint name %q; it is used as a tag, so may only hold letters, digits, _, . and -", name))
+	}
+
+	if err := b.exec.Commit(cacheKey, nil); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	ref := checkpointRepository + ":" + name
+	if err := b.exec.Tag(ref); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	b.bases.forget(ref)
+
+	fmt.Printf("+++ Checkpoint %s; start from it with: from %q\n", name, ref)
+	return nil, nil
+}
+
 func entrypoint(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 	if err := checkImage(b); err != nil {
-		return nil, createException(m, err.Error())
+		return nil, b.planException(m, err.Error())
 	}
 
-	stringArgs := extractStringArgs(args)
+	stringArgs, shellForm, err := execArgs(b, "entrypoint", args)
+	if err != nil {
+		return nil, b.planException(m, err.Error())
+	}
 
 	b.exec.Config().Entrypoint = stringArgs
+	b.exec.Config().ArgsEscaped = shellForm && b.windows()
 	// override the cmd when the entrypoint is set. this is a tough problem to
 	// solve in the right way. If cmd is set prior to this, we cannot be sure
 	// once we set the entrypoint that it is still valid, so we erase it.
@@ -247,129 +337,369 @@ func entrypoint(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mr
 
 func from(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 	if err := checkArgs(args, 1); err != nil {
-		return nil, createException(m, err.Error())
+		return nil, b.planException(m, err.Error())
 	}
 
-	id, err := b.exec.Fetch(args[0].String())
-	if err != nil {
-		return nil, createException(m, err.Error())
+	name := args[0].String()
+
+	if b.lock != nil {
+		if digest, ok := b.lock.Get(name); ok {
+			name = digest
+		}
 	}
 
-	b.exec.Config().Image = id
+	// an image resolved by another build of the session is used by its ID, so
+	// it is looked up locally; if it has been removed since, the name is
+	// resolved again.
+	base, resolved := b.bases.get(name)
+	id := ""
+	if resolved {
+		var err error
+		if id, err = b.exec.Fetch(base.id); err != nil {
+			resolved = false
+		}
+	}
 
-	return mruby.String(id), nil
-}
+	if !resolved {
+		var err error
+		if id, err = b.exec.Fetch(name); err != nil {
+			return nil, createException(m, err.Error())
+		}
 
-func run(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
-	if err := standardCheck(b, args, 1); err != nil {
-		return nil, createException(m, err.Error())
+		base = resolvedBase{id: id}
+		if b.lock != nil && name == args[0].String() {
+			if base.digest, err = b.exec.Digest(name); err != nil {
+				return nil, createException(m, err.Error())
+			}
+		}
+
+		b.bases.set(name, base)
 	}
 
-	stringArgs := extractStringArgs(args)
+	// images built locally have no digest, and are not pinned.
+	if b.lock != nil && name == args[0].String() && base.digest != "" {
+		if err := b.lock.Set(name, base.digest); err != nil {
+			return nil, createException(m, err.Error())
+		}
+	}
 
-	entrypoint := b.exec.Config().Entrypoint
-	cmd := b.exec.Config().Cmd
+	if name != args[0].String() {
+		fmt.Printf("+++ Using %s for %s\n", name, args[0].String())
+	}
 
-	b.exec.Config().Entrypoint = []string{"/bin/sh", "-c"}
-	b.exec.Config().Cmd = stringArgs
+	b.exec.Config().Image = id
+	b.base = id
 
-	defer func() {
-		b.exec.Config().Entrypoint = entrypoint
-		b.exec.Config().Cmd = cmd
-	}()
+	return mruby.String(id), nil
+}
 
-	if err := b.exec.Commit(cacheKey, b.exec.RunHook); err != nil {
+// fromLayer starts the build from a root filesystem on disk: the directory is
+// imported as the base image, in place of an image pulled by from.
+func fromLayer(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	dir, err := b.safePath(args[0].String())
+	if err != nil {
 		return nil, createException(m, err.Error())
 	}
 
-	return nil, nil
-}
+	b.inputs = append(b.inputs, dir)
 
-func withUser(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
-	if err := standardCheck(b, args, 2); err != nil {
+	fi, err := os.Stat(dir)
+	if err != nil {
 		return nil, createException(m, err.Error())
 	}
 
-	if args[1].Type() != mruby.TypeProc {
-		return nil, createException(m, fmt.Sprintf("Arg %q was not block!", args[1].String()))
+	if !fi.IsDir() {
+		return nil, b.planException(m, fmt.Sprintf("%s is not a directory", args[0].String()))
 	}
 
-	user := b.exec.Config().User
-	b.exec.Config().User = args[0].String()
+	// the directory is archived from within, so the entries and the key do
+	// not depend on where it is on the host.
+	opts := b.copyOpts
+	opts.Root = dir
 
-	val, err := m.Yield(args[1], args[0])
+	fn, err := tar.Archive(".", "/", opts)
+	defer os.Remove(fn)
 	if err != nil {
-		return nil, createException(m, fmt.Sprintf("Could not yield: %v", err))
+		return nil, createException(m, err.Error())
 	}
 
-	b.exec.Config().User = user
-
-	if err := b.exec.Commit(cacheKey, nil); err != nil {
+	key, err := tar.SumFile(fn)
+	if err != nil {
 		return nil, createException(m, err.Error())
 	}
 
-	return val, nil
-}
+	b.current.inputs = append(b.current.inputs, CacheInput{Path: dir, Sum: key})
 
-func inside(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
-	if err := standardCheck(b, args, 2); err != nil {
+	f, err := os.Open(fn)
+	if err != nil {
 		return nil, createException(m, err.Error())
 	}
+	defer f.Close()
 
-	if args[1].Type() != mruby.TypeProc {
-		return nil, createException(m, fmt.Sprintf("Arg %q was not block!", args[1].String()))
+	id, err := b.exec.Import(f, key)
+	if err != nil {
+		return nil, createException(m, err.Error())
 	}
 
-	if !path.IsAbs(args[0].String()) {
-		return nil, createException(m, fmt.Sprintf("path %q is not absolute in workdir", args[0].String()))
+	b.exec.Config().Image = id
+	b.base = id
+
+	return mruby.String(id), nil
+}
+
+// runOptions are the options run accepts as a hash following the command.
+type runOptions struct {
+	env []string
+	// envFile is a file on the host of KEY=VALUE lines added to the
+	// environment, before env.
+	envFile string
+	// stdin is a file on the host, and input a string, fed to the command.
+	stdin string
+	input *string
+	// cacheOn are globs of files on the host the command depends on; only
+	// their contents are used, in the cache key.
+	cacheOn []string
+	// entrypoint is a wrapper in the image the shell running the command is
+	// passed to.
+	entrypoint []string
+	// user runs the command as another user than the image's.
+	user string
+}
+
+// parseRunArgs separates the commands given to run, or script, from their
+// options.
+func parseRunArgs(verb string, args []*mruby.MrbValue) ([]string, *runOptions, error) {
+	opts := &runOptions{env: []string{}}
+	commands := []string{}
+
+	for _, arg := range args {
+		switch arg.Type() {
+		case mruby.TypeProc:
+		case mruby.TypeHash:
+			err := iterateRubyHash(arg, func(key, value *mruby.MrbValue) error {
+				switch key.String() {
+				case "env":
+					if value.Type() != mruby.TypeHash {
+						return fmt.Errorf("env for %s must be a hash, not %q", verb, value.String())
+					}
+
+					return iterateRubyHash(value, func(key, value *mruby.MrbValue) error {
+						opts.env = append(opts.env, fmt.Sprintf("%s=%s", key.String(), value.String()))
+						return nil
+					})
+				case "env_file":
+					if value.Type() != mruby.TypeString || value.String() == "" {
+						return fmt.Errorf("env_file for %s must be a filename, not %q", verb, value.String())
+					}
+
+					opts.envFile = value.String()
+				case "stdin":
+					if value.Type() != mruby.TypeString || value.String() == "" {
+						return fmt.Errorf("stdin for %s must be a filename, not %q", verb, value.String())
+					}
+
+					opts.stdin = value.String()
+				case "input":
+					if value.Type() != mruby.TypeString {
+						return fmt.Errorf("input for %s must be a string, not %q", verb, value.String())
+					}
+
+					input := value.String()
+					opts.input = &input
+				case "cache_on":
+					if value.Type() == mruby.TypeString {
+						opts.cacheOn = []string{value.String()}
+						return nil
+					}
+
+					globs, err := extractStringArray(value)
+					if err != nil {
+						return fmt.Errorf("cache_on for %s must be a glob or an array of globs, not %q", verb, value.String())
+					}
+
+					opts.cacheOn = globs
+				case "entrypoint":
+					if value.Type() == mruby.TypeString && value.String() != "" {
+						opts.entrypoint = []string{value.String()}
+						return nil
+					}
+
+					entrypoint, err := extractStringArray(value)
+					if err != nil || len(entrypoint) == 0 {
+						return fmt.Errorf("entrypoint for %s must be a program or an array of a program and its arguments, not %q", verb, value.String())
+					}
+
+					opts.entrypoint = entrypoint
+				case "user":
+					if value.Type() != mruby.TypeString || value.String() == "" {
+						return fmt.Errorf("user for %s must be a user name or uid, not %q", verb, value.String())
+					}
+
+					opts.user = value.String()
+				default:
+					return fmt.Errorf("Invalid option %q for %s", key.String(), verb)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return nil, nil, err
+			}
+		default:
+			commands = append(commands, arg.String())
+		}
 	}
 
-	workdir := b.exec.Config().WorkDir
-	b.exec.Config().WorkDir = args[0].String()
+	if opts.stdin != "" && opts.input != nil {
+		return nil, nil, fmt.Errorf("%s accepts only one of stdin and input", verb)
+	}
 
-	val, err := m.Yield(args[1], args[0])
+	return commands, opts, nil
+}
+
+// runInputKey returns the sums of the files a run or script command is fed
+// with the stdin option, given with the env_file option, and declared with the
+// cache_on option, so the step is rebuilt when they change, like copy, along
+// with the files and their sums. It is empty if there are no such files, or
+// the arguments are invalid; the verb reports those.
+func (b *Builder) runInputKey(verb string, args []*mruby.MrbValue) (string, []CacheInput, error) {
+	_, opts, err := parseRunArgs(verb, args)
 	if err != nil {
-		return nil, createException(m, fmt.Sprintf("Could not yield: %v", err))
+		return "", nil, nil
 	}
 
-	b.exec.Config().WorkDir = workdir
+	sums := []string{}
+	inputs := []CacheInput{}
 
-	if err := b.exec.Commit(cacheKey, nil); err != nil {
-		return nil, createException(m, err.Error())
+	for _, file := range []struct{ option, path string }{{"stdin", opts.stdin}, {"env_file", opts.envFile}} {
+		if file.path == "" {
+			continue
+		}
+
+		path, err := b.safePath(file.path)
+		if err != nil {
+			return "", nil, fmt.Errorf("Could not read %s for %s: %v", file.option, verb, err)
+		}
+
+		b.inputs = append(b.inputs, path)
+
+		sum, err := tar.SumFile(path)
+		if err != nil {
+			return "", nil, fmt.Errorf("Could not read %s for %s: %v", file.option, verb, err)
+		}
+
+		sums = append(sums, sum)
+		inputs = append(inputs, CacheInput{Path: path, Sum: sum})
 	}
 
-	return val, nil
+	for _, glob := range opts.cacheOn {
+		pattern, err := b.contextPath(glob)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid cache_on glob %q for %s: %v", glob, verb, err)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid cache_on glob %q for %s: %v", glob, verb, err)
+		}
+
+		files := 0
+		for _, match := range matches {
+			if fi, err := os.Stat(match); err != nil || fi.IsDir() {
+				continue
+			}
+
+			if err := b.checkSafe(match); err != nil {
+				return "", nil, fmt.Errorf("Could not read cache_on file %s for %s: %v", match, verb, err)
+			}
+
+			b.inputs = append(b.inputs, match)
+
+			sum, err := tar.SumFile(match)
+			if err != nil {
+				return "", nil, fmt.Errorf("Could not read cache_on file %s for %s: %v", match, verb, err)
+			}
+
+			// a file renamed or moved changes the key as well. Within a
+			// context, the name is relative to it, as the context is unpacked
+			// somewhere else each build.
+			name := match
+			if b.copyOpts.Root != "" {
+				if name, err = filepath.Rel(b.copyOpts.Root, match); err != nil {
+					return "", nil, fmt.Errorf("Could not read cache_on file %s for %s: %v", match, verb, err)
+				}
+			}
+
+			sums = append(sums, name+" "+sum)
+			inputs = append(inputs, CacheInput{Path: match, Sum: sum})
+			files++
+		}
+
+		if files == 0 {
+			return "", nil, fmt.Errorf("cache_on glob %q for %s matches no files", glob, verb)
+		}
+	}
+
+	return strings.Join(sums, ", "), inputs, nil
 }
 
-func env(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
-	if err := standardCheck(b, args, 1); err != nil {
-		return nil, createException(m, err.Error())
+func run(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
 	}
 
-	err := iterateRubyHash(args[0], func(key, value *mruby.MrbValue) error {
-		b.exec.Config().Env = append(b.exec.Config().Env, fmt.Sprintf("%s=%s", key.String(), value.String()))
-		return nil
-	})
+	commands, opts, err := parseRunArgs("run", args)
+	if err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	if len(commands) != 1 {
+		return nil, b.planException(m, fmt.Sprintf("Expected 1 arg, got %d", len(commands)))
+	}
+
+	return runCommand(b, cacheKey, b.shellCommand(), commands[0], opts, m)
+}
 
+// script runs its lines in a single shell, so shell state such as the working
+// directory and variables carries from one line to the next. It stops at the
+// first line that fails.
+func script(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	lines, opts, err := parseRunArgs("script", args)
 	if err != nil {
-		return nil, createException(m, err.Error())
+		return nil, b.planException(m, err.Error())
 	}
 
-	if err := b.exec.Commit(cacheKey, nil); err != nil {
-		return nil, createException(m, err.Error())
+	if len(lines) == 0 {
+		return nil, b.planException(m, "script requires at least one line")
 	}
 
-	return nil, nil
+	return runCommand(b, cacheKey, b.shellCommand(), "set -e\n"+strings.Join(lines, "\n"), opts, m)
 }
 
-func cmd(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+// shell sets the shell that runs the commands of run and script, and the
+// shell form of cmd and entrypoint. It is recorded in the image, as SHELL is
+// by docker, so it carries over to images built from it, and the steps after
+// it are cached apart from those run by another shell.
+func shell(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
 	if err := checkImage(b); err != nil {
-		return nil, createException(m, err.Error())
+		return nil, b.planException(m, err.Error())
 	}
 
 	stringArgs := extractStringArgs(args)
+	if len(stringArgs) == 0 || stringArgs[0] == "" {
+		return nil, b.planException(m, "shell requires the shell to run, such as \"/bin/bash\", \"-c\"")
+	}
 
-	b.exec.Config().Cmd = stringArgs
+	b.exec.Config().Shell = stringArgs
 
 	if err := b.exec.Commit(cacheKey, nil); err != nil {
 		return nil, createException(m, err.Error())
@@ -378,73 +708,940 @@ func cmd(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self
 	return nil, nil
 }
 
-func copy(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
-	if err := standardCheck(b, args, 2); err != nil {
-		return nil, createException(m, err.Error())
+// healthcheck sets the healthcheck of the image and commits. A single string
+// is run by the shell, several are run directly, and "NONE" disables the
+// healthcheck inherited from the base image.
+func healthcheck(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
 	}
 
-	source := args[0].String()
-	target := args[1].String()
+	health := &container.HealthConfig{}
+	command := []string{}
+	hasOptions := false
 
-	wd, err := os.Getwd()
-	if err != nil {
-		return nil, createException(m, err.Error())
-	}
+	for _, arg := range args {
+		if arg.Type() != mruby.TypeHash {
+			command = append(command, arg.String())
+			continue
+		}
 
-	// FIXME do not allow traversing above the wd
-	rel, err := filepath.Rel(wd, filepath.Join(wd, source))
-	if err != nil {
-		return nil, createException(m, err.Error())
-	}
+		hasOptions = true
+
+		err := iterateRubyHash(arg, func(key, value *mruby.MrbValue) error {
+			var err error
+
+			switch key.String() {
+			case "interval":
+				health.Interval, err = extractSeconds(value)
+			case "timeout":
+				health.Timeout, err = extractSeconds(value)
+			case "retries":
+				if value.Type() != mruby.TypeFixnum || value.Fixnum() < 1 {
+					return fmt.Errorf("retries must be a positive number, not %q", value.String())
+				}
+				health.Retries = value.Fixnum()
+			default:
+				return fmt.Errorf("Invalid option %q for healthcheck", key.String())
+			}
 
-	paths := filepath.SplitList(rel)
-	for _, path := range paths {
-		if path == ".." {
-			return nil, createException(m, fmt.Sprintf("Cannot use relative path %s because it may fall below the root build directory", source))
+			return err
+		})
+
+		if err != nil {
+			return nil, b.planException(m, err.Error())
 		}
 	}
 
-	target = filepath.Clean(filepath.Join(b.exec.Config().WorkDir, target))
-
-	if strings.HasSuffix(target, "/") {
-		target = filepath.Join(target, rel)
+	switch {
+	case len(command) == 0 || command[0] == "":
+		return nil, b.planException(m, "healthcheck requires a command, or \"NONE\"")
+	case len(command) == 1 && command[0] == "NONE":
+		if hasOptions {
+			return nil, b.planException(m, "healthcheck \"NONE\" takes no options")
+		}
+		health.Test = []string{"NONE"}
+	case len(command) == 1:
+		health.Test = []string{"CMD-SHELL", command[0]}
+	default:
+		health.Test = append([]string{"CMD"}, command...)
 	}
 
-	fn, err := tar.Archive(rel, target)
-	defer os.Remove(fn)
-	if err != nil {
-		return nil, createException(m, err.Error())
-	}
+	b.exec.Config().Healthcheck = health
 
-	cacheKey, err = tar.SumFile(fn)
-	if err != nil {
+	if err := b.exec.Commit(cacheKey, nil); err != nil {
 		return nil, createException(m, err.Error())
 	}
 
-	if b.useCache {
-		cached, err := b.exec.CheckCache(cacheKey)
-		if err != nil {
-			return nil, createException(m, err.Error())
-		}
+	return nil, nil
+}
 
-		if cached {
-			return nil, nil
+// shellCommand returns the shell of the image, as set with the shell verb, or
+// /bin/sh -c; cmd /S /C for Windows images, as docker uses.
+func (b *Builder) shellCommand() []string {
+	if len(b.exec.Config().Shell) == 0 {
+		if b.windows() {
+			return []string{"cmd", "/S", "/C"}
 		}
+
+		return []string{"/bin/sh", "-c"}
 	}
 
-	f, err := os.Open(fn)
-	if err != nil {
-		return nil, createException(m, err.Error())
+	return append([]string{}, b.exec.Config().Shell...)
+}
+
+// windows returns true if the base image is a Windows image.
+func (b *Builder) windows() bool {
+	return b.exec.Config().OS == "windows"
+}
+
+// execArgs returns the arguments of a cmd or entrypoint call, and whether
+// they are in the shell form. In the shell form, given the shell option, the
+// single command is run by the shell.
+func execArgs(b *Builder, verb string, args []*mruby.MrbValue) ([]string, bool, error) {
+	stringArgs := []string{}
+	shellForm := false
+
+	for _, arg := range args {
+		switch arg.Type() {
+		case mruby.TypeProc:
+		case mruby.TypeHash:
+			err := iterateRubyHash(arg, func(key, value *mruby.MrbValue) error {
+				switch key.String() {
+				case "shell":
+					shellForm = value.Type() == mruby.TypeTrue
+				default:
+					return fmt.Errorf("Invalid option %q for %s", key.String(), verb)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return nil, false, err
+			}
+		default:
+			stringArgs = append(stringArgs, arg.String())
+		}
 	}
 
-	hook := func(id string) (string, error) {
-		defer f.Close()
-		return "", b.exec.CopyToContainer(id, "/", f)
+	if !shellForm {
+		return stringArgs, false, nil
 	}
 
-	if err := b.exec.Commit(cacheKey, hook); err != nil {
-		return nil, createException(m, err.Error())
+	if len(stringArgs) != 1 {
+		return nil, false, fmt.Errorf("%s with shell: true takes 1 command, got %d", verb, len(stringArgs))
 	}
 
+	return append(b.shellCommand(), stringArgs[0]), true, nil
+}
+
+// runCommand runs the command with the shell and commits the result.
+func runCommand(b *Builder, cacheKey string, shell []string, command string, opts *runOptions, m *mruby.Mrb) (mruby.Value, mruby.Value) {
+	// the container runs the command, but the image keeps its own entrypoint,
+	// cmd and environment.
+	runConfig := *b.exec.Config()
+	runConfig.Entrypoint = shell
+	runConfig.Cmd = []string{command}
+
+	// a wrapper runs the shell in turn.
+	if len(opts.entrypoint) > 0 {
+		runConfig.Entrypoint = opts.entrypoint
+		runConfig.Cmd = append(append([]string{}, shell...), command)
+	}
+
+	if opts.user != "" {
+		runConfig.User = opts.user
+	}
+
+	// the environment given to the step is set over the proxy settings.
+	runConfig.Env = b.withProxy(runConfig.Env)
+
+	env := opts.env
+	if opts.envFile != "" {
+		path, err := b.safePath(opts.envFile)
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Could not read env_file: %v", err))
+		}
+
+		pairs, err := ReadKeyValueFile(path)
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Could not read env_file: %v", err))
+		}
+
+		fileEnv := []string{}
+		for _, pair := range pairs {
+			fileEnv = append(fileEnv, pair[0]+"="+pair[1])
+		}
+
+		env = append(fileEnv, opts.env...)
+	}
+
+	for _, entry := range env {
+		parts := strings.SplitN(entry, "=", 2)
+		runConfig.Env = setEnv(runConfig.Env, parts[0], parts[1])
+	}
+
+	b.exec.SetRunConfig(&runConfig)
+	defer b.exec.SetRunConfig(nil)
+
+	if opts.stdin != "" {
+		path, err := b.safePath(opts.stdin)
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Could not read stdin: %v", err))
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Could not read stdin: %v", err))
+		}
+		defer f.Close()
+
+		b.exec.SetInput(f)
+		defer b.exec.SetInput(nil)
+	} else if opts.input != nil {
+		b.exec.SetInput(strings.NewReader(*opts.input))
+		defer b.exec.SetInput(nil)
+	}
+
+	if b.logDir != "" {
+		w, closer, err := b.openStepLog()
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Could not create the step log: %v", err))
+		}
+		defer closer()
+
+		b.exec.SetLog(w)
+		defer b.exec.SetLog(nil)
+	}
+
+	if err := b.exec.Commit(cacheKey, b.exec.RunHook); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return nil, nil
+}
+
+// ensureFile fails the build if the path does not exist in the image, or with
+// the executable option, is not an executable file. Symlinks are followed. It
+// checks the image without changing it, so nothing is committed. Relative
+// paths are relative to the workdir.
+func ensureFile(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	path := args[0].String()
+	if path == "" {
+		return nil, b.planException(m, "ensure_file requires a path")
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(b.exec.Config().WorkDir, path)
+	}
+
+	executable := false
+
+	if len(args) > 1 {
+		if args[1].Type() != mruby.TypeHash {
+			return nil, b.planException(m, "Options for ensure_file must be a hash")
+		}
+
+		err := iterateRubyHash(args[1], func(key, value *mruby.MrbValue) error {
+			switch key.String() {
+			case "executable":
+				executable = value.Type() == mruby.TypeTrue
+			default:
+				return fmt.Errorf("Invalid option %q for ensure_file", key.String())
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, b.planException(m, err.Error())
+		}
+	}
+
+	mode, err := b.exec.FileMode(path)
+	if err != nil {
+		return nil, createException(m, fmt.Sprintf("%s does not exist in the image: %v", path, err))
+	}
+
+	if executable && (!mode.IsRegular() || mode&0111 == 0) {
+		return nil, createException(m, fmt.Sprintf("%s is not an executable file (mode %v)", path, mode))
+	}
+
+	return nil, nil
+}
+
+// runExpect runs the command as run does, and fails the build if its output
+// does not match the pattern, a regular expression in Go syntax. It checks the
+// image without changing it, so nothing is committed.
+func runExpect(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	if args[0].Type() != mruby.TypeString || args[1].Type() != mruby.TypeString {
+		return nil, b.planException(m, "run_expect requires a command and a pattern its output must match")
+	}
+
+	command := args[0].String()
+
+	pattern, err := regexp.Compile(args[1].String())
+	if err != nil {
+		return nil, b.planException(m, fmt.Sprintf("Invalid pattern for run_expect: %v", err))
+	}
+
+	runConfig := *b.exec.Config()
+	runConfig.Entrypoint = b.shellCommand()
+	runConfig.Cmd = []string{command}
+	runConfig.Env = b.withProxy(runConfig.Env)
+
+	b.exec.SetRunConfig(&runConfig)
+	defer b.exec.SetRunConfig(nil)
+
+	// the output is captured as it is printed; RunHook returns once all of it
+	// has been.
+	output := new(bytes.Buffer)
+	var w io.Writer = output
+
+	if b.logDir != "" {
+		stepLog, closer, err := b.openStepLog()
+		if err != nil {
+			return nil, createException(m, fmt.Sprintf("Could not create the step log: %v", err))
+		}
+		defer closer()
+
+		w = io.MultiWriter(output, stepLog)
+	}
+
+	b.exec.SetLog(w)
+	defer b.exec.SetLog(nil)
+
+	id, err := b.exec.Create()
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+	defer b.exec.Destroy(id)
+
+	if _, err := b.exec.RunHook(id); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	// a TTY ends lines with CRLF.
+	result := strings.Replace(output.String(), "\r\n", "\n", -1)
+
+	if !pattern.MatchString(result) {
+		return nil, createException(m, fmt.Sprintf("Output of %q does not match %q: %q", command, pattern.String(), strings.TrimSpace(result)))
+	}
+
+	return nil, nil
+}
+
+// deleteFiles removes the provided paths from the image and commits the
+// result. Paths may contain shell globs, and are relative to the workdir if
+// not absolute. The removal is always performed as root.
+func deleteFiles(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	if len(args) == 0 {
+		return nil, b.planException(m, "delete requires at least one path")
+	}
+
+	paths := []string{}
+	for _, arg := range extractStringArgs(args) {
+		if arg == "" {
+			return nil, b.planException(m, "delete cannot remove an empty path")
+		}
+
+		paths = append(paths, globQuote(arg))
+	}
+
+	// the container removes the paths, but the image keeps its own
+	// entrypoint, cmd and user.
+	runConfig := *b.exec.Config()
+	runConfig.Entrypoint = []string{"/bin/sh", "-c"}
+	runConfig.Cmd = []string{"rm -rf -- " + strings.Join(paths, " ")}
+	runConfig.User = "root"
+
+	b.exec.SetRunConfig(&runConfig)
+	defer b.exec.SetRunConfig(nil)
+
+	if err := b.exec.Commit(cacheKey, b.exec.RunHook); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return nil, nil
+}
+
+// mkdir creates directories in the image without starting a container to run
+// a command, which also means the image needs no shell. Paths are relative to
+// the workdir if not absolute, and a trailing hash may set the mode and the
+// owner, as "user" or "user:group".
+func mkdir(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	var mode int64 = 0755
+	owner := "0:0"
+	paths := []string{}
+
+	for _, arg := range args {
+		switch arg.Type() {
+		case mruby.TypeHash:
+			err := iterateRubyHash(arg, func(key, value *mruby.MrbValue) error {
+				switch key.String() {
+				case "mode":
+					if value.Type() != mruby.TypeFixnum {
+						return fmt.Errorf("mode for mkdir must be an integer, not %q", value.String())
+					}
+
+					mode = int64(value.Fixnum()) & 07777
+				case "owner":
+					owner = value.String()
+				default:
+					return fmt.Errorf("Invalid option %q for mkdir", key.String())
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return nil, b.planException(m, err.Error())
+			}
+		case mruby.TypeString:
+			if arg.String() == "" {
+				return nil, b.planException(m, "mkdir cannot create an empty path")
+			}
+
+			paths = append(paths, filepath.Join(b.exec.Config().WorkDir, arg.String()))
+		default:
+			return nil, b.planException(m, fmt.Sprintf("Invalid argument %q for mkdir", arg.String()))
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, b.planException(m, "mkdir requires at least one path")
+	}
+
+	uid, gid, err := lookupOwner(b, owner)
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	fn, err := tar.Directories(b.copyOpts.TempDir, paths, mode, uid, gid)
+	defer os.Remove(fn)
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	hook := func(id string) (string, error) {
+		f, err := os.Open(fn)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		return "", b.exec.CopyToContainer(id, "/", f)
+	}
+
+	if err := b.exec.Commit(cacheKey, hook); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return nil, nil
+}
+
+// useradd adds a user to the image's passwd and shadow files, with a group of
+// the same name unless there is one, and creates its home directory, without
+// starting a container, so the image needs no shell or useradd of its own. A
+// trailing hash may set the uid, gid, home and shell.
+func useradd(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	if len(args) == 0 || args[0].Type() != mruby.TypeString || args[0].String() == "" {
+		return nil, b.planException(m, "useradd requires a user name")
+	}
+
+	acct := &account{name: args[0].String(), uid: -1, gid: -1, shell: "/bin/sh"}
+	acct.home = path.Join("/home", acct.name)
+
+	if strings.ContainsAny(acct.name, ":\n/") {
+		return nil, b.planException(m, fmt.Sprintf("Invalid user name %q", acct.name))
+	}
+
+	for _, arg := range args[1:] {
+		if arg.Type() != mruby.TypeHash {
+			return nil, b.planException(m, fmt.Sprintf("Invalid argument %q for useradd", arg.String()))
+		}
+
+		err := iterateRubyHash(arg, func(key, value *mruby.MrbValue) error {
+			switch key.String() {
+			case "uid", "gid":
+				if value.Type() != mruby.TypeFixnum || value.Fixnum() < 0 {
+					return fmt.Errorf("%s for useradd must be a non-negative integer, not %q", key.String(), value.String())
+				}
+
+				if key.String() == "uid" {
+					acct.uid = value.Fixnum()
+				} else {
+					acct.gid = value.Fixnum()
+				}
+			case "home":
+				if !path.IsAbs(value.String()) {
+					return fmt.Errorf("home for useradd must be an absolute path, not %q", value.String())
+				}
+
+				acct.home = path.Clean(value.String())
+			case "shell":
+				acct.shell = value.String()
+			default:
+				return fmt.Errorf("Invalid option %q for useradd", key.String())
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, b.planException(m, err.Error())
+		}
+	}
+
+	hook := func(id string) (string, error) {
+		rc, err := b.exec.CopyFromContainer(id, "/etc")
+		if err != nil {
+			return "", fmt.Errorf("Could not read /etc: %v", err)
+		}
+
+		files, err := tar.ReadFiles(rc, accountFiles...)
+		if err != nil {
+			return "", fmt.Errorf("Could not read /etc: %v", err)
+		}
+
+		edited, err := acct.add(files)
+		if err != nil {
+			return "", err
+		}
+
+		fn, err := tar.Files(b.copyOpts.TempDir, edited)
+		defer os.Remove(fn)
+		if err != nil {
+			return "", err
+		}
+
+		dir, err := tar.Directories(b.copyOpts.TempDir, []string{acct.home}, 0755, acct.uid, acct.gid)
+		defer os.Remove(dir)
+		if err != nil {
+			return "", err
+		}
+
+		for _, archive := range []string{fn, dir} {
+			f, err := os.Open(archive)
+			if err != nil {
+				return "", err
+			}
+
+			err = b.exec.CopyToContainer(id, "/", f)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+
+		return "", nil
+	}
+
+	if err := b.exec.Commit(cacheKey, hook); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return nil, nil
+}
+
+func withUser(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := standardCheck(b, args, 2); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	if args[1].Type() != mruby.TypeProc {
+		return nil, b.planException(m, fmt.Sprintf("Arg %q was not block!", args[1].String()))
+	}
+
+	user := b.exec.Config().User
+	b.exec.Config().User = args[0].String()
+
+	val, err := m.Yield(args[1], args[0])
+	if err != nil {
+		return nil, createException(m, fmt.Sprintf("Could not yield: %v", err))
+	}
+
+	b.exec.Config().User = user
+
+	if err := b.exec.Commit(cacheKey, nil); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return val, nil
+}
+
+func inside(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := standardCheck(b, args, 2); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	if args[1].Type() != mruby.TypeProc {
+		return nil, b.planException(m, fmt.Sprintf("Arg %q was not block!", args[1].String()))
+	}
+
+	if !path.IsAbs(args[0].String()) {
+		return nil, b.planException(m, fmt.Sprintf("path %q is not absolute in workdir", args[0].String()))
+	}
+
+	workdir := b.exec.Config().WorkDir
+	b.exec.Config().WorkDir = args[0].String()
+
+	val, err := m.Yield(args[1], args[0])
+	if err != nil {
+		return nil, createException(m, fmt.Sprintf("Could not yield: %v", err))
+	}
+
+	b.exec.Config().WorkDir = workdir
+
+	if err := b.exec.Commit(cacheKey, nil); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return val, nil
+}
+
+func env(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := standardCheck(b, args, 1); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	err := iterateRubyHash(args[0], func(key, value *mruby.MrbValue) error {
+		b.exec.Config().Env = setEnv(b.exec.Config().Env, key.String(), value.String())
+		return nil
+	})
+
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	if err := b.exec.Commit(cacheKey, nil); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return nil, nil
+}
+
+// changeInstructions are the Dockerfile instructions docker can apply while
+// committing an image.
+var changeInstructions = map[string]bool{
+	"CMD":        true,
+	"ENTRYPOINT": true,
+	"ENV":        true,
+	"EXPOSE":     true,
+	"LABEL":      true,
+	"ONBUILD":    true,
+	"STOPSIGNAL": true,
+	"USER":       true,
+	"VOLUME":     true,
+	"WORKDIR":    true,
+}
+
+// change commits the image with Dockerfile instructions applied to its
+// configuration, for settings that have no verb of their own.
+func change(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	if len(args) == 0 {
+		return nil, b.planException(m, "change requires at least one instruction")
+	}
+
+	changes := extractStringArgs(args)
+	for _, instruction := range changes {
+		fields := strings.Fields(instruction)
+		if len(fields) < 2 {
+			return nil, b.planException(m, fmt.Sprintf("Change %q must be an instruction followed by its arguments", instruction))
+		}
+
+		if !changeInstructions[strings.ToUpper(fields[0])] {
+			return nil, b.planException(m, fmt.Sprintf("Instruction %q cannot be used with change", fields[0]))
+		}
+	}
+
+	b.exec.AddChanges(changes...)
+
+	if err := b.exec.Commit(cacheKey, nil); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return nil, nil
+}
+
+func cmd(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	stringArgs, shellForm, err := execArgs(b, "cmd", args)
+	if err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	b.exec.Config().Cmd = stringArgs
+	b.exec.Config().ArgsEscaped = shellForm && b.windows()
+
+	if err := b.exec.Commit(cacheKey, nil); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return nil, nil
+}
+
+func copy(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, b.planException(m, fmt.Sprintf("Expected 2 or 3 args, got %d", len(args)))
+	}
+
+	if err := checkImage(b); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	source := args[0].String()
+	target := args[1].String()
+	opts := b.copyOpts
+
+	if len(args) == 3 {
+		if args[2].Type() != mruby.TypeHash {
+			return nil, b.planException(m, fmt.Sprintf("Options for %s must be a hash, not %q", b.current.verb, args[2].String()))
+		}
+
+		owner := ""
+
+		err := iterateRubyHash(args[2], func(key, value *mruby.MrbValue) error {
+			switch key.String() {
+			case "owner":
+				owner = value.String()
+			default:
+				return fmt.Errorf("Invalid option %q for %s", key.String(), b.current.verb)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, b.planException(m, err.Error())
+		}
+
+		if owner != "" {
+			opts.Chown = true
+			if opts.Uid, opts.Gid, err = lookupOwner(b, owner); err != nil {
+				return nil, createException(m, err.Error())
+			}
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	// FIXME do not allow traversing above the wd
+	rel, err := filepath.Rel(wd, filepath.Join(wd, source))
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	paths := filepath.SplitList(rel)
+	for _, path := range paths {
+		if path == ".." {
+			return nil, b.planException(m, fmt.Sprintf("Cannot use relative path %s because it may fall below the root build directory", source))
+		}
+	}
+
+	// nothing outside of a build context is copied.
+	if b.copyOpts.Root != "" && (rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+		return nil, b.planException(m, fmt.Sprintf("Cannot copy %s because it is outside of the build context", source))
+	}
+
+	hostPath, err := b.safePath(rel)
+	if err != nil {
+		return nil, createException(m, fmt.Sprintf("Cannot copy %s: %v", source, err))
+	}
+
+	b.inputs = append(b.inputs, hostPath)
+
+	target = filepath.Clean(filepath.Join(b.exec.Config().WorkDir, target))
+
+	if strings.HasSuffix(target, "/") {
+		target = filepath.Join(target, rel)
+	}
+
+	fn, err := tar.Archive(rel, target, opts)
+	defer os.Remove(fn)
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	cacheKey, err = tar.SumFile(fn)
+	if err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	b.current.key = cacheKey
+	b.current.inputs = append(b.current.inputs, CacheInput{Path: hostPath, Sum: cacheKey})
+
+	if b.useCache {
+		cached, err := b.checkCache(cacheKey)
+		if err != nil {
+			return nil, createException(m, err.Error())
+		}
+
+		if cached {
+			b.current.cached = true
+			return nil, nil
+		}
+	}
+
+	hook := func(id string) (string, error) {
+		// files the parent image already has, unchanged, are left out of the
+		// layer.
+		dedupFn, err := dedupCopy(b, id, fn, target)
+		if err != nil {
+			return "", err
+		}
+
+		if dedupFn != fn {
+			defer os.Remove(dedupFn)
+		}
+
+		f, err := os.Open(dedupFn)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		return "", b.exec.CopyToContainer(id, "/", f)
+	}
+
+	if err := b.exec.Commit(cacheKey, hook); err != nil {
+		return nil, createException(m, err.Error())
+	}
+
+	return nil, nil
+}
+
+// dedupCopy returns an archive holding the entries of the archive in fn that
+// differ from what is at target in the container. If target cannot be read
+// from the container, fn itself is returned.
+func dedupCopy(b *Builder, id, fn, target string) (string, error) {
+	rc, err := b.exec.CopyFromContainer(id, target)
+	if err != nil {
+		return fn, nil
+	}
+
+	sums, err := tar.Sums(rc, filepath.Dir(target))
+	if closer, ok := rc.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	dedupFn, skipped, err := tar.Dedup(fn, sums)
+	if err != nil {
+		return "", err
+	}
+
+	if skipped > 0 {
+		fmt.Printf("+++ Skipped %d unchanged files\n", skipped)
+	}
+
+	return dedupFn, nil
+}
+
+func hostConfig(b *Builder, cacheKey string, args []*mruby.MrbValue, m *mruby.Mrb, self *mruby.MrbValue) (mruby.Value, mruby.Value) {
+	if err := standardCheck(b, args, 1); err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	// work on a copy so a bad key does not leave a half-applied configuration.
+	hc := *b.exec.HostConfig()
+
+	err := iterateRubyHash(args[0], func(key, value *mruby.MrbValue) error {
+		var err error
+
+		switch key.String() {
+		case "memory":
+			hc.Memory, err = extractBytes(value)
+		case "memory_swap":
+			hc.MemorySwap, err = extractBytes(value)
+		case "memory_reservation":
+			hc.MemoryReservation, err = extractBytes(value)
+		case "shm_size":
+			hc.ShmSize, err = extractBytes(value)
+		case "cpu_shares":
+			hc.CPUShares = int64(value.Fixnum())
+		case "pids_limit":
+			hc.PidsLimit = int64(value.Fixnum())
+		case "privileged":
+			hc.Privileged = value.Type() == mruby.TypeTrue
+		case "network_mode":
+			hc.NetworkMode = container.NetworkMode(value.String())
+		case "cap_add":
+			hc.CapAdd, err = extractStringArray(value)
+		case "cap_drop":
+			hc.CapDrop, err = extractStringArray(value)
+		case "security_opt":
+			hc.SecurityOpt, err = extractStringArray(value)
+		case "dns":
+			hc.DNS, err = extractStringArray(value)
+		case "extra_hosts":
+			hc.ExtraHosts, err = extractStringArray(value)
+			hc.ExtraHosts = append(hc.ExtraHosts, b.extraHosts...)
+		case "ulimits":
+			hc.Ulimits = []*units.Ulimit{}
+			err = iterateRubyHash(value, func(name, limit *mruby.MrbValue) error {
+				ulimit, err := units.ParseUlimit(fmt.Sprintf("%s=%s", name.String(), limit.String()))
+				if err != nil {
+					return err
+				}
+
+				hc.Ulimits = append(hc.Ulimits, ulimit)
+				return nil
+			})
+		case "sysctls":
+			hc.Sysctls = map[string]string{}
+			err = iterateRubyHash(value, func(name, setting *mruby.MrbValue) error {
+				hc.Sysctls[name.String()] = setting.String()
+				return nil
+			})
+		default:
+			return fmt.Errorf("host_config does not support key %q", key.String())
+		}
+
+		return err
+	})
+
+	if err == nil && b.safe {
+		err = safeHostConfig(&hc)
+	}
+
+	if err != nil {
+		return nil, b.planException(m, err.Error())
+	}
+
+	*b.exec.HostConfig() = hc
+
 	return nil, nil
 }
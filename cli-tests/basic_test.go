@@ -1,8 +1,22 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rendon/testcli"
 
@@ -54,6 +68,706 @@ func (s *cliSuite) TestCache(c *C) {
 	c.Assert(strings.Contains(cmd.Stdout(), "Cache"), Equals, false, Commentf("%s", cmd.Stdout()))
 }
 
+func (s *cliSuite) TestResume(c *C) {
+	os.Setenv("NO_CACHE", "")
+
+	plan := `
+    from "debian"
+    run "ls"
+    run "ls -l"
+  `
+
+	cmd, err := build(plan)
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	cmd, err = build(plan + fmt.Sprintf("run \"echo %d\"\n", time.Now().UnixNano()))
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "Resuming at step 4"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestLayerSize(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "dd if=/dev/zero of=/zero bs=1M count=10"
+    run "rm /zero"
+  `)
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "Layer: run dd if=/dev/zero of=/zero bs=1M count=10 (+10.49MB)"), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(strings.Contains(cmd.Stdout(), "Layer: run rm /zero (+0B)"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestTimestamps(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "echo hello"
+  `, "--timestamps")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	stamp := regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2}) `)
+	for _, line := range strings.Split(strings.TrimSuffix(cmd.Stdout(), "\n"), "\n") {
+		c.Assert(stamp.MatchString(line), Equals, true, Commentf("%q", line))
+	}
+
+	c.Assert(strings.Contains(cmd.Stdout(), "[run 1] hello"), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(strings.Contains(cmd.Stdout(), "\x1b["), Equals, false, Commentf("%q", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestNoColor(c *C) {
+	plan := `
+    from "debian"
+    run "printf '\\033[1;31mred\\033[0m\\n'"
+  `
+
+	cmd, err := build(plan, "--force-tty", "--no-color")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "red"), Equals, true, Commentf("%q", cmd.Stdout()))
+	c.Assert(regexp.MustCompile("\x1b\\[[0-9;]*m").MatchString(cmd.Stdout()), Equals, false, Commentf("%q", cmd.Stdout()))
+
+	os.Setenv("NO_COLOR", "1")
+	defer os.Unsetenv("NO_COLOR")
+
+	cmd, err = build(plan, "--force-tty")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(regexp.MustCompile("\x1b\\[[0-9;]*m").MatchString(cmd.Stdout()), Equals, false, Commentf("%q", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestSecretEnv(c *C) {
+	os.Setenv("BOX_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("BOX_TEST_SECRET")
+
+	cmd, err := build(`
+    from "debian"
+    run "echo the secret is #{getenv("BOX_TEST_SECRET")}; echo hunter >&2; echo 2 >&2"
+  `, "--secret-env", "BOX_TEST_SECRET", "--secret-env", "BOX_TEST_UNSET")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	c.Assert(strings.Contains(cmd.Stdout(), "the secret is ***"), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(strings.Contains(cmd.Stdout()+cmd.Stderr(), "hunter2"), Equals, false)
+	// only whole secrets are redacted.
+	c.Assert(strings.Contains(cmd.Stderr(), "hunter\n"), Equals, true, Commentf("%s", cmd.Stderr()))
+}
+
+func (s *cliSuite) TestFailOnStderr(c *C) {
+	plan := `
+    from "debian"
+    run "echo warning >&2"
+  `
+
+	cmd, err := build(plan, "--force-tty")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	// the streams are told apart even when a TTY is asked for.
+	cmd, err = build(plan, "--force-tty", "--fail-on-stderr")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "wrote 8 bytes to stderr"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	cmd, err = build(`
+    from "debian"
+    run "echo hello"
+  `, "--fail-on-stderr")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+}
+
+func (s *cliSuite) TestGitProvenance(c *C) {
+	sha := testcli.Command("git", "rev-parse", "--short", "HEAD")
+	sha.Run()
+	if !sha.Success() {
+		c.Skip("not run within a git repository")
+	}
+
+	cmd, err := build(fmt.Sprintf(`
+    from "debian"
+    run "echo %d"
+  `, time.Now().UnixNano()), "--git-provenance", "-t", "box-provenance-test")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	inspect := testcli.Command("docker", "inspect", "-f", "{{.Author}}", "box-provenance-test")
+	inspect.Run()
+	c.Assert(inspect.Success(), Equals, true, Commentf("%s", inspect.Stderr()))
+	c.Assert(strings.Contains(inspect.Stdout(), fmt.Sprintf("(git %s)", strings.TrimSpace(sha.Stdout()))), Equals, true, Commentf("%s", inspect.Stdout()))
+}
+
+func (s *cliSuite) TestEval(c *C) {
+	cmd, err := build("", "-e", `from "debian"; run "echo #{argv.join(",")}"`, "--", "a", "b")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "[run 1] a,b\n"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	cmd, err = build("", "--eval", `from "debian`)
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 2)
+}
+
+func (s *cliSuite) TestMultiplePlans(c *C) {
+	dir, err := ioutil.TempDir("", "box-cli-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.rb")
+	c.Assert(ioutil.WriteFile(base, []byte(`
+    from "debian"
+    run "echo #{argv.first} > /base"
+    tag "box-multi-base"
+  `), 0644), IsNil)
+	defer testcli.Command("docker", "rmi", "box-multi-base").Run()
+
+	app := filepath.Join(dir, "app.rb")
+	c.Assert(ioutil.WriteFile(app, []byte(`
+    from "box-multi-base"
+    run "test \"$(cat /base)\" = #{argv.first}"
+  `), 0644), IsNil)
+
+	cmd, err := build("", base, app, "--", "shared")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(len(regexp.MustCompile(`Finish: [0-9a-f]+`).FindAllString(cmd.Stdout(), -1)), Equals, 2, Commentf("%s", cmd.Stdout()))
+
+	cmd, err = build("", filepath.Join(dir, "missing.rb"), app)
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 2)
+}
+
+func (s *cliSuite) TestLabelFile(c *C) {
+	os.Setenv("NO_CACHE", "")
+	defer os.Setenv("NO_CACHE", "1")
+
+	f, err := ioutil.TempFile("", "box-cli-test")
+	c.Assert(err, IsNil)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	plan := `
+    from "debian"
+    run "echo label-file"
+    change "LABEL team=box build.url=plan"
+  `
+	defer testcli.Command("docker", "rmi", "box-label-test").Run()
+
+	labels := func() map[string]string {
+		inspect := testcli.Command("docker", "inspect", "-f", "{{json .Config.Labels}}", "box-label-test")
+		inspect.Run()
+		c.Assert(inspect.Success(), Equals, true, Commentf("%s", inspect.Stderr()))
+
+		labels := map[string]string{}
+		c.Assert(json.Unmarshal([]byte(inspect.Stdout()), &labels), IsNil, Commentf("%s", inspect.Stdout()))
+		return labels
+	}
+
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("# from ci\nvcs.ref=abc123\n\nbuild.url=https://ci/1\n"), 0644), IsNil)
+	cmd, err := build(plan, "--label-file", f.Name(), "-t", "box-label-test")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	result := labels()
+	c.Assert(result["vcs.ref"], Equals, "abc123")
+	c.Assert(result["build.url"], Equals, "https://ci/1")
+	c.Assert(result["team"], Equals, "box")
+
+	// the labels of box's containers are not carried into the image.
+	for _, label := range []string{"box.role", "box.build-id"} {
+		_, ok := result[label]
+		c.Assert(ok, Equals, false, Commentf("%v", result))
+	}
+
+	// other labels leave the steps cached.
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("vcs.ref=def456\n"), 0644), IsNil)
+	cmd, err = build(plan, "--label-file", f.Name(), "-t", "box-label-test")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "Cache"), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(labels()["vcs.ref"], Equals, "def456")
+
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("vcs.ref\n"), 0644), IsNil)
+	cmd, err = build(plan, "--label-file", f.Name())
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 2)
+}
+
+func (s *cliSuite) TestEnvFile(c *C) {
+	dir, err := ioutil.TempDir("", "box-cli-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	plan := filepath.Join(dir, "plan.rb")
+	c.Assert(ioutil.WriteFile(plan, []byte(`
+    from "debian"
+    run "echo greeting=#{arg("GREETING")} other=#{arg("OTHER", "default")}"
+  `), 0644), IsNil)
+
+	// without box.env, the arguments come from --arg and the defaults.
+	cmd := testcli.Command("box", "--arg", "GREETING=flag", plan)
+	cmd.Run()
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "greeting=flag other=default"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "box.env"), []byte("# local development\nGREETING=file\nOTHER=file\n"), 0644), IsNil)
+
+	cmd = testcli.Command("box", plan)
+	cmd.Run()
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "greeting=file other=file"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	// --arg takes precedence over the file.
+	cmd = testcli.Command("box", "--arg", "OTHER=flag", plan)
+	cmd.Run()
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "greeting=file other=flag"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "box.env"), []byte("GREETING\n"), 0644), IsNil)
+
+	cmd = testcli.Command("box", plan)
+	cmd.Run()
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 2)
+}
+
+func (s *cliSuite) TestLogEndpoint(c *C) {
+	plan := `
+    from "debian"
+    run "echo to-the-endpoint \e[31mred\e[0m"
+  `
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	messages := make(chan string, 1000)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+
+	cmd, err := build(plan, "--log-endpoint", "udp://"+conn.LocalAddr().String())
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	found := false
+	timeout := time.After(5 * time.Second)
+	for !found {
+		select {
+		case message := <-messages:
+			c.Assert(strings.HasPrefix(message, "<14>1 "), Equals, true, Commentf("%q", message))
+			found = strings.HasSuffix(message, "[run 1] to-the-endpoint red")
+		case <-timeout:
+			c.Fatal("no syslog message with the output of the run")
+		}
+	}
+
+	var mutex sync.Mutex
+	body := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		body += string(content)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	cmd, err = build(plan, "--log-endpoint", server.URL)
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	// everything is sent before box exits.
+	mutex.Lock()
+	c.Assert(strings.Contains(body, "[run 1] to-the-endpoint red\n"), Equals, true, Commentf("%s", body))
+	c.Assert(strings.Contains(body, "Execute: from debian"), Equals, true, Commentf("%s", body))
+	mutex.Unlock()
+
+	cmd, err = build(plan, "--log-endpoint", "ftp://logs")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+}
+
+func (s *cliSuite) TestContext(c *C) {
+	f, err := ioutil.TempFile("", "box-cli-test")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	content := []byte("from-context\n")
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "ctx/file", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}), IsNil)
+	_, err = tw.Write(content)
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(gz.Close(), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	// a directory is copied into the target under its own name.
+	cmd, err := build(`
+    from "debian"
+    copy "ctx", "/"
+    run "grep -q from-context /ctx/file"
+    run "grep -q from-context -", stdin: "ctx/file"
+  `, "--context", f.Name())
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	// the files a step depends on are keyed by their path within the context,
+	// which is unpacked somewhere else each build.
+	os.Setenv("NO_CACHE", "")
+	defer os.Setenv("NO_CACHE", "1")
+
+	plan := `from "debian"; run "date >/date", cache_on: "ctx/*"`
+	for i := 0; i < 2; i++ {
+		cmd, err = build(plan, "--context", f.Name())
+		c.Assert(err, IsNil)
+		checkSuccess(c, cmd)
+	}
+	c.Assert(strings.Contains(cmd.Stdout(), "Cache"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	// nothing outside of the context is read.
+	for _, plan := range []string{
+		`from "debian"; copy "../ctx", "/ctx"`,
+		`from "debian"; run "cat", stdin: "/etc/passwd"`,
+		`from "debian"; run "true", env_file: "../box.env"`,
+		`from "debian"; run "true", cache_on: "/etc/*"`,
+	} {
+		cmd, err = build(plan, "--context", f.Name())
+		c.Assert(err, IsNil)
+		checkFailure(c, cmd)
+		c.Assert(strings.Contains(cmd.Stdout(), "outside of the build context"), Equals, true, Commentf("%s: %s", plan, cmd.Stdout()))
+	}
+
+	cmd, err = build(`
+    from "debian"
+  `, "--context", "/nonexistent.tar")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 2)
+}
+
+func (s *cliSuite) TestWatch(c *C) {
+	dir, err := ioutil.TempDir("", "box-cli-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(os.Mkdir(filepath.Join(dir, "src"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "src", "file"), []byte("one"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "plan.rb"), []byte(`from "debian"; copy "src", "/src"`), 0644), IsNil)
+
+	cmd, lines, waitFor := startWatch(c, dir, "--watch", "plan.rb")
+	defer cmd.Process.Kill()
+
+	waitFor("Watching for changes")
+
+	// copy sources are watched along with the plan.
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "src", "file"), []byte("two"), 0644), IsNil)
+	waitFor("src/file changed, building again")
+	waitFor("Watching for changes")
+
+	// a failed build waits for the next change.
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "plan.rb"), []byte(`from "debian"; run "exit 1"`), 0644), IsNil)
+	waitFor("plan.rb changed, building again")
+	waitFor("exited with status 1")
+	waitFor("Watching for changes")
+
+	c.Assert(cmd.Process.Signal(os.Interrupt), IsNil)
+	for range lines {
+	}
+	c.Assert(cmd.Wait(), IsNil)
+}
+
+func (s *cliSuite) TestWatchContext(c *C) {
+	dir, err := ioutil.TempDir("", "box-cli-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	writeContext := func(content string) {
+		f, err := os.Create(filepath.Join(dir, "context.tar"))
+		c.Assert(err, IsNil)
+		tw := tar.NewWriter(f)
+		c.Assert(tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}), IsNil)
+		_, err = tw.Write([]byte(content))
+		c.Assert(err, IsNil)
+		c.Assert(tw.Close(), IsNil)
+		c.Assert(f.Close(), IsNil)
+	}
+
+	writeContext("one")
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "plan.rb"), []byte(`from "debian"; copy "file", "/file"; run "cat /file"`), 0644), IsNil)
+
+	cmd, lines, waitFor := startWatch(c, dir, "--watch", "--context", "context.tar", "plan.rb")
+	defer cmd.Process.Kill()
+
+	waitFor("Watching for changes")
+
+	// the archive is watched in place of the files unpacked from it.
+	writeContext("two")
+	waitFor("context.tar changed, building again")
+	waitFor("two")
+	waitFor("Watching for changes")
+
+	c.Assert(cmd.Process.Signal(os.Interrupt), IsNil)
+	for range lines {
+	}
+	c.Assert(cmd.Wait(), IsNil)
+}
+
+// startWatch starts box with the arguments in dir, and returns the lines it
+// prints and a function waiting for a line containing the text.
+func startWatch(c *C, dir string, args ...string) (*exec.Cmd, chan string, func(string)) {
+	cmd := exec.Command("box", args...)
+	cmd.Dir = dir
+	stdout, err := cmd.StdoutPipe()
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Start(), IsNil)
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	waitFor := func(text string) {
+		timeout := time.After(2 * time.Minute)
+		for {
+			select {
+			case line, ok := <-lines:
+				c.Assert(ok, Equals, true, Commentf("box exited before printing %q", text))
+				if strings.Contains(line, text) {
+					return
+				}
+			case <-timeout:
+				c.Fatalf("timed out waiting for %q", text)
+			}
+		}
+	}
+
+	return cmd, lines, waitFor
+}
+
+func (s *cliSuite) TestPlanURL(c *C) {
+	for _, url := range []string{
+		"http://example.com/plan.rb",
+		"https://127.0.0.1:1/plan.rb",
+	} {
+		cmd, err := build("", url)
+		c.Assert(err, IsNil)
+		checkFailure(c, cmd)
+		c.Assert(exitStatus(cmd), Equals, 2, Commentf("%s", url))
+	}
+
+	cmd, err := build("", "http://example.com/plan.rb")
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(cmd.Stdout(), "only fetched over https"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestOutput(c *C) {
+	dir, err := ioutil.TempDir("", "box-output")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "image.tar")
+	plan := `
+    from "debian"
+    run "touch /saved"
+  `
+
+	cmd, err := build(plan, "--output", "type=tar,dest="+dest, "-t", "box-output-test")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	manifest := testcli.Command("tar", "-xOf", dest, "manifest.json")
+	manifest.Run()
+	c.Assert(manifest.Success(), Equals, true, Commentf("%s", manifest.Stderr()))
+	c.Assert(strings.Contains(manifest.Stdout(), "box-output-test:latest"), Equals, true, Commentf("%s", manifest.Stdout()))
+
+	// to stdout, with the build output on stderr.
+	cmd, err = build(plan, "--output", "type=tar")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stderr(), "Finish:"), Equals, true)
+	c.Assert(strings.Contains(cmd.Stdout(), "manifest.json"), Equals, true)
+
+	for _, output := range []string{"type=zip", "type=docker,dest=foo", "dest"} {
+		cmd, err = build(plan, "--output", output)
+		c.Assert(err, IsNil)
+		checkFailure(c, cmd)
+	}
+}
+
+func (s *cliSuite) TestNoLoad(c *C) {
+	dir, err := ioutil.TempDir("", "box-no-load")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "image.tar")
+	plan := fmt.Sprintf(`
+    from "debian"
+    run "echo %d"
+  `, time.Now().UnixNano())
+
+	cmd, err := build(plan, "--output", "type=tar,dest="+dest, "--no-load", "-t", "box-no-load-test")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	_, err = os.Stat(dest)
+	c.Assert(err, IsNil)
+
+	inspect := testcli.Command("docker", "inspect", "box-no-load-test")
+	inspect.Run()
+	c.Assert(inspect.Success(), Equals, false)
+
+	cmd, err = build(plan, "--no-load")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+}
+
+func (s *cliSuite) TestBuildID(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "true"
+  `, "--build-id", "ci-1234")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	cmd, err = build(`from "debian"`, "--build-id", "ci/1234")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "invalid --build-id"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestAPIVersion(c *C) {
+	plan := `
+    from "debian"
+  `
+
+	cmd, err := build(plan, "--api-version", "1.23")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	cmd, err = build(plan, "--api-version", "latest")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 1)
+	c.Assert(strings.Contains(cmd.Stdout(), "invalid --api-version"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestKeepFinal(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "touch /final"
+  `, "--rm=false")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	match := regexp.MustCompile(`Kept container: ([0-9a-f]+)`).FindStringSubmatch(cmd.Stdout())
+	c.Assert(match, NotNil, Commentf("%s", cmd.Stdout()))
+	defer testcli.Command("docker", "rm", "-f", match[1]).Run()
+
+	finish := regexp.MustCompile(`Finish: ([0-9a-f]+)`).FindStringSubmatch(cmd.Stdout())
+	c.Assert(finish, NotNil, Commentf("%s", cmd.Stdout()))
+
+	inspect := testcli.Command("docker", "inspect", "-f", "{{.Image}} {{index .Config.Labels \"box.role\"}}", match[1])
+	inspect.Run()
+	c.Assert(inspect.Success(), Equals, true, Commentf("%s", inspect.Stderr()))
+	c.Assert(strings.Contains(inspect.Stdout(), finish[1]), Equals, true, Commentf("%s", inspect.Stdout()))
+	c.Assert(strings.HasSuffix(strings.TrimSpace(inspect.Stdout()), " final"), Equals, true, Commentf("%s", inspect.Stdout()))
+
+	cmd, err = build(`from "debian"`, "--rm=false", "--no-load", "--output", "type=tar,dest=/dev/null")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+
+	// imported plans are part of the build, and keep nothing of their own.
+	f, err := ioutil.TempFile("", "box-cli-test")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`run "touch /imported"`)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	cmd, err = build(fmt.Sprintf(`from "debian"; import %q; run "touch /final"`, f.Name()), "--rm=false")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	kept := regexp.MustCompile(`Kept container: ([0-9a-f]+)`).FindAllStringSubmatch(cmd.Stdout(), -1)
+	for _, match := range kept {
+		defer testcli.Command("docker", "rm", "-f", match[1]).Run()
+	}
+	c.Assert(kept, HasLen, 1, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestErrorFormat(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "exit 1"
+  `, "--error-format", "json")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 1)
+
+	lines := strings.Split(strings.TrimSpace(cmd.Stderr()), "\n")
+	failure := map[string]interface{}{}
+	c.Assert(json.Unmarshal([]byte(lines[len(lines)-1]), &failure), IsNil, Commentf("%s", cmd.Stderr()))
+	c.Assert(failure["kind"], Equals, "step")
+	c.Assert(failure["step"], Equals, float64(2))
+	c.Assert(failure["verb"], Equals, "run")
+	c.Assert(failure["exit_code"], Equals, float64(1))
+	c.Assert(strings.Contains(failure["message"].(string), "exited with status 1"), Equals, true, Commentf("%v", failure))
+	c.Assert(strings.Contains(cmd.Stdout(), "!!! Error:"), Equals, true)
+
+	cmd, err = build(`from "debian`, "--error-format", "json")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 2)
+	c.Assert(strings.Contains(cmd.Stderr(), `"kind":"plan"`), Equals, true, Commentf("%s", cmd.Stderr()))
+
+	cmd, err = build(`from "debian"`, "--error-format", "xml")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+}
+
+func (s *cliSuite) TestCacheDir(c *C) {
+	os.Setenv("NO_CACHE", "")
+
+	dir, err := ioutil.TempDir("", "box-cache-dir")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	plan := `
+    from "debian"
+    run "ls"
+  `
+
+	cmd, err := build(plan, "--cache-dir", dir)
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	_, err = os.Stat(filepath.Join(dir, "cache.json"))
+	c.Assert(err, IsNil)
+
+	cmd, err = build(plan, "--cache-dir", dir)
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "Cache"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
 func (s *cliSuite) TestOmit(c *C) {
 	cmd, err := build(
 		`
@@ -64,6 +778,27 @@ func (s *cliSuite) TestOmit(c *C) {
 	checkFailure(c, cmd)
 
 	c.Assert(cmd.Stdout(), Equals, "!!! Error: undefined method 'from' for main\n")
+	c.Assert(exitStatus(cmd), Equals, 2)
+}
+
+func (s *cliSuite) TestExitStatus(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "exit 1"
+  `)
+
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 1)
+
+	cmd, err = build(`
+    from "debian"
+    run "true" do
+  `)
+
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 2)
 }
 
 func (s *cliSuite) TestTag(c *C) {
@@ -77,6 +812,18 @@ func (s *cliSuite) TestTag(c *C) {
 	checkSuccess(c, cmd)
 
 	c.Assert(strings.Contains(cmd.Stdout(), `Tagged: tagtest`), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	cmd, err = build(
+		`
+    from "debian"
+    run "ls"
+    `, "-t", "tagtest:1", "-t", "tagtest:latest")
+
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	c.Assert(strings.Contains(cmd.Stdout(), `Tagged: tagtest:1`), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(strings.Contains(cmd.Stdout(), `Tagged: tagtest:latest`), Equals, true, Commentf("%s", cmd.Stdout()))
 }
 
 func (s *cliSuite) TestHelp(c *C) {
@@ -90,3 +837,129 @@ func (s *cliSuite) TestVersion(c *C) {
 	cmd.Run()
 	c.Assert(strings.Contains(cmd.Stdout(), "box version"), Equals, true)
 }
+
+func (s *cliSuite) TestDaemonUnreachable(c *C) {
+	host := os.Getenv("DOCKER_HOST")
+	os.Setenv("DOCKER_HOST", "unix:///nonexistent/docker.sock")
+	defer os.Setenv("DOCKER_HOST", host)
+
+	cmd, err := build(`
+    from "debian"
+  `)
+
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 3)
+	c.Assert(strings.Contains(cmd.Stdout(), "Cannot connect to the Docker daemon"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestLint(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "true"
+  `, "lint")
+
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(cmd.Stdout(), Equals, "")
+
+	cmd, err = build(`
+    run "true"
+  `, "lint")
+
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 1)
+	c.Assert(strings.Contains(cmd.Stdout(), "from is never called"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestDiff(c *C) {
+	dir, err := ioutil.TempDir("", "box-cli-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	a, b := filepath.Join(dir, "a.rb"), filepath.Join(dir, "b.rb")
+	c.Assert(ioutil.WriteFile(a, []byte(`
+    from "debian"
+    env "PORT" => "8080"
+    cmd "serve"
+  `), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(b, []byte(`
+    from "debian"
+    env "PORT" => "9090", "DEBUG" => "1"
+    run "touch /debug"
+    cmd "serve"
+  `), 0644), IsNil)
+
+	cmd := testcli.Command("box", "diff", a, a)
+	cmd.Run()
+	checkSuccess(c, cmd)
+	c.Assert(strings.Count(cmd.Stdout(), "\n"), Equals, 2, Commentf("%s", cmd.Stdout()))
+
+	cmd = testcli.Command("box", "diff", a, b)
+	cmd.Run()
+	checkFailure(c, cmd)
+	c.Assert(exitStatus(cmd), Equals, 1)
+	c.Assert(strings.Contains(cmd.Stdout(), "env PORT: 8080 -> 9090\n"), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(strings.Contains(cmd.Stdout(), "env DEBUG: (none) -> 1\n"), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(strings.Contains(cmd.Stdout(), "cmd:"), Equals, false, Commentf("%s", cmd.Stdout()))
+	// the output of the builds is not mixed in.
+	c.Assert(strings.Contains(cmd.Stdout(), "BEGIN OUTPUT"), Equals, false, Commentf("%s", cmd.Stdout()))
+
+	cmd = testcli.Command("box", "diff", "--json", a, b)
+	cmd.Run()
+	checkFailure(c, cmd)
+
+	diffs := []struct {
+		Field string
+		A     *string
+		B     *string
+	}{}
+	c.Assert(json.Unmarshal([]byte(cmd.Stdout()), &diffs), IsNil, Commentf("%s", cmd.Stdout()))
+
+	fields := map[string]bool{}
+	for _, d := range diffs {
+		fields[d.Field] = true
+	}
+	c.Assert(fields["env DEBUG"], Equals, true)
+	c.Assert(fields["layers"], Equals, true)
+
+	cmd = testcli.Command("box", "diff", a, filepath.Join(dir, "missing.rb"))
+	cmd.Run()
+	c.Assert(exitStatus(cmd), Equals, 2)
+
+	// the plans are built with the global flags, such as --arg.
+	withArg := filepath.Join(dir, "arg.rb")
+	c.Assert(ioutil.WriteFile(withArg, []byte(`
+    from "debian"
+    env "PORT" => arg("port")
+    cmd "serve"
+  `), 0644), IsNil)
+
+	cmd = testcli.Command("box", "--arg", "port=8080", "diff", a, withArg)
+	cmd.Run()
+	checkSuccess(c, cmd)
+}
+
+func (s *cliSuite) TestVerbs(c *C) {
+	cmd := testcli.Command("box", "verbs")
+	cmd.Run()
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "verb      with_user(arg1, &block)\n"), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(strings.Contains(cmd.Stdout(), "function  getenv(arg1)\n"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	cmd = testcli.Command("box", "verbs", "-o", "run", "--format", "json")
+	cmd.Run()
+	checkSuccess(c, cmd)
+
+	verbs := []struct{ Name string }{}
+	c.Assert(json.Unmarshal([]byte(cmd.Stdout()), &verbs), IsNil)
+
+	names := map[string]bool{}
+	for _, verb := range verbs {
+		names[verb.Name] = true
+	}
+
+	c.Assert(names["run"], Equals, false)
+	c.Assert(names["copy"], Equals, true)
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"syscall"
 	. "testing"
 
 	"github.com/rendon/testcli"
@@ -52,3 +54,11 @@ func checkSuccess(c *C, cmd *testcli.Cmd) {
 func checkFailure(c *C, cmd *testcli.Cmd) {
 	c.Assert(cmd.Failure(), Equals, true, Commentf("stdout:\n%s\nstderr:\n%s\n", cmd.Stdout(), cmd.Stderr()))
 }
+
+func exitStatus(cmd *testcli.Cmd) int {
+	if err, ok := cmd.Error().(*exec.ExitError); ok {
+		return err.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+
+	return 0
+}
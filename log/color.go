@@ -0,0 +1,65 @@
+package log
+
+import "io"
+
+// stripColorWriter removes the escape sequences setting colors and text
+// attributes (SGR, ESC [ ... m) from everything written through it. Other
+// escape sequences, such as cursor movement, are written unchanged. The start
+// of a sequence at the end of a write is held back until the next write
+// completes it, or until Close.
+type stripColorWriter struct {
+	writer io.Writer
+	held   []byte
+}
+
+// NewStripColorWriter returns a writer that removes color and formatting
+// escapes before writing to w. Close writes anything held back.
+func NewStripColorWriter(w io.Writer) io.WriteCloser {
+	return &stripColorWriter{writer: w}
+}
+
+func (sw *stripColorWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+
+	for _, c := range p {
+		switch {
+		case len(sw.held) == 0:
+			if c == 0x1b {
+				sw.held = append(sw.held, c)
+			} else {
+				out = append(out, c)
+			}
+		case len(sw.held) == 1:
+			// only control sequences (ESC [) can set colors.
+			if c == '[' {
+				sw.held = append(sw.held, c)
+			} else if c == 0x1b {
+				out = append(out, sw.held...)
+			} else {
+				out = append(append(out, sw.held...), c)
+				sw.held = sw.held[:0]
+			}
+		case c >= 0x20 && c <= 0x3f:
+			// parameter and intermediate bytes.
+			sw.held = append(sw.held, c)
+		default:
+			if c != 'm' {
+				out = append(append(out, sw.held...), c)
+			}
+			sw.held = sw.held[:0]
+		}
+	}
+
+	if _, err := sw.writer.Write(out); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close writes the start of a sequence that was never completed.
+func (sw *stripColorWriter) Close() error {
+	_, err := sw.writer.Write(sw.held)
+	sw.held = nil
+	return err
+}
@@ -0,0 +1,58 @@
+package log
+
+import (
+	"bytes"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type logSuite struct{}
+
+var _ = Suite(&logSuite{})
+
+func TestLog(t *T) {
+	TestingT(t)
+}
+
+func (ls *logSuite) TestStripColor(c *C) {
+	table := []struct {
+		writes []string
+		result string
+	}{
+		{[]string{"\x1b[1;31mred\x1b[0m plain"}, "red plain"},
+		// sequences split between writes are removed once complete.
+		{[]string{"\x1b", "[3", "1mred", "\x1b[", "0m plain"}, "red plain"},
+		// other sequences are kept.
+		{[]string{"\x1b[2Kline\x1b[1A"}, "\x1b[2Kline\x1b[1A"},
+		{[]string{"a\x1b", "b"}, "a\x1bb"},
+		{[]string{"a\x1b", "\x1b[0mb"}, "a\x1bb"},
+	}
+
+	for _, t := range table {
+		buf := &bytes.Buffer{}
+		w := NewStripColorWriter(buf)
+
+		for _, write := range t.writes {
+			n, err := w.Write([]byte(write))
+			c.Assert(err, IsNil)
+			c.Assert(n, Equals, len(write))
+		}
+
+		c.Assert(w.Close(), IsNil)
+		c.Assert(buf.String(), Equals, t.result, Commentf("%q", t.writes))
+	}
+}
+
+func (ls *logSuite) TestStripColorClose(c *C) {
+	buf := &bytes.Buffer{}
+	w := NewStripColorWriter(buf)
+
+	_, err := w.Write([]byte("text\x1b[1"))
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "text")
+
+	// the start of a sequence that is never completed is written as it was.
+	c.Assert(w.Close(), IsNil)
+	c.Assert(buf.String(), Equals, "text\x1b[1")
+}
@@ -0,0 +1,209 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// endpointQueue is the number of lines an endpoint holds while it is sending.
+// Writes block once it is full, rather than losing output.
+const endpointQueue = 1024
+
+// Endpoint mirrors the output written to its writers to a remote log
+// endpoint, one line at a time: as syslog messages (RFC 5424) to udp:// and
+// tcp:// endpoints, or in the body of POST requests to http:// and https://
+// ones. Lines are sent in the background. If sending fails, the error is
+// reported once and the remaining lines are dropped, so a broken endpoint
+// does not fail the build.
+type Endpoint struct {
+	send    func([]string) error
+	conn    io.Closer
+	lines   chan string
+	done    chan struct{}
+	warn    io.Writer
+	mutex   sync.Mutex
+	writers []*endpointWriter
+	closed  bool
+}
+
+// DialEndpoint connects to the endpoint, given as a URL such as
+// udp://logs:514 or https://logs/box. Problems sending later are reported to
+// warn.
+func DialEndpoint(endpoint string, warn io.Writer) (*Endpoint, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Endpoint{lines: make(chan string, endpointQueue), done: make(chan struct{}), warn: warn}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("%s has no host:port to send to", endpoint)
+		}
+
+		conn, err := net.DialTimeout(u.Scheme, u.Host, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+
+		e.send, e.conn = syslogSender(conn), conn
+	case "http", "https":
+		e.send = httpSender(endpoint)
+	default:
+		return nil, fmt.Errorf("%s must be a udp://, tcp://, http:// or https:// URL", endpoint)
+	}
+
+	go e.run()
+
+	return e, nil
+}
+
+// run sends the lines written until Close. Lines that are already waiting
+// are sent together.
+func (e *Endpoint) run() {
+	defer close(e.done)
+
+	failed := false
+
+	for line := range e.lines {
+		batch := []string{line}
+		for waiting := len(e.lines); waiting > 0; waiting-- {
+			batch = append(batch, <-e.lines)
+		}
+
+		if failed {
+			continue
+		}
+
+		if err := e.send(batch); err != nil {
+			fmt.Fprintf(e.warn, "!!! Could not send the output to the log endpoint; no more will be sent: %v\n", err)
+			failed = true
+		}
+	}
+}
+
+// Writer returns a writer whose lines are sent to the endpoint. Each stream,
+// such as stdout and stderr, should have its own, so their lines are not
+// mixed.
+func (e *Endpoint) Writer() io.Writer {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	w := &endpointWriter{lines: e.lines}
+	e.writers = append(e.writers, w)
+	return w
+}
+
+// Close sends the unfinished lines of the writers and everything still
+// waiting to be sent. The writers must not be written to afterwards. Closing
+// again does nothing.
+func (e *Endpoint) Close() error {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return nil
+	}
+
+	e.closed = true
+	for _, w := range e.writers {
+		w.flush()
+	}
+	e.mutex.Unlock()
+
+	close(e.lines)
+	<-e.done
+
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+
+	return nil
+}
+
+// endpointWriter splits what is written to it into lines for an Endpoint.
+type endpointWriter struct {
+	lines chan string
+	held  []byte
+}
+
+func (ew *endpointWriter) Write(p []byte) (int, error) {
+	ew.held = append(ew.held, p...)
+
+	for {
+		i := bytes.IndexByte(ew.held, '\n')
+		if i < 0 {
+			break
+		}
+
+		ew.lines <- strings.TrimSuffix(string(ew.held[:i]), "\r")
+		ew.held = ew.held[i+1:]
+	}
+
+	ew.held = append([]byte{}, ew.held...)
+	return len(p), nil
+}
+
+func (ew *endpointWriter) flush() {
+	if len(ew.held) > 0 {
+		ew.lines <- string(ew.held)
+		ew.held = nil
+	}
+}
+
+// syslogSender returns a sender writing each line to conn as a syslog
+// message of the user facility, at the info level.
+func syslogSender(conn net.Conn) func([]string) error {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	header := fmt.Sprintf("%s box %d - -", hostname, os.Getpid())
+	_, stream := conn.(*net.TCPConn)
+
+	return func(lines []string) error {
+		for _, line := range lines {
+			message := fmt.Sprintf("<14>1 %s %s %s", time.Now().UTC().Format("2006-01-02T15:04:05.000000Z07:00"), header, line)
+			// messages on a stream are framed by newlines.
+			if stream {
+				message += "\n"
+			}
+
+			if _, err := conn.Write([]byte(message)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// httpSender returns a sender posting the lines to the URL as plain text,
+// one per line.
+func httpSender(endpoint string) func([]string) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	return func(lines []string) error {
+		resp, err := client.Post(endpoint, "text/plain; charset=utf-8", strings.NewReader(strings.Join(lines, "\n")+"\n"))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s responded %s", endpoint, resp.Status)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (ls *logSuite) TestEndpointWriter(c *C) {
+	lines := make(chan string, 10)
+	w := &endpointWriter{lines: lines}
+
+	for _, write := range []string{"fir", "st\nsec", "ond\r\nthird\n\nfou", "rth"} {
+		n, err := w.Write([]byte(write))
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(write))
+	}
+
+	// the unfinished line is held until flushed.
+	c.Assert(len(lines), Equals, 4)
+	w.flush()
+	close(lines)
+
+	result := []string{}
+	for line := range lines {
+		result = append(result, line)
+	}
+
+	c.Assert(result, DeepEquals, []string{"first", "second", "third", "", "fourth"})
+}
+
+func (ls *logSuite) TestEndpointBatches(c *C) {
+	batches := [][]string{}
+	warn := &bytes.Buffer{}
+
+	e := &Endpoint{lines: make(chan string, endpointQueue), done: make(chan struct{}), warn: warn}
+	e.send = func(lines []string) error {
+		batches = append(batches, lines)
+		return nil
+	}
+
+	// the lines waiting when the endpoint starts sending are sent together.
+	w := e.Writer()
+	_, err := w.Write([]byte("a\nb\nc\n"))
+	c.Assert(err, IsNil)
+
+	go e.run()
+	c.Assert(e.Close(), IsNil)
+	c.Assert(batches, DeepEquals, [][]string{{"a", "b", "c"}})
+	c.Assert(warn.String(), Equals, "")
+}
+
+func (ls *logSuite) TestEndpointSendFailure(c *C) {
+	sent := 0
+	warn := &bytes.Buffer{}
+
+	e := &Endpoint{lines: make(chan string, endpointQueue), done: make(chan struct{}), warn: warn}
+	e.send = func(lines []string) error {
+		sent++
+		return errors.New("refused")
+	}
+	go e.run()
+
+	w := e.Writer()
+	for i := 0; i < 3; i++ {
+		_, err := w.Write([]byte("line\n"))
+		c.Assert(err, IsNil)
+	}
+
+	// the failure is reported once, and the rest of the lines dropped.
+	c.Assert(e.Close(), IsNil)
+	c.Assert(sent, Equals, 1)
+	c.Assert(strings.Count(warn.String(), "Could not send"), Equals, 1, Commentf("%s", warn.String()))
+}
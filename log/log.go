@@ -3,6 +3,7 @@ package log
 import (
 	"fmt"
 
+	"github.com/docker/go-units"
 	"github.com/fatih/color"
 )
 
@@ -21,13 +22,49 @@ func BuildStep(step, command string) {
 	color.Green(fmt.Sprintf("%s %s", step, command))
 }
 
-// CacheHit logs a cache hit.
-func CacheHit(imageID string) {
+// CacheHit logs a cache hit: the step and verb that hit, the cache key it
+// matched, which the image carries as its comment, and the image used.
+func CacheHit(step int, verb, cacheKey, imageID string) {
 	printGood()
 	color.New(color.FgWhite, color.Bold, color.BgRed).Printf("Cache hit:")
+	fmt.Printf(" step %d (%s), key %s", step, verb, cacheKey)
 	color.New(color.FgCyan).Printf(" using %q\n", imageID)
 }
 
+// Resume logs the step a build resumes at after the steps before it were
+// found in the cache.
+func Resume(step int) {
+	printGood()
+	color.New(color.FgWhite, color.Bold, color.BgRed).Printf("Resuming at step %d", step)
+	fmt.Println()
+}
+
+// LayerSize logs the change in image size made by a build step.
+func LayerSize(step, command string, delta int64) {
+	sign := "+"
+	if delta < 0 {
+		sign, delta = "-", -delta
+	}
+
+	printGood()
+	color.New(color.Bold, color.FgWhite).Printf("Layer: ")
+	fmt.Printf("%s %s ", step, command)
+	color.New(color.FgCyan).Printf("(%s%s)\n", sign, units.HumanSize(float64(delta)))
+}
+
+// Violation logs a violation of the policy of strict mode by the step and
+// verb, or by the image built if step is 0.
+func Violation(step int, verb, message string) {
+	printNotice()
+	color.New(color.FgRed, color.Bold).Printf("VIOLATION: ")
+	if step == 0 {
+		fmt.Println(message)
+		return
+	}
+
+	fmt.Printf("step %d (%s): %s\n", step, verb, message)
+}
+
 // CopyPath logs a copied path
 func CopyPath(file1, file2 string) {
 	printNotice()
@@ -35,6 +72,20 @@ func CopyPath(file1, file2 string) {
 	fmt.Printf("%q -> %q\n", file1, file2)
 }
 
+// CopySkip logs a path left out of a copy.
+func CopySkip(file string, err error) {
+	printNotice()
+	color.New(color.FgRed).Printf("SKIP: ")
+	fmt.Printf("%q: %v\n", file, err)
+}
+
+// Container logs a container left behind by the build.
+func Container(id string) {
+	printGood()
+	color.New(color.FgYellow).Printf("Kept container: ")
+	fmt.Println(id)
+}
+
 // Tag logs a tag
 func Tag(name string) {
 	printGood()
@@ -0,0 +1,68 @@
+package log
+
+import (
+	"bytes"
+	"io"
+)
+
+// redactWriter replaces secrets with *** in everything written through it.
+// The end of a write that could be the start of a secret is held back until
+// the next write shows whether it is one, or until Close.
+type redactWriter struct {
+	writer  io.Writer
+	secrets [][]byte
+	buf     []byte
+}
+
+// NewRedactWriter returns a writer that replaces each of the secrets with ***
+// before writing to w. Close writes anything held back.
+func NewRedactWriter(w io.Writer, secrets []string) io.WriteCloser {
+	rw := &redactWriter{writer: w}
+	for _, secret := range secrets {
+		if secret != "" {
+			rw.secrets = append(rw.secrets, []byte(secret))
+		}
+	}
+
+	return rw
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	rw.buf = append(rw.buf, p...)
+
+	for _, secret := range rw.secrets {
+		rw.buf = bytes.Replace(rw.buf, secret, []byte("***"), -1)
+	}
+
+	keep := rw.partial()
+	if _, err := rw.writer.Write(rw.buf[:len(rw.buf)-keep]); err != nil {
+		return 0, err
+	}
+
+	rw.buf = append([]byte{}, rw.buf[len(rw.buf)-keep:]...)
+	return len(p), nil
+}
+
+// partial returns the length of the longest end of the buffer that is the
+// start of a secret.
+func (rw *redactWriter) partial() int {
+	longest := 0
+
+	for _, secret := range rw.secrets {
+		for n := len(secret) - 1; n > longest; n-- {
+			if n <= len(rw.buf) && bytes.HasSuffix(rw.buf, secret[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+
+	return longest
+}
+
+// Close writes what is held back.
+func (rw *redactWriter) Close() error {
+	_, err := rw.writer.Write(rw.buf)
+	rw.buf = nil
+	return err
+}
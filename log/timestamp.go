@@ -0,0 +1,50 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// timestampWriter writes the time, in RFC3339 format, before every line
+// written through it.
+type timestampWriter struct {
+	writer  io.Writer
+	midLine bool
+}
+
+// NewTimestampWriter returns a writer that prefixes every line written to w
+// with the time it was written.
+func NewTimestampWriter(w io.Writer) io.Writer {
+	return &timestampWriter{writer: w}
+}
+
+func (tw *timestampWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		if !tw.midLine {
+			if _, err := io.WriteString(tw.writer, time.Now().Format(time.RFC3339)+" "); err != nil {
+				return 0, err
+			}
+			tw.midLine = true
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if _, err := tw.writer.Write(p); err != nil {
+				return 0, err
+			}
+			break
+		}
+
+		if _, err := tw.writer.Write(p[:i+1]); err != nil {
+			return 0, err
+		}
+
+		tw.midLine = false
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
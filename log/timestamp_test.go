@@ -0,0 +1,37 @@
+package log
+
+import (
+	"bytes"
+	"regexp"
+
+	. "gopkg.in/check.v1"
+)
+
+var stampPattern = regexp.MustCompile(`(?m)^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(Z|[+-]\d\d:\d\d) `)
+
+func (ls *logSuite) TestTimestamp(c *C) {
+	table := []struct {
+		writes []string
+		result string
+	}{
+		{[]string{"one\ntwo\n"}, "T one\nT two\n"},
+		// lines split between writes are stamped once, at their start.
+		{[]string{"o", "ne\nt", "wo", "\n"}, "T one\nT two\n"},
+		{[]string{"one", "\n", "\n", "two"}, "T one\nT \nT two"},
+		// nothing is written before a line has started.
+		{[]string{"one\n", ""}, "T one\n"},
+	}
+
+	for _, t := range table {
+		buf := &bytes.Buffer{}
+		w := NewTimestampWriter(buf)
+
+		for _, write := range t.writes {
+			n, err := w.Write([]byte(write))
+			c.Assert(err, IsNil)
+			c.Assert(n, Equals, len(write))
+		}
+
+		c.Assert(stampPattern.ReplaceAllString(buf.String(), "T "), Equals, t.result, Commentf("%q", t.writes))
+	}
+}
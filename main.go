@@ -1,19 +1,49 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/docker/docker/pkg/term"
 	"github.com/erikh/box/builder"
+	"github.com/erikh/box/builder/executor/docker"
+	"github.com/erikh/box/builder/tar"
 	"github.com/erikh/box/log"
 	"github.com/fatih/color"
 	"github.com/urfave/cli"
 )
 
+// maxPlanSize is the largest plan fetched from a URL, in bytes.
+const maxPlanSize = 1 << 20
+
+// envFileName is the file of build arguments read from the directory of the
+// first plan.
+const envFileName = "box.env"
+
+// apiVersionPattern matches docker API versions.
+var apiVersionPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// buildIDPattern matches the build IDs that can be part of container names.
+var buildIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
 var (
 	// Version is the version of the application
 	Version = "0.2"
@@ -29,9 +59,426 @@ var (
 	// Copyright is the copyright, generated automatically for each year.
 	Copyright = fmt.Sprintf("(C) %d %s - Licensed under MIT license", time.Now().Year(), Author)
 	// UsageText is the description of how to use the program.
-	UsageText = "box [options] filename"
+	UsageText = "box [options] filename... [-- args...]\n   box [options] -e plan [-- args...]"
 )
 
+// exitCode maps an error returned from a build to the process exit status.
+func exitCode(err error) int {
+	if _, ok := err.(*docker.DaemonError); ok {
+		return 3
+	}
+
+	if berr, ok := err.(*builder.BuildError); ok {
+		switch berr.Kind {
+		case builder.ErrPlan:
+			return 2
+		case builder.ErrDaemon:
+			return 3
+		case builder.ErrDisk:
+			return 4
+		}
+	}
+
+	return 1
+}
+
+// shortID returns the image ID without its algorithm.
+func shortID(id string) string {
+	if strings.Contains(id, ":") {
+		return strings.SplitN(id, ":", 2)[1]
+	}
+
+	return id
+}
+
+// buildFailure is a failed build, as written by --error-format=json.
+type buildFailure struct {
+	Kind      string `json:"kind"`
+	Step      int    `json:"step,omitempty"`
+	Verb      string `json:"verb,omitempty"`
+	Message   string `json:"message"`
+	Container string `json:"container,omitempty"`
+	ExitCode  int    `json:"exit_code"`
+}
+
+// fail reports the error of a failed build and returns its exit status. With
+// the json format, the error is also written to w as a single line of JSON,
+// with any secrets redacted.
+func fail(err error, format string, w io.Writer, secrets []string) int {
+	fmt.Printf("!!! Error: %v\n", err)
+
+	code := exitCode(err)
+
+	if format == "json" {
+		failure := buildFailure{Kind: builder.ErrPlan.String(), Message: err.Error(), ExitCode: code}
+
+		switch err := err.(type) {
+		case *builder.BuildError:
+			failure.Kind = err.Kind.String()
+			failure.Step = err.Step
+			failure.Verb = err.Verb
+			failure.Container = err.Container
+		case *docker.DaemonError:
+			failure.Kind = builder.ErrDaemon.String()
+		}
+
+		for _, secret := range secrets {
+			failure.Message = strings.Replace(failure.Message, secret, "***", -1)
+		}
+
+		json.NewEncoder(w).Encode(failure)
+	}
+
+	return code
+}
+
+// exit exits the process with the status. It is replaced to flush output
+// first when output passes through filters.
+var exit = os.Exit
+
+// watchInterval is how often --watch looks for changes.
+const watchInterval = 500 * time.Millisecond
+
+// snapshot returns the modification time, size and mode of the files given,
+// and of everything within the directories given, keyed by name. Files that
+// are missing are left out.
+func snapshot(paths []string) map[string]string {
+	files := map[string]string{}
+
+	for _, path := range paths {
+		filepath.Walk(path, func(name string, fi os.FileInfo, err error) error {
+			if err == nil {
+				files[name] = fmt.Sprintf("%d %d %v", fi.ModTime().UnixNano(), fi.Size(), fi.Mode())
+			}
+			return nil
+		})
+	}
+
+	return files
+}
+
+// firstChange returns the first name, in lexical order, that was added,
+// removed or modified between the snapshots, or an empty string.
+func firstChange(before, after map[string]string) string {
+	names := []string{}
+	for name, state := range after {
+		if before[name] != state {
+			names = append(names, name)
+		}
+	}
+
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	sort.Strings(names)
+	return names[0]
+}
+
+// waitForChange polls the files and directories until one of them changes,
+// and returns the first to change. The change is reported once the files are
+// left alone for a poll, so a burst of writes, such as a checkout, triggers
+// one rebuild. It returns false when interrupted.
+func waitForChange(paths []string) (string, bool) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	before := snapshot(paths)
+	changed := ""
+
+	for {
+		select {
+		case <-interrupt:
+			return "", false
+		case <-time.After(watchInterval):
+		}
+
+		after := snapshot(paths)
+		name := firstChange(before, after)
+
+		if name == "" && changed != "" {
+			return changed, true
+		}
+
+		if changed == "" {
+			changed = name
+		}
+
+		before = after
+	}
+}
+
+// filterOutput replaces the file with a pipe, which is copied to the original
+// through the writer returned by wrap. The returned function closes the pipe
+// and waits for the copy to finish.
+func filterOutput(f **os.File, wrap func(io.Writer) io.Writer) (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	orig := *f
+	*f = w
+	done := make(chan struct{})
+
+	go func() {
+		filtered := wrap(orig)
+		io.Copy(filtered, r)
+		if closer, ok := filtered.(io.Closer); ok {
+			closer.Close()
+		}
+		close(done)
+	}()
+
+	return func() {
+		w.Close()
+		<-done
+		*f = orig
+	}, nil
+}
+
+// filterChain is the writer of a chain of output filters. Closing it closes
+// the filters that hold output back, such as the end of a write that could
+// be the start of a secret, from the last applied to the first, so what they
+// hold is written through the rest of the chain.
+type filterChain struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (fc *filterChain) Close() error {
+	for i := len(fc.closers) - 1; i >= 0; i-- {
+		if err := fc.closers[i].Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planClient fetches plans given as URLs. Redirects must stay on https.
+var planClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing to follow a redirect to %s", req.URL)
+		}
+
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+
+		return nil
+	},
+}
+
+// readPlan reads the plan in the named file, or fetches it if the name is an
+// https URL. A fetched plan must have one of the provided sha256 sums, if any
+// are provided.
+func readPlan(name string, sums []string) ([]byte, error) {
+	if strings.HasPrefix(name, "http://") {
+		return nil, fmt.Errorf("%s: plans are only fetched over https", name)
+	}
+
+	if !strings.HasPrefix(name, "https://") {
+		return ioutil.ReadFile(name)
+	}
+
+	resp, err := planClient.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not fetch %s: %s", name, resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPlanSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch %s: %v", name, err)
+	}
+
+	if len(content) > maxPlanSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, maxPlanSize)
+	}
+
+	if len(sums) == 0 {
+		return content, nil
+	}
+
+	sum := sha256.Sum256(content)
+	for _, want := range sums {
+		if strings.EqualFold(want, hex.EncodeToString(sum[:])) {
+			return content, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s has sha256 %x, which was not given with --plan-sha256", name, sum)
+}
+
+// cacheGraph is the cache graph of a plan, as written by --dump-cache-graph.
+type cacheGraph struct {
+	Plan  int                 `json:"plan"`
+	Steps []builder.CacheStep `json:"steps"`
+}
+
+// writeCacheGraph writes the cache graphs of the plans built so far to the
+// file as JSON.
+func writeCacheGraph(path string, graphs []cacheGraph) error {
+	content, err := json.MarshalIndent(graphs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// readPlans reads the plans with readPlan, in order.
+func readPlans(names []string, sums []string) ([][]byte, error) {
+	plans := [][]byte{}
+
+	for _, name := range names {
+		content, err := readPlan(name, sums)
+		if err != nil {
+			return nil, err
+		}
+
+		plans = append(plans, content)
+	}
+
+	return plans, nil
+}
+
+// unpackContext extracts the build context from the named tar archive, which
+// may be compressed with gzip, or from stdin if the name is -. It returns a
+// new directory, within tmpdir if provided, holding the files.
+func unpackContext(name, tmpdir string) (string, error) {
+	in := os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	r := bufio.NewReader(in)
+
+	var archive io.Reader = r
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		archive = gz
+	}
+
+	dir, err := ioutil.TempDir(tmpdir, "box-context.")
+	if err != nil {
+		return "", err
+	}
+
+	if err := tar.Extract(archive, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// gitProvenance returns the author of the images when built within a git
+// repository: the git user, and the commit checked out. It returns an empty
+// string outside of a repository.
+func gitProvenance() string {
+	git := func(args ...string) string {
+		out, err := exec.Command("git", args...).Output()
+		if err != nil {
+			return ""
+		}
+
+		return strings.TrimSpace(string(out))
+	}
+
+	sha := git("rev-parse", "--short", "HEAD")
+	if sha == "" {
+		return ""
+	}
+
+	author := git("config", "user.name")
+	if email := git("config", "user.email"); email != "" {
+		author = strings.TrimSpace(fmt.Sprintf("%s <%s>", author, email))
+	}
+
+	return strings.TrimSpace(fmt.Sprintf("%s (git %s)", author, sha))
+}
+
+// parseOutput parses the value of --output, such as "type=tar,dest=image.tar",
+// into the output type and its destination.
+func parseOutput(spec string) (string, string, error) {
+	typ, dest := "docker", ""
+
+	for _, field := range strings.Split(spec, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("Invalid output %q: expected key=value", field)
+		}
+
+		switch parts[0] {
+		case "type":
+			typ = parts[1]
+		case "dest":
+			dest = parts[1]
+		default:
+			return "", "", fmt.Errorf("Invalid output option %q", parts[0])
+		}
+	}
+
+	switch typ {
+	case "docker":
+		if dest != "" {
+			return "", "", fmt.Errorf("Output type docker does not take a dest")
+		}
+	case "tar":
+		if dest == "" {
+			dest = "-"
+		}
+	default:
+		return "", "", fmt.Errorf("Invalid output type %q; must be docker or tar", typ)
+	}
+
+	return typ, dest, nil
+}
+
+// saveImage writes the image to dest, or out if dest is "-".
+func saveImage(b *builder.Builder, dest string, out *os.File, tags []string) error {
+	if dest == "-" {
+		return b.Save(out, tags)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Save(f, tags); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+
+	return f.Close()
+}
+
 func main() {
 	app := cli.NewApp()
 
@@ -44,10 +491,125 @@ func main() {
 	app.UsageText = UsageText
 	app.HideHelp = true
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "eval, e",
+			Usage: "Build this plan instead of reading one from a file",
+		},
+		cli.StringFlag{
+			Name:   "api-version",
+			Usage:  "Use this version of the docker API, such as 1.23, to talk to the daemon",
+			EnvVar: "DOCKER_API_VERSION",
+		},
 		cli.BoolFlag{
 			Name:  "no-cache, n",
 			Usage: "Disable the build cache",
 		},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "Keep an index of the build cache in this directory",
+		},
+		cli.StringSliceFlag{
+			Name:  "cache-from",
+			Usage: "Use this image to seed the build cache. Repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "cache-to",
+			Usage: "Tag the layers of this build with this name for use with --cache-from",
+		},
+		cli.BoolFlag{
+			Name:  "cache-push",
+			Usage: "Push the tags created by --cache-to",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Also export the image: type=tar,dest=<file or - for stdout>. The default is type=docker",
+			Value: "type=docker",
+		},
+		cli.BoolFlag{
+			Name:  "no-load",
+			Usage: "Remove the image from the daemon once it is exported with --output",
+		},
+		cli.StringFlag{
+			Name:  "pin",
+			Usage: "Pin images used by from to the digests in this lockfile, adding any not yet pinned",
+		},
+		cli.StringFlag{
+			Name:  "build-id",
+			Usage: "Label or name the containers of this build with this ID (box.build-id); generated if not provided",
+		},
+		cli.BoolFlag{
+			Name:  "git-provenance",
+			Usage: "Record the git user and commit as the author of the images committed",
+		},
+		cli.BoolFlag{
+			Name:  "skip-empty",
+			Usage: "Do not commit layers for steps that change no files",
+		},
+		cli.StringSliceFlag{
+			Name:  "add-host",
+			Usage: "Add a NAME:IP entry to /etc/hosts in the build's containers. Repeatable.",
+		},
+		cli.BoolTFlag{
+			Name:  "rm",
+			Usage: "Remove the build's containers; with --rm=false, a container of the final image is kept",
+		},
+		cli.StringFlag{
+			Name:  "error-format",
+			Value: "text",
+			Usage: "Format of the error reported when the build fails: text, or json to also write it to stderr as JSON",
+		},
+		cli.BoolFlag{
+			Name:  "keep-on-failure",
+			Usage: "Keep the container of a failed step for inspection instead of removing it",
+		},
+		cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "Make copy layers independent of file ownership and of modification times after SOURCE_DATE_EPOCH (default 0)",
+		},
+		cli.BoolFlag{
+			Name:  "strict-copy",
+			Usage: "Fail copies that include unreadable files, instead of skipping them",
+		},
+		cli.BoolFlag{
+			Name:  "use-proxy",
+			Usage: "Pass HTTP_PROXY, HTTPS_PROXY, NO_PROXY and the other proxy settings of the environment to the commands run, without recording them in the image",
+		},
+		cli.BoolFlag{
+			Name:  "fail-on-stderr",
+			Usage: "Fail run and script steps whose command writes to stderr, even if it succeeds; commands are not given a TTY",
+		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "Fail the build on the patterns of strict mode: downloads piped into a shell, latest or untagged base images, and images running as root",
+		},
+		cli.BoolFlag{
+			Name:  "strict-warn",
+			Usage: "Report the patterns of strict mode, without failing the build",
+		},
+		cli.BoolFlag{
+			Name:  "safe",
+			Usage: "Build a plan that is not trusted: only read files on the host from the build context, and allow neither getenv nor privileged or host-networked containers",
+		},
+		cli.IntFlag{
+			Name:  "compress-to",
+			Usage: "Squash the layers of the image built down to at most this many, keeping the base image's layers where possible",
+		},
+		cli.StringSliceFlag{
+			Name:  "secret-env",
+			Usage: "Replace the value of this environment variable with *** wherever it is printed. Repeatable.",
+		},
+		cli.BoolFlag{
+			Name:  "timestamps",
+			Usage: "Prefix each line of output with the time, without colors; implies --no-tty",
+		},
+		cli.StringFlag{
+			Name:  "log-endpoint",
+			Usage: "Also send the output, line by line, to this endpoint: syslog at udp://HOST:PORT or tcp://HOST:PORT, or POST requests to an http(s):// URL",
+		},
+		cli.BoolFlag{
+			Name:  "no-color",
+			Usage: "Print no colors or text formatting, including those of the commands run; also set by NO_COLOR",
+		},
 		cli.BoolFlag{
 			Name:  "no-tty",
 			Usage: "Disable TTY features this run",
@@ -56,13 +618,57 @@ func main() {
 			Name:  "force-tty",
 			Usage: "Force TTY features this run",
 		},
+		cli.BoolFlag{
+			Name:  "image-tty",
+			Usage: "Record a TTY in the configuration of the images built",
+		},
 		cli.BoolFlag{
 			Name:  "help, h",
 			Usage: "Show the help",
 		},
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:  "tag, t",
-			Usage: "Tag the last image with this name",
+			Usage: "Tag the last image with this name. Repeatable.",
+		},
+		cli.StringSliceFlag{
+			Name:  "arg",
+			Usage: "Set the build argument NAME=VALUE, returned by the arg function. Repeatable.",
+		},
+		cli.StringSliceFlag{
+			Name:  "plan-sha256",
+			Usage: "Require plans fetched from https URLs to have this sha256 sum. Repeatable.",
+		},
+		cli.BoolFlag{
+			Name:  "watch",
+			Usage: "Build again whenever the plan files, or the files the build reads such as copy sources, change, until interrupted",
+		},
+		cli.StringFlag{
+			Name:  "dump-cache-graph",
+			Usage: "Write the steps of the build, with their cache keys, parents and inputs, to this file as JSON",
+		},
+		cli.BoolFlag{
+			Name:  "tag-layers",
+			Usage: "Tag the image left by each step as box-cache/<short key>, so it can be inspected or run",
+		},
+		cli.StringFlag{
+			Name:  "log-dir",
+			Usage: "Also write the output of each run and script step to a file of its own in this directory",
+		},
+		cli.StringFlag{
+			Name:  "tmpdir",
+			Usage: "Write scratch files, such as the archives of copies, to this directory instead of $TMPDIR",
+		},
+		cli.StringFlag{
+			Name:  "context",
+			Usage: "Copy files from this tar archive, or - for stdin, instead of the current directory",
+		},
+		cli.StringFlag{
+			Name:  "label-file",
+			Usage: "Label the final image with the KEY=VALUE lines of this file, without affecting the cache",
+		},
+		cli.StringFlag{
+			Name:  "target",
+			Usage: "Name the build target; steps in only_in blocks for other targets are skipped",
 		},
 		cli.StringSliceFlag{
 			Name:  "omit, o",
@@ -70,6 +676,53 @@ func main() {
 		},
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:      "lint",
+			Usage:     "Report likely problems with a build plan without building it",
+			ArgsUsage: "filename",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "omit, o",
+					Usage: "Report uses of these functions/verbs. One per option, repeatable.",
+				},
+			},
+			Action: lint,
+		},
+		{
+			Name:  "verbs",
+			Usage: "List the verbs and functions plans may call, and their arguments",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "omit, o",
+					Usage: "Leave out these functions/verbs, as a build given them would. One per option, repeatable.",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "Print the list as text, one call signature per line, or as json",
+				},
+			},
+			Action: verbs,
+		},
+		{
+			Name:      "diff",
+			Usage:     "Build two plans and report how the configuration and layers of their images differ",
+			ArgsUsage: "filename filename",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the differences as json",
+				},
+				cli.BoolFlag{
+					Name:  "no-cache, n",
+					Usage: "Build both plans without the cache",
+				},
+			},
+			Action: diff,
+		},
+	}
+
 	app.Action = func(ctx *cli.Context) {
 		if ctx.Bool("help") {
 			cli.ShowAppHelp(ctx)
@@ -78,68 +731,747 @@ func main() {
 
 		args := ctx.Args()
 
-		tty := !ctx.Bool("no-tty")
+		output, dest, err := parseOutput(ctx.String("output"))
+		if err != nil {
+			fmt.Printf("!!! Error: %v\n", err)
+			exit(1)
+		}
+
+		if ctx.Bool("no-load") && output == "docker" {
+			fmt.Println("!!! Error: --no-load requires an --output type other than docker")
+			exit(1)
+		}
+
+		errorFormat := ctx.String("error-format")
+		if errorFormat != "text" && errorFormat != "json" {
+			fmt.Printf("!!! Error: invalid --error-format %q; must be text or json\n", errorFormat)
+			exit(1)
+		}
+
+		if ctx.Bool("watch") && output == "tar" && dest == "-" {
+			fmt.Println("!!! Error: --watch cannot write the image to stdout")
+			exit(1)
+		}
+
+		if id := ctx.String("build-id"); id != "" && !buildIDPattern.MatchString(id) {
+			fmt.Printf("!!! Error: invalid --build-id %q; it names containers, so may only have letters, digits, '_', '.' and '-'\n", id)
+			exit(1)
+		}
+
+		if !ctx.BoolT("rm") && ctx.Bool("no-load") {
+			fmt.Println("!!! Error: --rm=false keeps a container of the image, which --no-load removes")
+			exit(1)
+		}
+
+		// the archive owns stdout when written there, so everything else goes
+		// to stderr.
+		stdout, stderr := os.Stdout, os.Stderr
+		if output == "tar" && dest == "-" {
+			os.Stdout = os.Stderr
+			color.Output = os.Stderr
+		}
+
+		filters := []func(io.Writer) io.Writer{}
+
+		if ctx.Bool("timestamps") {
+			color.NoColor = true
+			filters = append(filters, log.NewTimestampWriter)
+		}
+
+		// NO_COLOR is honored when set to anything, as https://no-color.org
+		// asks. Colors printed by the commands run are removed as well.
+		if ctx.Bool("no-color") || os.Getenv("NO_COLOR") != "" {
+			color.NoColor = true
+			filters = append(filters, func(w io.Writer) io.Writer {
+				return log.NewStripColorWriter(w)
+			})
+		}
+
+		// the output is mirrored to the endpoint as it is printed, once secrets
+		// are redacted.
+		var endpoint *log.Endpoint
+		if spec := ctx.String("log-endpoint"); spec != "" {
+			var err error
+			if endpoint, err = log.DialEndpoint(spec, os.Stderr); err != nil {
+				fmt.Printf("!!! Error: could not connect to --log-endpoint: %v\n", err)
+				exit(1)
+			}
+
+			filters = append(filters, func(w io.Writer) io.Writer {
+				strip := log.NewStripColorWriter(endpoint.Writer())
+				return &filterChain{Writer: io.MultiWriter(w, strip), closers: []io.Closer{strip}}
+			})
+		}
+
+		// secrets are redacted before anything else sees the output.
+		secrets := []string{}
+		for _, name := range ctx.StringSlice("secret-env") {
+			if value := os.Getenv(name); value != "" {
+				secrets = append(secrets, value)
+			}
+		}
+
+		if len(secrets) > 0 {
+			filters = append(filters, func(w io.Writer) io.Writer {
+				return log.NewRedactWriter(w, secrets)
+			})
+		}
+
+		if len(filters) > 0 {
+			wrap := func(w io.Writer) io.Writer {
+				chain := &filterChain{}
+				for _, filter := range filters {
+					w = filter(w)
+					if closer, ok := w.(io.Closer); ok {
+						chain.closers = append(chain.closers, closer)
+					}
+				}
+
+				chain.Writer = w
+				return chain
+			}
+
+			flushStdout, err := filterOutput(&os.Stdout, wrap)
+			if err != nil {
+				fmt.Printf("!!! Error: %v\n", err)
+				exit(1)
+			}
+
+			flushStderr, err := filterOutput(&os.Stderr, wrap)
+			if err != nil {
+				fmt.Printf("!!! Error: %v\n", err)
+				exit(1)
+			}
+
+			color.Output = os.Stdout
+
+			flush := func() {
+				flushStderr()
+				flushStdout()
+
+				if endpoint != nil {
+					endpoint.Close()
+				}
+			}
+			defer flush()
+
+			exit = func(code int) {
+				flush()
+				os.Exit(code)
+			}
+		}
+
+		plans := [][]byte{}
+		argv := []string{}
+		files := []string{}
+
+		// anything after the filenames must follow --, and is provided to the
+		// plans through argv. With -e there is no filename, so every argument is
+		// for the plan.
+		if expr := ctx.String("eval"); expr != "" {
+			plans = append(plans, []byte(expr))
+			argv = args
+			if len(argv) > 0 && argv[0] == "--" {
+				argv = argv[1:]
+			}
+		} else {
+			files = args
+			for i, arg := range args {
+				if arg == "--" {
+					files, argv = args[:i], args[i+1:]
+					break
+				}
+			}
+
+			if len(files) == 0 {
+				cli.ShowAppHelp(ctx)
+				color.Red("!!! Please provide a filename to process, or a plan with -e!\n\n")
+				exit(1)
+			}
+
+			var err error
+			if plans, err = readPlans(files, ctx.StringSlice("plan-sha256")); err != nil {
+				fmt.Printf("!!! Error: %v\n", err.Error())
+				exit(2)
+			}
+		}
+
+		// --watch unpacks the context again as it changes.
+		opts := readBuildOptions(ctx, files, argv)
+		if opts.contextDir != "" {
+			defer func() { os.RemoveAll(opts.contextDir) }()
+		}
+
+		opts.errorFormat, opts.stderr, opts.secrets = errorFormat, stderr, secrets
+
+		// the files read by the last build, watched by --watch along with the
+		// plan files.
+		inputs := []string{}
+
+		// build builds the plans and returns the exit status.
+		build := func() int {
+			inputs = []string{}
+
+			var b *builder.Builder
+			graphs := []cacheGraph{}
+
+			// plans starting from the same image share its resolution; each build
+			// of --watch resolves them afresh.
+			bases := builder.NewBaseCache()
+
+			// the options applying to the result, such as --tag and --output, apply
+			// to the last plan's image.
+			for i, plan := range plans {
+				final := i == len(plans)-1
+
+				var err error
+				if b, err = newBuilder(ctx, opts, final); err != nil {
+					return fail(err, errorFormat, stderr, secrets)
+				}
+				defer b.Close()
+				b.SetBaseCache(bases)
+
+				if dir := ctx.String("log-dir"); dir != "" {
+					// the steps of each plan are numbered from 1.
+					if len(plans) > 1 {
+						dir = filepath.Join(dir, strconv.Itoa(i+1))
+					}
+
+					if err := b.SetLogDir(dir, secrets); err != nil {
+						fmt.Printf("!!! Error: %v\n", err.Error())
+						return 2
+					}
+				}
+
+				response, err := b.Run(string(plan))
+				inputs = append(inputs, b.Inputs()...)
+
+				// the graph is written as far as the build got, failed or not.
+				graphFailed := false
+				if path := ctx.String("dump-cache-graph"); path != "" {
+					graphs = append(graphs, cacheGraph{Plan: i + 1, Steps: b.CacheGraph()})
+					if err := writeCacheGraph(path, graphs); err != nil {
+						fmt.Printf("!!! Can't write the cache graph to %q: %v\n", path, err)
+						graphFailed = true
+					}
+				}
+
+				if err != nil {
+					return fail(err, errorFormat, stderr, secrets)
+				}
+
+				if graphFailed {
+					return 1
+				}
+
+				if response.String() != "" {
+					log.EvalResponse(response.String())
+				}
+
+				if !final {
+					log.Finish(shortID(b.ImageID()))
+				}
+			}
+
+			if n := ctx.Int("compress-to"); n != 0 {
+				if err := b.CompressTo(n); err != nil {
+					fmt.Printf("!!! Can't compress the image: %v\n", err)
+					return 1
+				}
+			}
+
+			for _, tag := range ctx.StringSlice("tag") {
+				if err := b.Tag(tag); err != nil {
+					fmt.Printf("!!! Can't tag with tag %q: %v\n", tag, err)
+					return 1
+				}
+				log.Tag(tag)
+			}
+
+			if ref := ctx.String("cache-to"); ref != "" {
+				if err := b.CacheTo(ref, ctx.Bool("cache-push")); err != nil {
+					fmt.Printf("!!! Can't export the cache to %q: %v\n", ref, err)
+					return 1
+				}
+			}
+
+			if output == "tar" {
+				if err := saveImage(b, dest, stdout, ctx.StringSlice("tag")); err != nil {
+					fmt.Printf("!!! Can't save the image to %q: %v\n", dest, err)
+					return 1
+				}
+
+				if ctx.Bool("no-load") {
+					if err := b.Unload(ctx.StringSlice("tag")); err != nil {
+						fmt.Printf("!!! Can't remove the image from the daemon: %v\n", err)
+						return 1
+					}
+				}
+			}
+
+			log.Finish(shortID(b.ImageID()))
+			return 0
+		}
+
+		if !ctx.Bool("watch") {
+			if code := build(); code != 0 {
+				exit(code)
+			}
+			return
+		}
+
+		// files read from the build context are watched through its archive,
+		// which is unpacked again for each build.
+		contextName := ctx.String("context")
+
+		// a failed build ends the build, not the watch.
+		for {
+			build()
+
+			watched := []string{}
+			for _, input := range inputs {
+				if opts.contextDir == "" || !strings.HasPrefix(input, opts.contextDir+string(filepath.Separator)) {
+					watched = append(watched, input)
+				}
+			}
+
+			if contextName != "" && contextName != "-" {
+				watched = append(watched, contextName)
+			}
+
+			for _, file := range files {
+				if !strings.HasPrefix(file, "https://") {
+					watched = append(watched, file)
+				}
+			}
+
+			if opts.envFile != "" {
+				watched = append(watched, opts.envFile)
+			}
+
+			// the plans are built again once they can be read.
+			for {
+				fmt.Println("+++ Watching for changes; interrupt to stop")
+
+				changed, ok := waitForChange(watched)
+				if !ok {
+					return
+				}
+
+				fmt.Printf("+++ %s changed, building again\n", changed)
+
+				// the archive may have changed along with other files.
+				if contextName != "" && contextName != "-" {
+					dir, err := unpackContext(contextName, ctx.String("tmpdir"))
+					if err != nil {
+						fmt.Printf("!!! Error: could not read the build context: %v\n", err)
+						continue
+					}
+
+					os.RemoveAll(opts.contextDir)
+					opts.contextDir = dir
+				}
+
+				if len(files) == 0 {
+					break
+				}
+
+				reloaded, err := readPlans(files, ctx.StringSlice("plan-sha256"))
+				if err != nil {
+					fmt.Printf("!!! Error: %v\n", err.Error())
+					continue
+				}
+
+				reloadedArgs, err := opts.readBuildArgs()
+				if err != nil {
+					fmt.Printf("!!! Error: %v\n", err.Error())
+					continue
+				}
+
+				plans, opts.buildArgs = reloaded, reloadedArgs
+				break
+			}
+		}
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "!!! Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// buildOptions are the settings of a build read from the flags and the files
+// they name, shared by the builders of its plans and by those of diff.
+type buildOptions struct {
+	tty  bool
+	argv []string
+	// envFile is box.env next to the first plan file, if there is one.
+	envFile    string
+	flagArgs   [][]string
+	buildArgs  [][]string
+	labels     [][]string
+	contextDir string
+	epoch      int64
+
+	// client is the docker client the builders share, connected on first use.
+	client docker.Client
+
+	// errorFormat, stderr and secrets are how failures to reach the daemon
+	// are reported.
+	errorFormat string
+	stderr      io.Writer
+	secrets     []string
+}
+
+// readBuildOptions checks the flags configuring the builders of the plan
+// files, or an evaluated plan if there are none, and reads the files they
+// name. Invalid flags exit with status 1, and files that cannot be read with
+// status 2. The build context, if any, is unpacked into a directory for the
+// caller to remove.
+func readBuildOptions(ctx *cli.Context, files, argv []string) *buildOptions {
+	opts := &buildOptions{argv: argv, errorFormat: "text", stderr: os.Stderr}
+
+	// the docker client is configured from the environment.
+	if version := ctx.GlobalString("api-version"); version != "" {
+		if !apiVersionPattern.MatchString(version) {
+			fmt.Printf("!!! Error: invalid --api-version %q; must be MAJOR.MINOR, such as 1.23\n", version)
+			exit(1)
+		}
+
+		os.Setenv("DOCKER_API_VERSION", version)
+	}
 
-		if !term.IsTerminal(0) {
-			tty = ctx.Bool("force-tty")
+	opts.tty = !ctx.GlobalBool("no-tty") && !ctx.GlobalBool("timestamps")
+
+	if !term.IsTerminal(0) {
+		opts.tty = ctx.GlobalBool("force-tty")
+	}
+
+	for _, host := range ctx.GlobalStringSlice("add-host") {
+		parts := strings.SplitN(host, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+			fmt.Printf("!!! Error: invalid --add-host %q; must be NAME:IP\n", host)
+			exit(1)
+		}
+	}
+
+	for _, buildArg := range ctx.GlobalStringSlice("arg") {
+		parts := strings.SplitN(buildArg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			fmt.Printf("!!! Error: invalid --arg %q; must be NAME=VALUE\n", buildArg)
+			exit(1)
+		}
+
+		opts.flagArgs = append(opts.flagArgs, parts)
+	}
+
+	// the build arguments of box.env, next to the first plan, are set first
+	// so --arg overrides them. The file is optional.
+	if len(files) > 0 && !strings.HasPrefix(files[0], "https://") {
+		opts.envFile = filepath.Join(filepath.Dir(files[0]), envFileName)
+	}
+
+	var err error
+	if opts.buildArgs, err = opts.readBuildArgs(); err != nil {
+		fmt.Printf("!!! Error: %v\n", err.Error())
+		exit(2)
+	}
+
+	if path := ctx.GlobalString("label-file"); path != "" {
+		if opts.labels, err = builder.ReadKeyValueFile(path); err != nil {
+			fmt.Printf("!!! Error: %v\n", err.Error())
+			exit(2)
 		}
+	}
+
+	if name := ctx.GlobalString("context"); name != "" {
+		if opts.contextDir, err = unpackContext(name, ctx.GlobalString("tmpdir")); err != nil {
+			fmt.Printf("!!! Error: could not read the build context: %v\n", err)
+			exit(2)
+		}
+
+		parentExit := exit
+		exit = func(code int) {
+			os.RemoveAll(opts.contextDir)
+			parentExit(code)
+		}
+	}
+
+	if value := os.Getenv("SOURCE_DATE_EPOCH"); value != "" && ctx.GlobalBool("reproducible") {
+		if opts.epoch, err = strconv.ParseInt(value, 10, 64); err != nil {
+			fmt.Printf("!!! Error: invalid SOURCE_DATE_EPOCH %q: %v\n", value, err)
+			exit(1)
+		}
+	}
+
+	return opts
+}
+
+// readBuildArgs reads the build arguments of box.env, if there is one, and
+// adds those of --arg after them.
+func (opts *buildOptions) readBuildArgs() ([][]string, error) {
+	fileArgs := [][]string{}
+	if opts.envFile != "" {
+		var err error
+		if fileArgs, err = builder.ReadKeyValueFile(opts.envFile); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return append(fileArgs, opts.flagArgs...), nil
+}
 
-		b, err := builder.NewBuilder(tty, ctx.StringSlice("omit"))
+// newBuilder returns a builder for one of the plans of a build, configured by
+// the global flags and the options read with them. Each plan is built by a
+// builder of its own, starting from a clean state; they share the daemon,
+// cache and lockfile, so a plan can use the images of the plans before it.
+// The options applying to the result, such as --label-file, only apply to
+// the final builder. Options the builder rejects are returned as errors in
+// the plan.
+func newBuilder(ctx *cli.Context, opts *buildOptions, final bool) (*builder.Builder, error) {
+	if opts.client == nil {
+		client, err := docker.NewClient()
 		if err != nil {
+			if _, ok := err.(*docker.DaemonError); ok {
+				return nil, err
+			}
 			panic(err)
 		}
-		defer b.Close()
 
-		var content []byte
+		opts.client = client
+	}
+
+	b := builder.NewBuilderWithClient(opts.client, opts.tty, ctx.GlobalStringSlice("omit"))
 
-		if len(args) == 1 {
-			content, err = ioutil.ReadFile(args[0])
-		} else {
-			cli.ShowAppHelp(ctx)
-			color.Red("!!! Please provide a filename to process!\n\n")
-			os.Exit(1)
+	rejected := func(err error) (*builder.Builder, error) {
+		b.Close()
+		return nil, &builder.BuildError{Kind: builder.ErrPlan, Err: err}
+	}
+
+	if ctx.GlobalBool("no-cache") {
+		b.SetCache(false)
+	}
+
+	b.SetTarget(ctx.GlobalString("target"))
+	b.SetSkipEmpty(ctx.GlobalBool("skip-empty"))
+	b.SetImageTTY(ctx.GlobalBool("image-tty"))
+	b.AddHosts(ctx.GlobalStringSlice("add-host"))
+	b.SetKeepOnFailure(ctx.GlobalBool("keep-on-failure"))
+	b.SetKeepFinal(final && !ctx.GlobalBoolT("rm"))
+	b.SetTagLayers(ctx.GlobalBool("tag-layers"))
+	b.SetStrictCopy(ctx.GlobalBool("strict-copy"))
+	b.SetFailOnStderr(ctx.GlobalBool("fail-on-stderr"))
+	b.SetUseProxy(ctx.GlobalBool("use-proxy"))
+
+	if ctx.GlobalBool("strict") {
+		b.SetStrict(builder.StrictFail)
+	} else if ctx.GlobalBool("strict-warn") {
+		b.SetStrict(builder.StrictWarn)
+	}
+
+	if ctx.GlobalBool("reproducible") {
+		b.SetReproducibleCopy(time.Unix(opts.epoch, 0))
+	}
+
+	if id := ctx.GlobalString("build-id"); id != "" {
+		b.SetBuildID(id)
+	}
+
+	if ctx.GlobalBool("git-provenance") {
+		b.SetAuthor(gitProvenance())
+	}
+
+	b.SetVersion(Version)
+	b.SetArgv(opts.argv)
+
+	for _, parts := range opts.buildArgs {
+		b.SetArg(parts[0], parts[1])
+	}
+
+	if final {
+		for _, parts := range opts.labels {
+			b.SetLabel(parts[0], parts[1])
+		}
+	}
+
+	for _, name := range ctx.GlobalStringSlice("cache-from") {
+		if err := b.AddCacheSource(name); err != nil {
+			fmt.Printf("!!! Could not use %q as a cache source: %v\n", name, err)
+		}
+	}
+
+	if path := ctx.GlobalString("pin"); path != "" {
+		if err := b.SetLockfile(path); err != nil {
+			return rejected(err)
+		}
+	}
+
+	if dir := ctx.GlobalString("tmpdir"); dir != "" {
+		if err := b.SetTempDir(dir); err != nil {
+			return rejected(err)
+		}
+	}
+
+	if opts.contextDir != "" {
+		if err := b.SetContextDir(opts.contextDir); err != nil {
+			return rejected(err)
 		}
+	}
+
+	if err := b.SetSafe(ctx.GlobalBool("safe")); err != nil {
+		return rejected(err)
+	}
+
+	if dir := ctx.GlobalString("cache-dir"); dir != "" {
+		if err := b.SetCacheDir(dir); err != nil {
+			return rejected(err)
+		}
+	}
+
+	return b, nil
+}
+
+// lint implements the lint subcommand.
+func lint(ctx *cli.Context) {
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, "lint")
+		color.Red("!!! Please provide a filename to process!\n\n")
+		os.Exit(1)
+	}
+
+	content, err := readPlan(ctx.Args()[0], nil)
+	if err != nil {
+		fmt.Printf("!!! Error: %v\n", err.Error())
+		os.Exit(2)
+	}
+
+	issues, err := builder.Lint(string(content), ctx.StringSlice("omit"))
+	if err != nil {
+		fmt.Printf("!!! Error: %v\n", err.Error())
+		os.Exit(2)
+	}
+
+	for _, issue := range issues {
+		fmt.Printf("!!! %v\n", issue)
+	}
 
+	if len(issues) > 0 {
+		os.Exit(1)
+	}
+}
+
+// verbs implements the verbs subcommand.
+func verbs(ctx *cli.Context) {
+	list := builder.Verbs(ctx.StringSlice("omit"))
+
+	switch ctx.String("format") {
+	case "text":
+		for _, verb := range list {
+			kind := "verb"
+			if verb.Function {
+				kind = "function"
+			}
+
+			fmt.Printf("%-9s %v\n", kind, verb)
+		}
+	case "json":
+		content, err := json.MarshalIndent(list, "", "  ")
 		if err != nil {
 			fmt.Printf("!!! Error: %v\n", err.Error())
 			os.Exit(2)
 		}
 
-		if ctx.Bool("no-cache") {
-			b.SetCache(false)
+		fmt.Println(string(content))
+	default:
+		fmt.Printf("!!! Error: invalid --format %q; must be text or json\n", ctx.String("format"))
+		os.Exit(1)
+	}
+}
+
+// diff implements the diff subcommand. The output of the builds goes to
+// stderr, so only the differences are printed to stdout. As with diff(1), the
+// exit status is 1 if the images differ.
+func diff(ctx *cli.Context) {
+	if len(ctx.Args()) != 2 {
+		cli.ShowCommandHelp(ctx, "diff")
+		color.Red("!!! Please provide the two plans to compare!\n\n")
+		os.Exit(1)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	color.Output = os.Stderr
+
+	// the plans are built as box builds them, with the global flags.
+	opts := readBuildOptions(ctx, ctx.Args(), nil)
+	exit(compare(ctx, opts, stdout))
+}
+
+// compare builds the plans of diff and prints how their images differ to
+// stdout, returning the exit status.
+func compare(ctx *cli.Context, opts *buildOptions, stdout *os.File) int {
+	images := []string{}
+	var b *builder.Builder
+
+	// 1 is for images that differ.
+	failed := func(code int) int {
+		if code == 1 {
+			return 2
 		}
+		return code
+	}
 
-		response, err := b.Run(string(content))
+	for _, name := range ctx.Args() {
+		content, err := readPlan(name, ctx.GlobalStringSlice("plan-sha256"))
 		if err != nil {
 			fmt.Printf("!!! Error: %v\n", err.Error())
-			os.Exit(1)
+			return 2
 		}
 
-		if response.String() != "" {
-			log.EvalResponse(response.String())
+		if b, err = newBuilder(ctx, opts, true); err != nil {
+			return failed(fail(err, opts.errorFormat, opts.stderr, opts.secrets))
 		}
+		defer b.Close()
 
-		tag := ctx.String("tag")
+		if ctx.Bool("no-cache") {
+			b.SetCache(false)
+		}
 
-		if tag != "" {
-			if err := b.Tag(tag); err != nil {
-				fmt.Printf("!!! Can't tag with tag %q: %v\n", tag, err)
-				os.Exit(1)
-			}
-			log.Tag(tag)
+		if _, err := b.Run(string(content)); err != nil {
+			fmt.Printf("!!! Error building %s: %v\n", name, err)
+			return failed(exitCode(err))
 		}
 
-		id := b.ImageID()
+		images = append(images, b.ImageID())
+	}
+
+	diffs, err := b.Diff(images[0], images[1])
+	if err != nil {
+		fmt.Printf("!!! Error: %v\n", err.Error())
+		return 2
+	}
+
+	os.Stdout = stdout
+	color.Output = stdout
 
-		if strings.Contains(id, ":") {
-			id = strings.SplitN(id, ":", 2)[1]
+	if ctx.Bool("json") {
+		content, err := json.MarshalIndent(diffs, "", "  ")
+		if err != nil {
+			fmt.Printf("!!! Error: %v\n", err.Error())
+			return 2
 		}
 
-		log.Finish(id)
+		fmt.Println(string(content))
+	} else {
+		fmt.Printf("--- %s (%s)\n+++ %s (%s)\n", ctx.Args()[0], shortID(images[0]), ctx.Args()[1], shortID(images[1]))
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, "!!! Error: %v\n", err)
-		os.Exit(1)
+	if len(diffs) > 0 {
+		return 1
 	}
+
+	return 0
 }